@@ -1,6 +1,7 @@
 package apirouter
 
 import (
+	"github.com/gin-gonic/gin"
 	"github.com/leyle/fabric-user-manager/model"
 	"github.com/leyle/go-api-starter/couchdb"
 	"github.com/leyle/go-api-starter/ginhelper"
@@ -29,8 +30,19 @@ func setupCtx() *model.JWTContext {
 	}
 
 	jwtOpt := &model.JWTOption{
-		Secret:      []byte("hello"),
-		ExpireHours: 30 * 24,
+		Secret:              []byte("hello"),
+		ExpireHours:         30 * 24,
+		AccessExpireMinutes: 15,
+		RefreshExpireHours:  30 * 24,
+	}
+
+	oauth2Opt := &model.OAuth2Option{
+		Clients: []*model.OAuth2Client{
+			{
+				ClientId:     "gateway",
+				ClientSecret: "passwd",
+			},
+		},
 	}
 
 	opt := &model.Option{
@@ -38,6 +50,7 @@ func setupCtx() *model.JWTContext {
 		Registrar:      registerOpt,
 		FabricGWOption: gwOpt,
 		JWTOpt:         jwtOpt,
+		OAuth2Opt:      oauth2Opt,
 	}
 
 	ctx := &model.JWTContext{
@@ -64,3 +77,14 @@ func TestJWTRouter(t *testing.T) {
 
 	e.Run(":9000")
 }
+
+// routes must be registered without conflicts, gin panics if they conflict
+func TestJWTRouterRoutes(t *testing.T) {
+	e := gin.New()
+	ctx := setupCtx()
+	JWTRouter(ctx, e.Group("/api"))
+
+	if len(e.Routes()) == 0 {
+		t.Fatal("no routes registered")
+	}
+}
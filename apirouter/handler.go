@@ -1,12 +1,17 @@
 package apirouter
 
 import (
+	"github.com/gin-contrib/sse"
 	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
 	"github.com/leyle/fabric-user-manager/jwtwrapper"
 	"github.com/leyle/fabric-user-manager/model"
 	"github.com/leyle/go-api-starter/ginhelper"
-	"github.com/leyle/go-api-starter/util"
+	"io"
+	"net/http"
+	"strconv"
 	"strings"
+	"time"
 )
 
 type LoginForm struct {
@@ -19,37 +24,197 @@ func LoginHandler(ctx *model.JWTContext) {
 	err := ctx.C.BindJSON(&form)
 	ginhelper.StopExec(err)
 
+	// password is used as it is, spaces are valid characters
 	form.Username = strings.TrimSpace(form.Username)
-	form.Password = strings.TrimSpace(form.Password)
 
-	// we need to init system admin's user account
-	// if username and password equal ca's enrollId and secret
-	// we insert into db
-
-	caUser := ctx.Opt.Registrar.EnrollId
-	caPasswd := ctx.Opt.Registrar.Secret
+	// first admin is created by bootstrap, see jwtwrapper.Bootstrap
+	resp := jwtwrapper.JWTLogin(ctx, form.Username, form.Password)
+	if resp.Err != nil {
+		returnLoginErr(ctx, resp.Err)
+		return
+	}
 
-	if caUser == form.Username && caPasswd == form.Password {
-		// check if user exist
-		resp := insureSystemAdmin(ctx, form.Username, form.Password)
-		if resp.Err != nil {
-			ctx.Logger().Error().Err(err).Msg("init system admin failed")
-			ginhelper.ReturnErrJson(ctx.C, resp.Err.Error())
-			return
+	// second step is needed, client calls login/mfa with the challenge
+	if resp.MFA != nil {
+		retData := gin.H{
+			"mfaRequired":    true,
+			"challenge":      resp.MFA.Challenge,
+			"enrollRequired": resp.MFA.EnrollRequired,
 		}
+		ginhelper.ReturnOKJson(ctx.C, retData)
+		return
 	}
 
-	resp := jwtwrapper.JWTLogin(ctx, form.Username, form.Password)
+	retData := gin.H{
+		"token":        resp.Token,
+		"refreshToken": resp.RefreshToken,
+		"user":         resp.UserAccount.Sanitize(),
+	}
+	ginhelper.ReturnOKJson(ctx.C, retData)
+	return
+}
+
+type LoginMFAForm struct {
+	Challenge string `json:"challenge" binding:"required"`
+
+	// one of them is required, recovery code is used when authenticator is lost
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recoveryCode"`
+}
+
+func LoginMFAHandler(ctx *model.JWTContext) {
+	var form LoginMFAForm
+	err := ctx.C.BindJSON(&form)
+	ginhelper.StopExec(err)
+
+	resp := jwtwrapper.JWTLoginMFA(ctx, form.Challenge, form.Code, form.RecoveryCode)
 	if resp.Err != nil {
-		ginhelper.ReturnErrJson(ctx.C, resp.Err.Error())
+		returnLoginErr(ctx, resp.Err)
 		return
 	}
 
-	resp.UserAccount.PassHash = ""
-	resp.UserAccount.Salt = ""
 	retData := gin.H{
-		"token": resp.Token,
-		"user":  resp.UserAccount,
+		"token":        resp.Token,
+		"refreshToken": resp.RefreshToken,
+		"user":         resp.UserAccount.Sanitize(),
+	}
+	// totp is enabled in this login, recovery codes are only shown once
+	if resp.MFA != nil {
+		retData["recoveryCodes"] = resp.MFA.RecoveryCodes
+	}
+	ginhelper.ReturnOKJson(ctx.C, retData)
+	return
+}
+
+type LoginMFAEnrollForm struct {
+	Challenge string `json:"challenge" binding:"required"`
+}
+
+func LoginMFAEnrollHandler(ctx *model.JWTContext) {
+	var form LoginMFAEnrollForm
+	err := ctx.C.BindJSON(&form)
+	ginhelper.StopExec(err)
+
+	resp := jwtwrapper.JWTLoginMFAEnroll(ctx, form.Challenge)
+	if resp.Err != nil {
+		returnLoginErr(ctx, resp.Err)
+		return
+	}
+
+	ginhelper.ReturnOKJson(ctx.C, resp.MFA)
+	return
+}
+
+func EnrollMFAHandler(ctx *model.JWTContext) {
+	resp := jwtwrapper.JWTEnrollMFA(ctx)
+	if resp.Err != nil {
+		returnErr(ctx, resp.Err)
+		return
+	}
+
+	ginhelper.ReturnOKJson(ctx.C, resp.MFA)
+	return
+}
+
+type ConfirmMFAForm struct {
+	Code string `json:"code" binding:"required"`
+}
+
+func ConfirmMFAHandler(ctx *model.JWTContext) {
+	var form ConfirmMFAForm
+	err := ctx.C.BindJSON(&form)
+	ginhelper.StopExec(err)
+
+	resp := jwtwrapper.JWTConfirmMFA(ctx, form.Code)
+	if resp.Err != nil {
+		returnLoginErr(ctx, resp.Err)
+		return
+	}
+
+	ginhelper.ReturnOKJson(ctx.C, resp.MFA)
+	return
+}
+
+type DisableMFAForm struct {
+	Password string `json:"password" binding:"required"`
+
+	// one of them is required
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recoveryCode"`
+}
+
+func DisableMFAHandler(ctx *model.JWTContext) {
+	var form DisableMFAForm
+	err := ctx.C.BindJSON(&form)
+	ginhelper.StopExec(err)
+
+	resp := jwtwrapper.JWTDisableMFA(ctx, form.Password, form.Code, form.RecoveryCode)
+	if resp.Err != nil {
+		returnLoginErr(ctx, resp.Err)
+		return
+	}
+
+	ginhelper.ReturnOKJson(ctx.C, resp.UserAccount.Sanitize())
+	return
+}
+
+type ListUsersForm struct {
+	Role        model.UserRole `form:"role"`
+	Valid       *bool          `form:"valid"`
+	Username    string         `form:"username"` // prefix
+	CreatedFrom int64          `form:"createdFrom"`
+	CreatedTo   int64          `form:"createdTo"`
+	Sort        string         `form:"sort"`
+	Order       string         `form:"order" binding:"omitempty,oneof=asc desc"`
+	Limit       int            `form:"limit"`
+	Bookmark    string         `form:"bookmark"`
+}
+
+func ListUsersHandler(ctx *model.JWTContext) {
+	var form ListUsersForm
+	err := ctx.C.BindQuery(&form)
+	ginhelper.StopExec(err)
+
+	query := &model.UserQuery{
+		Role:           form.Role,
+		Valid:          form.Valid,
+		UsernamePrefix: form.Username,
+		CreatedFrom:    form.CreatedFrom,
+		CreatedTo:      form.CreatedTo,
+		Sort:           form.Sort,
+		Desc:           form.Order == "desc",
+		Limit:          form.Limit,
+		Bookmark:       form.Bookmark,
+	}
+
+	list, err := jwtwrapper.JWTListUsers(ctx, query)
+	if err != nil {
+		returnErr(ctx, err)
+		return
+	}
+
+	ginhelper.ReturnOKJson(ctx.C, list)
+	return
+}
+
+type RefreshTokenForm struct {
+	RefreshToken string `json:"refreshToken" binding:"required"`
+}
+
+func RefreshTokenHandler(ctx *model.JWTContext) {
+	var form RefreshTokenForm
+	err := ctx.C.BindJSON(&form)
+	ginhelper.StopExec(err)
+
+	resp := jwtwrapper.JWTRefresh(ctx, form.RefreshToken)
+	if resp.Err != nil {
+		ginhelper.Return401Json(ctx.C, resp.Err.Error())
+		return
+	}
+
+	retData := gin.H{
+		"token":        resp.Token,
+		"refreshToken": resp.RefreshToken,
 	}
 	ginhelper.ReturnOKJson(ctx.C, retData)
 	return
@@ -59,6 +224,10 @@ type CreateUserForm struct {
 	Username string         `json:"username" binding:"required"`
 	Password string         `json:"password" binding:"required"`
 	Role     model.UserRole `json:"role" binding:"required"`
+
+	// optional, ca identity's affiliation and attributes for chaincode's access control
+	Affiliation string               `json:"affiliation"`
+	Attrs       []*model.CAAttribute `json:"attrs"`
 }
 
 func CreateUserHandler(ctx *model.JWTContext) {
@@ -66,36 +235,545 @@ func CreateUserHandler(ctx *model.JWTContext) {
 	err := ctx.C.BindJSON(&form)
 	ginhelper.StopExec(err)
 
+	// password is used as it is, spaces are valid characters
 	form.Username = strings.TrimSpace(form.Username)
-	form.Password = strings.TrimSpace(form.Password)
 
-	resp := jwtwrapper.JWTRegister(ctx, form.Username, form.Password, form.Role)
+	resp := jwtwrapper.JWTRegister(ctx, form.Username, form.Password, form.Role, form.Affiliation, form.Attrs)
 
 	if resp.Err != nil {
-		if resp.Err == jwtwrapper.ErrContextNoClaim {
-			ginhelper.Return401Json(ctx.C, resp.Err.Error())
-			return
+		returnErr(ctx, resp.Err)
+		return
+	}
+	// user has been registered and enrolled
+	ua := resp.UserAccount.Sanitize()
+	ginhelper.ReturnOKJson(ctx.C, ua)
+	return
+}
+
+type LogoutForm struct {
+	// optional, if it's set, the refresh token family is revoked too
+	RefreshToken string `json:"refreshToken"`
+}
+
+func LogoutHandler(ctx *model.JWTContext) {
+	var form LogoutForm
+	err := ctx.C.ShouldBindJSON(&form)
+	if err != nil && err != io.EOF {
+		ginhelper.StopExec(err)
+	}
+
+	resp := jwtwrapper.JWTLogout(ctx, form.RefreshToken)
+	if resp.Err != nil {
+		ginhelper.ReturnErrJson(ctx.C, resp.Err.Error())
+		return
+	}
+
+	ginhelper.ReturnOKJson(ctx.C, "")
+	return
+}
+
+func RevokeUserSessionsHandler(ctx *model.JWTContext) {
+	userId := ctx.C.Param("id")
+
+	resp := jwtwrapper.JWTRevokeUserSessions(ctx, userId)
+	if resp.Err != nil {
+		returnErr(ctx, resp.Err)
+		return
+	}
+
+	ginhelper.ReturnOKJson(ctx.C, "")
+	return
+}
+
+// JWKSHandler returns the public keys in standard JWK set format, so it's not wrapped
+func JWKSHandler(ctx *model.JWTContext) {
+	set := jwtwrapper.JWKS(ctx)
+	ctx.C.JSON(http.StatusOK, set)
+	return
+}
+
+func ListSigningKeysHandler(ctx *model.JWTContext) {
+	keys, err := jwtwrapper.JWTListSigningKeys(ctx)
+	if err != nil {
+		returnErr(ctx, err)
+		return
+	}
+
+	ginhelper.ReturnOKJson(ctx.C, keys)
+	return
+}
+
+type RotateSigningKeyForm struct {
+	// optional, HS256/RS256/ES256/EdDSA
+	Algorithm string `json:"algorithm"`
+}
+
+func RotateSigningKeyHandler(ctx *model.JWTContext) {
+	var form RotateSigningKeyForm
+	err := ctx.C.ShouldBindJSON(&form)
+	if err != nil && err != io.EOF {
+		ginhelper.StopExec(err)
+	}
+
+	key, err := jwtwrapper.JWTRotateSigningKey(ctx, form.Algorithm)
+	if err != nil {
+		returnErr(ctx, err)
+		return
+	}
+
+	ginhelper.ReturnOKJson(ctx.C, key)
+	return
+}
+
+func RetireSigningKeyHandler(ctx *model.JWTContext) {
+	kid := ctx.C.Param("kid")
+
+	err := jwtwrapper.JWTRetireSigningKey(ctx, kid)
+	if err != nil {
+		returnErr(ctx, err)
+		return
+	}
+
+	ginhelper.ReturnOKJson(ctx.C, "")
+	return
+}
+
+type IntrospectForm struct {
+	Token         string `form:"token" binding:"required"`
+	TokenTypeHint string `form:"token_type_hint"`
+	ClientId      string `form:"client_id"`
+	ClientSecret  string `form:"client_secret"`
+}
+
+// IntrospectHandler follows RFC 7662, response is not wrapped
+func IntrospectHandler(ctx *model.JWTContext) {
+	var form IntrospectForm
+	err := ctx.C.ShouldBind(&form)
+	if err != nil {
+		ctx.C.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid_request"})
+		return
+	}
+
+	// client credentials can be in basic auth header or in form
+	clientId, clientSecret, ok := ctx.C.Request.BasicAuth()
+	if !ok {
+		clientId, clientSecret = form.ClientId, form.ClientSecret
+	}
+	err = jwtwrapper.AuthenticateOAuth2Client(ctx, clientId, clientSecret)
+	if err != nil {
+		ctx.C.Header("WWW-Authenticate", `Basic realm="introspect"`)
+		ctx.C.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
+
+	resp := jwtwrapper.Introspect(ctx, form.Token, form.TokenTypeHint)
+
+	ctx.C.Header("Cache-Control", "no-store")
+	ctx.C.JSON(http.StatusOK, resp)
+	return
+}
+
+type ChangePasswdForm struct {
+	OldPassword string `json:"oldPassword" binding:"required"`
+	NewPassword string `json:"newPassword" binding:"required"`
+}
+
+func ChangePasswdHandler(ctx *model.JWTContext) {
+	var form ChangePasswdForm
+	err := ctx.C.BindJSON(&form)
+	ginhelper.StopExec(err)
+
+	resp := jwtwrapper.JWTChangePasswd(ctx, form.OldPassword, form.NewPassword)
+	if resp.Err != nil {
+		returnErr(ctx, resp.Err)
+		return
+	}
+
+	retData := gin.H{
+		"token":        resp.Token,
+		"refreshToken": resp.RefreshToken,
+	}
+	ginhelper.ReturnOKJson(ctx.C, retData)
+	return
+}
+
+func UnlockUserHandler(ctx *model.JWTContext) {
+	userId := ctx.C.Param("id")
+
+	resp := jwtwrapper.JWTUnlockUser(ctx, userId)
+	if resp.Err != nil {
+		returnErr(ctx, resp.Err)
+		return
+	}
+
+	ginhelper.ReturnOKJson(ctx.C, resp.UserAccount.Sanitize())
+	return
+}
+
+type DisableUserForm struct {
+	Reason string `json:"reason"`
+}
+
+func DisableUserHandler(ctx *model.JWTContext) {
+	var form DisableUserForm
+	err := ctx.C.ShouldBindJSON(&form)
+	if err != nil && err != io.EOF {
+		ginhelper.StopExec(err)
+	}
+
+	userId := ctx.C.Param("id")
+	resp := jwtwrapper.JWTDisableUser(ctx, userId, form.Reason)
+	if resp.Err != nil {
+		returnErr(ctx, resp.Err)
+		return
+	}
+
+	ginhelper.ReturnOKJson(ctx.C, resp.UserAccount.Sanitize())
+	return
+}
+
+func EnableUserHandler(ctx *model.JWTContext) {
+	userId := ctx.C.Param("id")
+	resp := jwtwrapper.JWTEnableUser(ctx, userId)
+	if resp.Err != nil {
+		returnErr(ctx, resp.Err)
+		return
+	}
+
+	ginhelper.ReturnOKJson(ctx.C, resp.UserAccount.Sanitize())
+	return
+}
+
+type DeleteUserForm struct {
+	// hard delete at once even if retention is configured
+	Hard bool `form:"hard"`
+}
+
+func DeleteUserHandler(ctx *model.JWTContext) {
+	var form DeleteUserForm
+	err := ctx.C.BindQuery(&form)
+	ginhelper.StopExec(err)
+
+	userId := ctx.C.Param("id")
+	resp := jwtwrapper.JWTDeleteUser(ctx, userId, form.Hard)
+	if resp.Err != nil {
+		returnErr(ctx, resp.Err)
+		return
+	}
+
+	ginhelper.ReturnOKJson(ctx.C, resp.UserAccount.Sanitize())
+	return
+}
+
+type ReconcileForm struct {
+	// repair mismatches, default is only report them
+	Repair bool `json:"repair"`
+}
+
+func ReconcileHandler(ctx *model.JWTContext) {
+	var form ReconcileForm
+	err := ctx.C.ShouldBindJSON(&form)
+	if err != nil && err != io.EOF {
+		ginhelper.StopExec(err)
+	}
+
+	report, err := jwtwrapper.JWTReconcile(ctx, form.Repair)
+	if err != nil {
+		returnErr(ctx, err)
+		return
+	}
+
+	ginhelper.ReturnOKJson(ctx.C, report)
+	return
+}
+
+func ReloadFabricHandler(ctx *model.JWTContext) {
+	err := jwtwrapper.JWTReloadFabric(ctx)
+	if err != nil {
+		returnErr(ctx, err)
+		return
+	}
+
+	ginhelper.ReturnOKJson(ctx.C, "")
+	return
+}
+
+func ReenrollUserHandler(ctx *model.JWTContext) {
+	userId := ctx.C.Param("id")
+	resp := jwtwrapper.JWTReenrollUser(ctx, userId)
+	if resp.Err != nil {
+		returnErr(ctx, resp.Err)
+		return
+	}
+
+	ginhelper.ReturnOKJson(ctx.C, resp.UserAccount.Sanitize())
+	return
+}
+
+type UpdateCAAttrsForm struct {
+	// optional, current affiliation is kept if it's empty
+	Affiliation string `json:"affiliation"`
+
+	// all attributes of the user, those not in it are removed
+	Attrs []*model.CAAttribute `json:"attrs"`
+}
+
+func UpdateCAAttrsHandler(ctx *model.JWTContext) {
+	var form UpdateCAAttrsForm
+	err := ctx.C.BindJSON(&form)
+	ginhelper.StopExec(err)
+
+	userId := ctx.C.Param("id")
+	resp := jwtwrapper.JWTUpdateUserCAAttrs(ctx, userId, form.Affiliation, form.Attrs)
+	if resp.Err != nil {
+		returnErr(ctx, resp.Err)
+		return
+	}
+
+	ginhelper.ReturnOKJson(ctx.C, resp.UserAccount.Sanitize())
+	return
+}
+
+type ExportIdentityForm struct {
+	// password protects private key in bundle, it's needed by import
+	Password string `json:"password" binding:"required"`
+}
+
+func ExportIdentityHandler(ctx *model.JWTContext) {
+	var form ExportIdentityForm
+	err := ctx.C.BindJSON(&form)
+	ginhelper.StopExec(err)
+
+	userId := ctx.C.Param("id")
+	bundle, err := jwtwrapper.JWTExportIdentity(ctx, userId, form.Password)
+	if err != nil {
+		returnErr(ctx, err)
+		return
+	}
+
+	ginhelper.ReturnOKJson(ctx.C, bundle)
+	return
+}
+
+type ImportIdentityForm struct {
+	Password string                `json:"password" binding:"required"`
+	Bundle   *model.IdentityBundle `json:"bundle" binding:"required"`
+}
+
+func ImportIdentityHandler(ctx *model.JWTContext) {
+	var form ImportIdentityForm
+	err := ctx.C.BindJSON(&form)
+	ginhelper.StopExec(err)
+
+	userId := ctx.C.Param("id")
+	resp := jwtwrapper.JWTImportIdentity(ctx, userId, form.Password, form.Bundle)
+	if resp.Err != nil {
+		returnErr(ctx, resp.Err)
+		return
+	}
+
+	ginhelper.ReturnOKJson(ctx.C, resp.UserAccount.Sanitize())
+	return
+}
+
+type ChaincodeForm struct {
+	Function string   `json:"function" binding:"required"`
+	Args     []string `json:"args"`
+
+	// optional private data, values are passed to chaincode as they are
+	Transient map[string]string `json:"transient"`
+}
+
+func SubmitTransactionHandler(ctx *model.JWTContext) {
+	chaincodeHandler(ctx, jwtwrapper.JWTSubmitTransaction)
+}
+
+func EvaluateTransactionHandler(ctx *model.JWTContext) {
+	chaincodeHandler(ctx, jwtwrapper.JWTEvaluateTransaction)
+}
+
+func chaincodeHandler(ctx *model.JWTContext, invoke func(*model.JWTContext, *jwtwrapper.ChaincodeRequest) (*jwtwrapper.ChaincodeResult, error)) {
+	var form ChaincodeForm
+	err := ctx.C.BindJSON(&form)
+	ginhelper.StopExec(err)
+
+	req := &jwtwrapper.ChaincodeRequest{
+		Channel:   ctx.C.Param("channel"),
+		Chaincode: ctx.C.Param("chaincode"),
+		Function:  form.Function,
+		Args:      form.Args,
+	}
+	if len(form.Transient) > 0 {
+		req.Transient = make(map[string][]byte, len(form.Transient))
+		for k, v := range form.Transient {
+			req.Transient[k] = []byte(v)
 		}
-		if resp.Err == jwtwrapper.ErrUserNoPermission {
-			ginhelper.Return403Json(ctx.C, resp.Err.Error())
-			return
+	}
+
+	result, err := invoke(ctx, req)
+	if err != nil {
+		returnErr(ctx, err)
+		return
+	}
+
+	ginhelper.ReturnOKJson(ctx.C, result)
+	return
+}
+
+func GatewayPoolStatsHandler(ctx *model.JWTContext) {
+	stats, err := jwtwrapper.JWTGatewayPoolStats(ctx)
+	if err != nil {
+		returnErr(ctx, err)
+		return
+	}
+
+	ginhelper.ReturnOKJson(ctx.C, stats)
+	return
+}
+
+type EventForm struct {
+	// chaincode, block or commit
+	Type string `form:"type" binding:"required"`
+
+	Chaincode   string `form:"chaincode"`
+	EventFilter string `form:"event"`
+	TxId        string `form:"txId"`
+
+	// resume from this block, events of this block are sent again
+	FromBlock *uint64 `form:"fromBlock"`
+}
+
+const eventKeepAliveInterval = 15 * time.Second
+
+func bindEventRequest(ctx *model.JWTContext) *jwtwrapper.EventRequest {
+	var form EventForm
+	err := ctx.C.BindQuery(&form)
+	ginhelper.StopExec(err)
+
+	return &jwtwrapper.EventRequest{
+		Channel:     ctx.C.Param("channel"),
+		Type:        form.Type,
+		Chaincode:   form.Chaincode,
+		EventFilter: form.EventFilter,
+		TxId:        form.TxId,
+		FromBlock:   form.FromBlock,
+	}
+}
+
+// EventSSEHandler streams events as server-sent events, event id is block number,
+// so a reconnecting client resumes by Last-Event-ID header
+func EventSSEHandler(ctx *model.JWTContext) {
+	req := bindEventRequest(ctx)
+	if req.FromBlock == nil {
+		if lastId := ctx.C.GetHeader("Last-Event-ID"); lastId != "" {
+			if block, err := strconv.ParseUint(lastId, 10, 64); err == nil {
+				req.FromBlock = &block
+			}
 		}
+	}
 
-		ginhelper.ReturnErrJson(ctx.C, resp.Err.Error())
+	events, stop, err := jwtwrapper.JWTSubscribeEvents(ctx, req)
+	if err != nil {
+		returnErr(ctx, err)
 		return
 	}
-	ua := resp.UserAccount
-	ua.PassHash = ""
+	defer stop()
+
+	keepAlive := time.NewTicker(eventKeepAliveInterval)
+	defer keepAlive.Stop()
 
-	// enroll
-	resp2 := jwtwrapper.CAEnroll(ctx, ua.Username, ua.Id)
-	if resp2.Err != nil {
-		ctx.Logger().Error().Err(resp2.Err).Str("username", form.Username).Msg("create user failed, enroll failed")
-		ginhelper.ReturnErrJson(ctx.C, resp2.Err.Error())
+	ctx.C.Header("Cache-Control", "no-cache")
+	ctx.C.Header("X-Accel-Buffering", "no")
+	ctx.C.Stream(func(w io.Writer) bool {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				return false
+			}
+			ctx.C.Render(-1, sse.Event{
+				Id:    strconv.FormatUint(e.BlockNumber, 10),
+				Event: e.Type,
+				Data:  e,
+			})
+			return true
+		case <-keepAlive.C:
+			_, err := io.WriteString(w, ": keepalive\n\n")
+			return err == nil
+		case <-ctx.C.Request.Context().Done():
+			return false
+		}
+	})
+}
+
+var eventUpgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+}
+
+// EventWSHandler streams events as websocket json messages
+func EventWSHandler(ctx *model.JWTContext) {
+	req := bindEventRequest(ctx)
+	events, stop, err := jwtwrapper.JWTSubscribeEvents(ctx, req)
+	if err != nil {
+		returnErr(ctx, err)
 		return
 	}
+	defer stop()
 
-	ginhelper.ReturnOKJson(ctx.C, ua)
+	conn, err := eventUpgrader.Upgrade(ctx.C.Writer, ctx.C.Request, nil)
+	if err != nil {
+		ctx.Logger().Error().Err(err).Msg("upgrade to websocket failed")
+		return
+	}
+	defer conn.Close()
+
+	// client doesn't send data, reading is only to find out it's gone
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	keepAlive := time.NewTicker(eventKeepAliveInterval)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				_ = conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+				return
+			}
+			if err = conn.WriteJSON(e); err != nil {
+				return
+			}
+		case <-keepAlive.C:
+			if err = conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(time.Second)); err != nil {
+				return
+			}
+		case <-closed:
+			return
+		}
+	}
+}
+
+func ResetPasswdHandler(ctx *model.JWTContext) {
+	userId := ctx.C.Param("id")
+
+	resp := jwtwrapper.JWTResetPasswd(ctx, userId)
+	if resp.Err != nil {
+		returnErr(ctx, resp.Err)
+		return
+	}
+
+	retData := gin.H{
+		"user":         resp.UserAccount.Sanitize(),
+		"tempPassword": resp.Passwd,
+	}
+	ginhelper.ReturnOKJson(ctx.C, retData)
 	return
 }
 
@@ -103,6 +781,7 @@ type CheckTokenForm struct {
 	Token string `json:"token" binding:"required"`
 }
 
+// deprecated, use IntrospectHandler
 func CheckTokenHandler(ctx *model.JWTContext) {
 	var form CheckTokenForm
 	err := ctx.C.BindJSON(&form)
@@ -113,59 +792,41 @@ func CheckTokenHandler(ctx *model.JWTContext) {
 	ginhelper.ReturnOKJson(ctx.C, resp)
 }
 
-func insureSystemAdmin(ctx *model.JWTContext, username, passwd string) *model.JWTResponse {
-	resp := model.InitJWTResponse()
+// returnLoginErr returns 429 with Retry-After if it's locked by failed attempts
+func returnLoginErr(ctx *model.JWTContext, err error) {
+	if lerr, ok := err.(*jwtwrapper.LoginLockedError); ok {
+		retryAfter := int(lerr.RetryAfter().Seconds())
+		ctx.C.Header("Retry-After", strconv.Itoa(retryAfter))
+		ginhelper.ReturnJson(ctx.C, http.StatusTooManyRequests, http.StatusTooManyRequests, lerr.Error(), "")
+		return
+	}
+
+	returnErr(ctx, err)
+}
 
-	ua, err := model.GetUserAccountByUsername(ctx, username)
-	if err != nil {
-		resp.Err = err
-		return resp
+// returnErr maps permission errors to 401/403, known errors to their status, others are 400
+func returnErr(ctx *model.JWTContext, err error) {
+	if err == jwtwrapper.ErrContextNoClaim {
+		ginhelper.Return401Json(ctx.C, err.Error())
+		return
 	}
-	if ua == nil {
-		resp = insertSystemAdmin(ctx, username, passwd)
-		if resp.Err != nil {
-			return resp
-		}
+	if err == jwtwrapper.ErrUserNoPermission {
+		ginhelper.Return403Json(ctx.C, err.Error())
+		return
 	}
-	resp.UserAccount = ua
-
-	/*
-		var ua *model.UserAccount
-		_, err := ctx.Ds(model.DBNameUserAccount).GetById(ctx.C.Request.Context(), username, &ua)
-		if err != nil {
-			if err == couchdb.NoIdData {
-				// do insert
-				resp = insertSystemAdmin(ctx, username, passwd)
-				return resp
-			} else {
-				// other error, we need to process it
-				resp.Err = err
-				return resp
-			}
-		}
-	*/
-
-	// enroll it
-	resp2 := jwtwrapper.CAEnroll(ctx, username, passwd)
-	if resp2.Err != nil {
-		resp.Err = resp2.Err
-		ctx.Logger().Error().Err(resp.Err).Msg("enroll system admin failed")
-	}
-	return resp
-}
-
-func insertSystemAdmin(ctx *model.JWTContext, username, passwd string) *model.JWTResponse {
-	salt := util.GetCurNoSpaceTime()
-	ua := &model.UserAccount{
-		Id:       username,
-		Username: username,
-		Salt:     salt,
-		Role:     model.UserRoleAdmin,
-		Valid:    true,
-		Created:  util.GetCurTime(),
-	}
-	ua.PassHash = ua.CreatePassHash(passwd, salt)
-	ua.Updated = ua.Created
-	resp := jwtwrapper.SaveJWTUser(ctx, ua)
-	return resp
+
+	if err == model.ErrDocConflict {
+		ginhelper.ReturnJson(ctx.C, http.StatusConflict, http.StatusConflict, err.Error(), "")
+		return
+	}
+	if err == model.ErrGatewayPoolFull {
+		ginhelper.ReturnJson(ctx.C, http.StatusServiceUnavailable, http.StatusServiceUnavailable, err.Error(), "")
+		return
+	}
+	if verr, ok := err.(*model.PasswdPolicyError); ok {
+		ginhelper.ReturnJson(ctx.C, http.StatusBadRequest, http.StatusBadRequest, verr.Error(), verr)
+		return
+	}
+
+	ginhelper.ReturnErrJson(ctx.C, err.Error())
 }
@@ -2,36 +2,161 @@ package apirouter
 
 import (
 	"context"
+	"github.com/leyle/fabric-user-manager/jwtwrapper"
 	"github.com/leyle/fabric-user-manager/model"
 	"github.com/leyle/go-api-starter/logmiddleware"
+	"time"
 )
 
-// init couchdb database and index
+// init couchdb database and index, and services shared by all requests
 func Init(ctx *model.JWTContext) error {
-	// create database for user account
+	// create database/table for user account
 	tmpCtx := context.Background()
 	logger := logmiddleware.GetLogger(logmiddleware.LogTargetStdout)
 	tmpCtx = logger.WithContext(tmpCtx)
 	logger.Debug().Msg("start to Init database")
-	err := ctx.Ds(model.DBNameUserAccount).CreateDatabase(tmpCtx)
+	if initer, ok := ctx.Users().(model.UserStoreIniter); ok {
+		err := initer.Init(tmpCtx)
+		if err != nil {
+			return err
+		}
+	}
+
+	// create database for refresh token
+	err := ctx.Ds(model.DBNameRefreshToken).CreateDatabase(tmpCtx)
 	if err != nil {
 		return err
 	}
 
-	// create index
 	fields := []string{
-		"username",
-		"role",
-		"valid",
-		"created.second",
+		"familyId",
+		"userId",
+	}
+
+	err = ctx.Ds(model.DBNameRefreshToken).CreateIndex(tmpCtx, fields)
+	if err != nil {
+		return err
+	}
+
+	// create database for token revocation
+	err = ctx.Ds(model.DBNameTokenRevocation).CreateDatabase(tmpCtx)
+	if err != nil {
+		return err
+	}
+
+	// create database for generated jwt keys
+	err = ctx.Ds(model.DBNameJWTKey).CreateDatabase(tmpCtx)
+	if err != nil {
+		return err
+	}
+
+	fields = []string{
+		"status",
+	}
+
+	err = ctx.Ds(model.DBNameJWTKey).CreateIndex(tmpCtx, fields)
+	if err != nil {
+		return err
+	}
+
+	// create database for registration saga
+	err = ctx.Ds(model.DBNameRegisterSaga).CreateDatabase(tmpCtx)
+	if err != nil {
+		return err
+	}
+
+	fields = []string{
+		"status",
 		"updated.second",
 	}
 
-	err = ctx.Ds(model.DBNameUserAccount).CreateIndex(tmpCtx, fields)
+	err = ctx.Ds(model.DBNameRegisterSaga).CreateIndex(tmpCtx, fields)
+	if err != nil {
+		return err
+	}
+
+	// create database for audit log
+	err = ctx.Ds(model.DBNameAuditLog).CreateDatabase(tmpCtx)
+	if err != nil {
+		return err
+	}
+
+	fields = []string{
+		"action",
+		"targetId",
+		"created.second",
+	}
+
+	err = ctx.Ds(model.DBNameAuditLog).CreateIndex(tmpCtx, fields)
 	if err != nil {
 		return err
 	}
 
+	// wallet backend may be couchdb, then all instances share identities
+	if ctx.Wallet == nil {
+		wallet, err := model.NewWallet(ctx.Opt.FabricGWOption, ctx.Opt.CouchDBOpt)
+		if err != nil {
+			return err
+		}
+		ctx.Wallet = wallet
+	}
+	if initer, ok := ctx.Wallet.(model.WalletIniter); ok {
+		err = initer.Init(tmpCtx)
+		if err != nil {
+			return err
+		}
+	}
+
 	logger.Debug().Msg("Init database success")
+
+	// init shared services
+	if ctx.Revocation == nil {
+		ttl := time.Duration(ctx.Opt.JWTOpt.RevocationCacheSeconds) * time.Second
+		ctx.Revocation = model.NewRevocationCache(ttl)
+	}
+
+	if ctx.LoginLimiter == nil {
+		ctx.LoginLimiter = model.NewLoginLimiter(ctx.Opt.LoginThrottleOpt)
+	}
+
+	// fabric sdk is created on first use, see Close
+	if ctx.Fabric == nil {
+		ctx.Fabric = model.NewFabricClient(ctx.Opt.FabricGWOption)
+	}
+
+	if ctx.Gateways == nil {
+		ctx.Gateways = model.NewGatewayPool(ctx.Opt.GatewayPoolOpt)
+	}
+
+	// fail early if deny list file can't be read
+	err = ctx.Opt.PasswdPolicyOpt.LoadDenyList()
+	if err != nil {
+		return err
+	}
+
+	// keys generated by rotation are shared by all instances
+	err = jwtwrapper.LoadKeyRing(ctx)
+	if err != nil {
+		return err
+	}
+
+	// startup hook of bootstrap command, it's safe to run on every start
+	if ctx.Opt.BootstrapOpt != nil {
+		_, err = jwtwrapper.Bootstrap(ctx, ctx.Opt.BootstrapOpt)
+		if err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
+
+// Close releases services created by Init, it's called when server shuts down
+func Close(ctx *model.JWTContext) {
+	if ctx.Gateways != nil {
+		ctx.Gateways.Close()
+	}
+	if ctx.Fabric != nil {
+		ctx.Fabric.Close()
+	}
+}
@@ -0,0 +1,32 @@
+package apirouter
+
+import (
+	"github.com/leyle/fabric-user-manager/jwtwrapper"
+	"github.com/leyle/fabric-user-manager/model"
+)
+
+// StartBackgroundJobs starts enabled periodic jobs, they stop when stop is closed
+// ctx must be the one passed to Init
+func StartBackgroundJobs(ctx *model.JWTContext, stop <-chan struct{}) {
+	// registrations left pending by crashed requests
+	jwtwrapper.StartSagaRecovery(ctx, stop)
+
+	// idle gateways of chaincode proxy
+	jwtwrapper.StartGatewayPoolSweep(ctx, stop)
+
+	if ctx.Opt.JWTOpt.KeyRotation != nil {
+		jwtwrapper.StartKeyRotation(ctx, stop)
+	}
+
+	if ctx.Opt.UserDeleteOpt.Retention() > 0 {
+		jwtwrapper.StartUserPurge(ctx, stop)
+	}
+
+	if ctx.Opt.CertRenewOpt != nil {
+		jwtwrapper.StartCertRenew(ctx, stop)
+	}
+
+	if ctx.Opt.ReconcileOpt != nil {
+		jwtwrapper.StartReconcile(ctx, stop)
+	}
+}
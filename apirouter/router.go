@@ -14,24 +14,113 @@ func HandlerWrapper(f func(ctx *model.JWTContext), ctx *model.JWTContext) gin.Ha
 	}
 }
 
-func auth(ctx *model.JWTContext, c *gin.Context) {
+// auth checks token, if user must change password,
+// only apis registered with passwdChangeAllowed can be used
+func auth(ctx *model.JWTContext, c *gin.Context, passwdChangeAllowed bool) {
 	newCtx := ctx.New(c)
 	resp := jwtwrapper.Auth(newCtx)
 	if resp.Err != nil {
 		ginhelper.Return401Json(c, resp.Err.Error())
+		return
+	}
+
+	if resp.Claim.MustChangePasswd && !passwdChangeAllowed {
+		ginhelper.Return403Json(c, jwtwrapper.ErrMustChangePasswd.Error())
+		return
 	}
 
 	c.Next()
 }
 
+// streamAuth is auth of event stream apis, token is also read from query parameter or cookie
+// query parameter is removed, so it's not passed on
+func streamAuth(ctx *model.JWTContext, c *gin.Context) {
+	if c.GetHeader(model.JWTHeaderName) == "" {
+		token := c.Query(model.JWTQueryName)
+		if token != "" {
+			query := c.Request.URL.Query()
+			query.Del(model.JWTQueryName)
+			c.Request.URL.RawQuery = query.Encode()
+		} else if cookie, err := c.Cookie(model.JWTCookieName); err == nil {
+			token = cookie
+		}
+		if token != "" {
+			c.Request.Header.Set(model.JWTHeaderName, token)
+		}
+	}
+
+	auth(ctx, c, false)
+}
+
 func JWTRouter(ctx *model.JWTContext, g *gin.RouterGroup) {
 	// need auth api
 	authG := g.Group("/jwt", func(c *gin.Context) {
-		auth(ctx, c)
+		auth(ctx, c, false)
 	})
 	{
 		// create user
 		authG.POST("/user/create", HandlerWrapper(CreateUserHandler, ctx))
+
+		// revoke all sessions of the user
+		// apis refer to a user id are under /users, gin doesn't allow /user/:id next to /user/create
+		authG.POST("/users/:id/sessions/revoke", HandlerWrapper(RevokeUserSessionsHandler, ctx))
+
+		// admin lists and searches users
+		authG.GET("/users", HandlerWrapper(ListUsersHandler, ctx))
+
+		// admin resets user's password
+		authG.POST("/users/:id/password/reset", HandlerWrapper(ResetPasswdHandler, ctx))
+
+		// totp enrollment of current user
+		authG.POST("/user/mfa/enroll", HandlerWrapper(EnrollMFAHandler, ctx))
+		authG.POST("/user/mfa/confirm", HandlerWrapper(ConfirmMFAHandler, ctx))
+		authG.POST("/user/mfa/disable", HandlerWrapper(DisableMFAHandler, ctx))
+
+		// admin disables or enables user, certificate is revoked when disabled
+		authG.POST("/users/:id/disable", HandlerWrapper(DisableUserHandler, ctx))
+		authG.POST("/users/:id/enable", HandlerWrapper(EnableUserHandler, ctx))
+
+		// admin deletes user, its ca identity and wallet identity are removed
+		authG.DELETE("/users/:id", HandlerWrapper(DeleteUserHandler, ctx))
+
+		// admin renews user's enrollment certificate at once
+		authG.POST("/users/:id/reenroll", HandlerWrapper(ReenrollUserHandler, ctx))
+
+		// admin replaces user's ca attributes, user is re-enrolled to get them in certificate
+		authG.PUT("/users/:id/attributes", HandlerWrapper(UpdateCAAttrsHandler, ctx))
+
+		// admin exports user's wallet identity as a password protected bundle, or imports one
+		authG.POST("/users/:id/identity/export", HandlerWrapper(ExportIdentityHandler, ctx))
+		authG.POST("/users/:id/identity/import", HandlerWrapper(ImportIdentityHandler, ctx))
+
+		// admin unlocks user locked by failed logins
+		authG.POST("/users/:id/unlock", HandlerWrapper(UnlockUserHandler, ctx))
+
+		// admin checks db users, wallet and ca identities, and optionally repairs mismatches
+		authG.POST("/reconcile", HandlerWrapper(ReconcileHandler, ctx))
+
+		// admin reloads fabric connection config file
+		authG.POST("/fabric/reload", HandlerWrapper(ReloadFabricHandler, ctx))
+
+		// admin checks usage of gateway pool used by chaincode proxy
+		authG.GET("/fabric/gateways", HandlerWrapper(GatewayPoolStatsHandler, ctx))
+
+		// signing keys management
+		authG.GET("/keys", HandlerWrapper(ListSigningKeysHandler, ctx))
+		authG.POST("/keys/rotate", HandlerWrapper(RotateSigningKeyHandler, ctx))
+		authG.DELETE("/keys/:kid", HandlerWrapper(RetireSigningKeyHandler, ctx))
+	}
+
+	// need auth api, can be used when user must change password
+	passwdG := g.Group("/jwt", func(c *gin.Context) {
+		auth(ctx, c, true)
+	})
+	{
+		// logout, revoke current token
+		passwdG.POST("/user/logout", HandlerWrapper(LogoutHandler, ctx))
+
+		// change password
+		passwdG.POST("/user/password/change", HandlerWrapper(ChangePasswdHandler, ctx))
 	}
 
 	// don't need auth api
@@ -40,7 +129,43 @@ func JWTRouter(ctx *model.JWTContext, g *gin.RouterGroup) {
 		// login
 		noG.POST("/user/login", HandlerWrapper(LoginHandler, ctx))
 
-		// check token
+		// second step of login, by challenge returned from login
+		noG.POST("/user/login/mfa", HandlerWrapper(LoginMFAHandler, ctx))
+		noG.POST("/user/login/mfa/enroll", HandlerWrapper(LoginMFAEnrollHandler, ctx))
+
+		// check token, deprecated, use /oauth2/introspect
 		noG.POST("/token/check", HandlerWrapper(CheckTokenHandler, ctx))
+
+		// refresh token
+		noG.POST("/token/refresh", HandlerWrapper(RefreshTokenHandler, ctx))
+
+		// public keys to verify tokens
+		noG.GET("/.well-known/jwks.json", HandlerWrapper(JWKSHandler, ctx))
+	}
+
+	// chaincode proxy, transactions are signed by current user's wallet identity
+	fabricG := g.Group("/fabric", func(c *gin.Context) {
+		auth(ctx, c, false)
+	})
+	{
+		fabricG.POST("/:channel/:chaincode/submit", HandlerWrapper(SubmitTransactionHandler, ctx))
+		fabricG.POST("/:channel/:chaincode/evaluate", HandlerWrapper(EvaluateTransactionHandler, ctx))
+	}
+
+	// chaincode, block and commit events of the channel
+	// browser clients can't set X-TOKEN header, token may be passed by query parameter or cookie
+	eventG := g.Group("/fabric", func(c *gin.Context) {
+		streamAuth(ctx, c)
+	})
+	{
+		eventG.GET("/:channel/events/sse", HandlerWrapper(EventSSEHandler, ctx))
+		eventG.GET("/:channel/events/ws", HandlerWrapper(EventWSHandler, ctx))
+	}
+
+	// oauth2 api, authenticated by client credentials
+	oauthG := g.Group("/oauth2")
+	{
+		// RFC 7662 token introspection
+		oauthG.POST("/introspect", HandlerWrapper(IntrospectHandler, ctx))
 	}
 }
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"github.com/leyle/fabric-user-manager/apirouter"
+	"github.com/leyle/fabric-user-manager/jwtwrapper"
+	"github.com/leyle/fabric-user-manager/model"
+	"github.com/leyle/go-api-starter/couchdb"
+	"os"
+)
+
+const usage = `usage: fabric-user-manager <command> [flags]
+
+commands:
+  bootstrap  create databases, enroll registrar and create the first admin
+
+secrets are read from environment variables:
+  FUM_COUCHDB_PASSWD, FUM_REGISTRAR_SECRET, FUM_ADMIN_PASSWD, FUM_WALLET_MASTER_KEY(base64)
+
+bootstrap uses default options: couchdb user store, default password hash, password policy,
+ca affiliation and attributes. if the service sets any of them, e.g. a sql user store,
+don't use this command, set Option.BootstrapOpt in the service, apirouter.Init bootstraps
+with the service's own options on start.
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	switch os.Args[1] {
+	case "bootstrap":
+		err := bootstrap(os.Args[2:])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "bootstrap failed:", err)
+			os.Exit(1)
+		}
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+}
+
+func bootstrap(args []string) error {
+	fs := flag.NewFlagSet("bootstrap", flag.ExitOnError)
+	couchHost := fs.String("couchdb", "localhost:5984", "couchdb host:port")
+	couchUser := fs.String("couchdb-user", "admin", "couchdb user")
+	couchProtocol := fs.String("couchdb-protocol", "http", "couchdb protocol, http or https")
+	ccPath := fs.String("ccpath", "", "fabric connection config file")
+	walletPath := fs.String("wallet", "", "file wallet path")
+	walletBackend := fs.String("wallet-backend", model.WalletBackendFile, "wallet backend, file or couchdb")
+	walletPlaintext := fs.Bool("wallet-allow-plaintext", false, "read and encrypt identities saved before wallet master key is set")
+	orgName := fs.String("org", "", "fabric org name")
+	registrar := fs.String("registrar", "", "fabric ca registrar enrollId")
+	admin := fs.String("admin", "", "app admin username, empty means only registrar is enrolled")
+	fs.Parse(args)
+
+	if *ccPath == "" || *orgName == "" || *registrar == "" {
+		fs.Usage()
+		return fmt.Errorf("ccpath, org and registrar are required")
+	}
+
+	var masterKey []byte
+	if v := os.Getenv("FUM_WALLET_MASTER_KEY"); v != "" {
+		key, err := base64.StdEncoding.DecodeString(v)
+		if err != nil {
+			return err
+		}
+		masterKey = key
+	}
+
+	// only options above are set, others are defaults, see usage
+	opt := &model.Option{
+		CouchDBOpt: &couchdb.CouchDBOption{
+			HostPort: *couchHost,
+			User:     *couchUser,
+			Passwd:   os.Getenv("FUM_COUCHDB_PASSWD"),
+			Protocol: *couchProtocol,
+		},
+		Registrar: &model.FabricCARegistrar{
+			EnrollId: *registrar,
+			Secret:   os.Getenv("FUM_REGISTRAR_SECRET"),
+		},
+		FabricGWOption: &model.FabricGWOption{
+			CCPath:               *ccPath,
+			WalletPath:           *walletPath,
+			WalletBackend:        *walletBackend,
+			WalletMasterKey:      masterKey,
+			WalletAllowPlaintext: *walletPlaintext,
+			OrgName:              *orgName,
+		},
+		JWTOpt: &model.JWTOption{},
+	}
+	ctx := &model.JWTContext{Opt: opt}
+
+	// databases and indexes are created by Init, bootstrap runs after them
+	err := apirouter.Init(ctx)
+	if err != nil {
+		return err
+	}
+	defer apirouter.Close(ctx)
+
+	result, err := jwtwrapper.Bootstrap(ctx, &model.BootstrapOption{
+		AdminUsername: *admin,
+		AdminPasswd:   os.Getenv("FUM_ADMIN_PASSWD"),
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("registrar enrolled: %v, admin created: %v\n", result.RegistrarEnrolled, result.AdminCreated)
+	return nil
+}
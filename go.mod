@@ -4,9 +4,12 @@ go 1.15
 
 require (
 	github.com/dgrijalva/jwt-go v3.2.0+incompatible
+	github.com/gin-contrib/sse v0.1.0
 	github.com/gin-gonic/gin v1.6.3
+	github.com/gorilla/websocket v1.4.2
 	github.com/hyperledger/fabric-sdk-go v1.0.0-rc1
 	github.com/leyle/go-api-starter v0.0.0-20201231091755-3028923aa2c1
 	github.com/rs/zerolog v1.20.0
+	golang.org/x/crypto v0.0.0-20200622213623-75b288015ac9
 	golang.org/x/net v0.0.0-20201026091529-146b70c837a4 // indirect
 )
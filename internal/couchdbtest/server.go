@@ -0,0 +1,362 @@
+// Package couchdbtest is an in-memory couchdb used by tests
+// it implements the parts of couchdb http api used by this module:
+// database, document CRUD with revisions, _index and _find with bookmark
+package couchdbtest
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/leyle/go-api-starter/couchdb"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type Server struct {
+	*httptest.Server
+
+	mu  sync.Mutex
+	dbs map[string]map[string]map[string]interface{}
+	seq int
+}
+
+// NewServer starts a server, it's closed by Close
+func NewServer() *Server {
+	s := &Server{
+		dbs: make(map[string]map[string]map[string]interface{}),
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+// Option returns couchdb option of the server
+func (s *Server) Option() *couchdb.CouchDBOption {
+	return &couchdb.CouchDBOption{
+		HostPort: strings.TrimPrefix(s.URL, "http://"),
+		User:     "admin",
+		Passwd:   "passwd",
+		Protocol: "http",
+	}
+}
+
+// Docs returns a copy of all docs in db
+func (s *Server) Docs(db string) []map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var docs []map[string]interface{}
+	for _, doc := range s.dbs[db] {
+		docs = append(docs, copyDoc(doc))
+	}
+	return docs
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	db := parts[0]
+	if len(parts) == 1 || parts[1] == "" {
+		s.serveDB(w, r, db)
+		return
+	}
+
+	docs, ok := s.dbs[db]
+	if !ok {
+		reply(w, http.StatusNotFound, map[string]string{"error": "not_found", "reason": "Database does not exist."})
+		return
+	}
+
+	switch id := parts[1]; {
+	case id == "_index" && r.Method == http.MethodPost:
+		reply(w, http.StatusOK, map[string]string{"result": "created"})
+	case id == "_find" && r.Method == http.MethodPost:
+		s.find(w, r, docs)
+	case r.Method == http.MethodGet:
+		doc, ok := docs[id]
+		if !ok {
+			reply(w, http.StatusNotFound, map[string]string{"error": "not_found", "reason": "missing"})
+			return
+		}
+		reply(w, http.StatusOK, doc)
+	case r.Method == http.MethodPut:
+		s.put(w, r, docs, id)
+	case r.Method == http.MethodDelete:
+		doc, ok := docs[id]
+		if !ok {
+			reply(w, http.StatusNotFound, map[string]string{"error": "not_found", "reason": "missing"})
+			return
+		}
+		if doc["_rev"] != r.URL.Query().Get("rev") {
+			reply(w, http.StatusConflict, map[string]string{"error": "conflict", "reason": "Document update conflict."})
+			return
+		}
+		delete(docs, id)
+		reply(w, http.StatusOK, map[string]interface{}{"ok": true, "id": id})
+	default:
+		reply(w, http.StatusMethodNotAllowed, map[string]string{"error": "method_not_allowed"})
+	}
+}
+
+func (s *Server) serveDB(w http.ResponseWriter, r *http.Request, db string) {
+	_, ok := s.dbs[db]
+	switch r.Method {
+	case http.MethodGet:
+		if !ok {
+			reply(w, http.StatusNotFound, map[string]string{"error": "not_found", "reason": "Database does not exist."})
+			return
+		}
+		reply(w, http.StatusOK, map[string]interface{}{"db_name": db})
+	case http.MethodPut:
+		if ok {
+			reply(w, http.StatusPreconditionFailed, map[string]string{"error": "file_exists"})
+			return
+		}
+		s.dbs[db] = make(map[string]map[string]interface{})
+		reply(w, http.StatusCreated, map[string]bool{"ok": true})
+	default:
+		reply(w, http.StatusMethodNotAllowed, map[string]string{"error": "method_not_allowed"})
+	}
+}
+
+func (s *Server) put(w http.ResponseWriter, r *http.Request, docs map[string]map[string]interface{}, id string) {
+	var doc map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&doc); err != nil {
+		reply(w, http.StatusBadRequest, map[string]string{"error": "bad_request", "reason": err.Error()})
+		return
+	}
+
+	rev, _ := doc["_rev"].(string)
+	cur, ok := docs[id]
+	if (ok && cur["_rev"] != rev) || (!ok && rev != "") {
+		reply(w, http.StatusConflict, map[string]string{"error": "conflict", "reason": "Document update conflict."})
+		return
+	}
+
+	s.seq++
+	n := 1
+	if ok {
+		n, _ = strconv.Atoi(strings.SplitN(rev, "-", 2)[0])
+		n++
+	}
+	doc["_id"] = id
+	doc["_rev"] = fmt.Sprintf("%d-%08x", n, s.seq)
+	docs[id] = doc
+	reply(w, http.StatusCreated, map[string]interface{}{"ok": true, "id": id, "rev": doc["_rev"]})
+}
+
+type findRequest struct {
+	Selector map[string]interface{} `json:"selector"`
+	Sort     []map[string]string    `json:"sort"`
+	Limit    int                    `json:"limit"`
+	Skip     int                    `json:"skip"`
+	Bookmark string                 `json:"bookmark"`
+}
+
+func (s *Server) find(w http.ResponseWriter, r *http.Request, docs map[string]map[string]interface{}) {
+	var req findRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		reply(w, http.StatusBadRequest, map[string]string{"error": "bad_request", "reason": err.Error()})
+		return
+	}
+
+	var matched []map[string]interface{}
+	for _, doc := range docs {
+		if matchSelector(doc, req.Selector) {
+			matched = append(matched, doc)
+		}
+	}
+
+	// doc id is the last sort key, so pages are stable
+	sort.Slice(matched, func(i, j int) bool {
+		for _, field := range req.Sort {
+			for name, dir := range field {
+				vi, _ := fieldValue(matched[i], name)
+				vj, _ := fieldValue(matched[j], name)
+				if c := compare(vi, vj); c != 0 {
+					if dir == "desc" {
+						return c > 0
+					}
+					return c < 0
+				}
+			}
+		}
+		return matched[i]["_id"].(string) < matched[j]["_id"].(string)
+	})
+
+	offset := req.Skip
+	if req.Bookmark != "" {
+		offset, _ = strconv.Atoi(req.Bookmark)
+	}
+	if offset > len(matched) {
+		offset = len(matched)
+	}
+	end := len(matched)
+	if req.Limit > 0 && offset+req.Limit < end {
+		end = offset + req.Limit
+	}
+
+	page := matched[offset:end]
+	if page == nil {
+		page = []map[string]interface{}{}
+	}
+	reply(w, http.StatusOK, map[string]interface{}{
+		"docs":     page,
+		"bookmark": strconv.Itoa(end),
+	})
+}
+
+func matchSelector(doc map[string]interface{}, selector map[string]interface{}) bool {
+	for key, cond := range selector {
+		if key == "$or" {
+			list, _ := cond.([]interface{})
+			ok := false
+			for _, sub := range list {
+				if m, _ := sub.(map[string]interface{}); matchSelector(doc, m) {
+					ok = true
+					break
+				}
+			}
+			if !ok {
+				return false
+			}
+			continue
+		}
+
+		value, exist := fieldValue(doc, key)
+		if !matchCondition(value, exist, cond) {
+			return false
+		}
+	}
+	return true
+}
+
+func matchCondition(value interface{}, exist bool, cond interface{}) bool {
+	ops, ok := cond.(map[string]interface{})
+	if !ok || !isOperators(ops) {
+		return exist && compare(value, cond) == 0
+	}
+	if !exist {
+		return false
+	}
+	for op, arg := range ops {
+		c := compare(value, arg)
+		switch op {
+		case "$eq":
+			ok = c == 0
+		case "$ne":
+			ok = c != 0
+		case "$gt":
+			ok = c > 0
+		case "$gte":
+			ok = c >= 0
+		case "$lt":
+			ok = c < 0
+		case "$lte":
+			ok = c <= 0
+		case "$in":
+			ok = false
+			list, _ := arg.([]interface{})
+			for _, v := range list {
+				if compare(value, v) == 0 {
+					ok = true
+					break
+				}
+			}
+		default:
+			panic("couchdbtest: unsupported operator " + op)
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func isOperators(m map[string]interface{}) bool {
+	for k := range m {
+		if !strings.HasPrefix(k, "$") {
+			return false
+		}
+	}
+	return len(m) > 0
+}
+
+func fieldValue(doc map[string]interface{}, path string) (interface{}, bool) {
+	var cur interface{} = doc
+	for _, name := range strings.Split(path, ".") {
+		m, ok := cur.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if cur, ok = m[name]; !ok {
+			return nil, false
+		}
+	}
+	return cur, true
+}
+
+// compare follows couchdb collation: null < false < true < numbers < strings < others
+func compare(a, b interface{}) int {
+	ra, rb := rank(a), rank(b)
+	if ra != rb {
+		return ra - rb
+	}
+	switch av := a.(type) {
+	case bool:
+		bv := b.(bool)
+		if av == bv {
+			return 0
+		}
+		if !av {
+			return -1
+		}
+		return 1
+	case float64:
+		bv := b.(float64)
+		switch {
+		case av < bv:
+			return -1
+		case av > bv:
+			return 1
+		}
+		return 0
+	case string:
+		return strings.Compare(av, b.(string))
+	case nil:
+		return 0
+	}
+	da, _ := json.Marshal(a)
+	db, _ := json.Marshal(b)
+	return strings.Compare(string(da), string(db))
+}
+
+func rank(v interface{}) int {
+	switch v.(type) {
+	case nil:
+		return 0
+	case bool:
+		return 1
+	case float64:
+		return 2
+	case string:
+		return 3
+	}
+	return 4
+}
+
+func copyDoc(doc map[string]interface{}) map[string]interface{} {
+	data, _ := json.Marshal(doc)
+	var c map[string]interface{}
+	_ = json.Unmarshal(data, &c)
+	return c
+}
+
+func reply(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(v)
+}
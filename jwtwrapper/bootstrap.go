@@ -0,0 +1,109 @@
+package jwtwrapper
+
+import (
+	"errors"
+	"github.com/leyle/fabric-user-manager/model"
+)
+
+var ErrBootstrapAdminConflict = errors.New("bootstrap admin username is used by a non admin user")
+
+type BootstrapResult struct {
+	RegistrarEnrolled bool `json:"registrarEnrolled"`
+	AdminCreated      bool `json:"adminCreated"`
+}
+
+// Bootstrap enrolls registrar into wallet and creates the first app admin
+// it's idempotent, registrar in wallet and existing admin are kept as they are
+// databases must have been created, see apirouter.Init
+func Bootstrap(ctx *model.JWTContext, opt *model.BootstrapOption) (*BootstrapResult, error) {
+	result := &BootstrapResult{}
+
+	enrolled, err := bootstrapRegistrar(ctx)
+	if err != nil {
+		return nil, err
+	}
+	result.RegistrarEnrolled = enrolled
+	warnLegacyRegistrarAccount(ctx)
+
+	if opt == nil || opt.AdminUsername == "" {
+		return result, nil
+	}
+
+	created, err := bootstrapAdmin(ctx, opt.AdminUsername, opt.AdminPasswd)
+	if err != nil {
+		return nil, err
+	}
+	result.AdminCreated = created
+
+	return result, nil
+}
+
+// registrar's identity in wallet gives org's msp id, see orgMSPID
+func bootstrapRegistrar(ctx *model.JWTContext) (bool, error) {
+	registrar := ctx.Opt.Registrar
+	wallet, err := NewWallet(ctx)
+	if err != nil {
+		return false, err
+	}
+	// wallet outage must not be taken as not enrolled, or registrar is enrolled again
+	exist, err := model.WalletExists(wallet, registrar.EnrollId)
+	if err != nil {
+		ctx.Logger().Error().Err(err).Str("registrar", registrar.EnrollId).Msg("bootstrap, check registrar in wallet failed")
+		return false, err
+	}
+	if exist {
+		ctx.Logger().Debug().Str("registrar", registrar.EnrollId).Msg("bootstrap, registrar has been enrolled")
+		return false, nil
+	}
+
+	resp := CAEnroll(ctx, registrar.EnrollId, registrar.Secret)
+	if resp.Err != nil {
+		ctx.Logger().Error().Err(resp.Err).Str("registrar", registrar.EnrollId).Msg("bootstrap, enroll registrar failed")
+		return false, resp.Err
+	}
+
+	ctx.Logger().Info().Str("registrar", registrar.EnrollId).Msg("bootstrap, enroll registrar success")
+	return true, nil
+}
+
+func bootstrapAdmin(ctx *model.JWTContext, username, passwd string) (bool, error) {
+	ua, err := model.GetUserAccountByUsername(ctx, username)
+	if err != nil {
+		return false, err
+	}
+	if ua != nil {
+		if ua.Role != model.UserRoleAdmin {
+			return false, ErrBootstrapAdminConflict
+		}
+		ctx.Logger().Debug().Str("username", username).Msg("bootstrap, admin has been created")
+		return false, nil
+	}
+
+	err = ctx.Opt.PasswdPolicyOpt.Check(passwd, nil)
+	if err != nil {
+		return false, err
+	}
+
+	affiliation := ctx.Opt.CAAttrOpt.Affiliation("")
+	attrs := ctx.Opt.CAAttrOpt.Merge(model.UserRoleAdmin, nil)
+	resp := registerUser(ctx, username, passwd, model.UserRoleAdmin, affiliation, attrs)
+	if resp.Err != nil {
+		ctx.Logger().Error().Err(resp.Err).Str("username", username).Msg("bootstrap, create admin failed")
+		return false, resp.Err
+	}
+
+	ctx.Logger().Info().Str("username", username).Msg("bootstrap, create admin success")
+	return true, nil
+}
+
+// account created by old login shortcut uses ca secret as its password
+func warnLegacyRegistrarAccount(ctx *model.JWTContext) {
+	registrar := ctx.Opt.Registrar
+	ua, err := model.GetUserAccountByUsername(ctx, registrar.EnrollId)
+	if err != nil || ua == nil || !ua.Valid {
+		return
+	}
+	if ua.IsPasswdEqual(registrar.Secret) {
+		ctx.Logger().Warn().Str("username", ua.Username).Msg("bootstrap, registrar's app account still uses ca secret as password, disable or delete it")
+	}
+}
@@ -1,21 +1,25 @@
 package jwtwrapper
 
 import (
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
 	"github.com/hyperledger/fabric-sdk-go/pkg/client/msp"
 	"github.com/hyperledger/fabric-sdk-go/pkg/core/config"
-	"github.com/hyperledger/fabric-sdk-go/pkg/fabsdk"
 	"github.com/hyperledger/fabric-sdk-go/pkg/gateway"
 	"github.com/leyle/fabric-user-manager/model"
+	"strings"
+	"time"
 )
 
-func NewWallet(ctx *model.JWTContext) (*gateway.Wallet, error) {
+// NewWallet returns shared wallet, it's created by option's backend if Init isn't called
+func NewWallet(ctx *model.JWTContext) (model.Wallet, error) {
 	if ctx.Wallet != nil {
 		return ctx.Wallet, nil
 	}
-	walletPath := ctx.Opt.FabricGWOption.WalletPath
-	wallet, err := gateway.NewFileSystemWallet(walletPath)
+	wallet, err := model.NewWallet(ctx.Opt.FabricGWOption, ctx.Opt.CouchDBOpt)
 	if err != nil {
-		ctx.Logger().Error().Err(err).Str("wallet", walletPath).Msg("create file wallet failed")
+		ctx.Logger().Error().Err(err).Str("backend", ctx.Opt.FabricGWOption.WalletBackend).Msg("create wallet failed")
 		return nil, err
 	}
 	ctx.Wallet = wallet
@@ -45,7 +49,9 @@ func NewGateway(ctx *model.JWTContext, enrollId string) (*gateway.Gateway, error
 	return gw, nil
 }
 
-func CARegister(ctx *model.JWTContext, enrollId, secret string, role model.UserRole) *model.JWTResponse {
+// CARegister registers enrollId into ca, attrs are added into ca identity
+// affiliation can be empty, then registrar's affiliation is used by ca
+func CARegister(ctx *model.JWTContext, enrollId, secret string, role model.UserRole, affiliation string, attrs []*model.CAAttribute) *model.JWTResponse {
 	resp := getMSPClient(ctx)
 	if resp.Err != nil {
 		ctx.Logger().Error().Err(resp.Err).Str("enrollId", enrollId).Msg("create ca user, get msp client failed")
@@ -53,33 +59,75 @@ func CARegister(ctx *model.JWTContext, enrollId, secret string, role model.UserR
 	}
 
 	// check if enrollId has exists
-	if IsCAUserExist(ctx, enrollId) {
+	exist, err := caUserExists(ctx, enrollId)
+	if err != nil {
+		resp.Err = err
+		return resp
+	}
+	if exist {
 		resp.Err = ErrUserIdExist
 		ctx.Logger().Error().Err(ErrUserIdExist).Str("enrollId", enrollId).Msg("create ca user, enrollId has exists")
 		return resp
 	}
 
+	resp.Err = caRegisterIdentity(ctx, resp.MspClient, enrollId, secret, role, affiliation, attrs)
+	return resp
+}
+
+// caRegisterIdentity registers enrollId in ca without checking wallet
+// it's used when wallet may have the identity, e.g. reconciliation re-registers a missing ca identity
+func caRegisterIdentity(ctx *model.JWTContext, mspClient model.MSPClient, enrollId, secret string, role model.UserRole, affiliation string, attrs []*model.CAAttribute) error {
 	regForm := &msp.RegistrationRequest{
 		Name:           enrollId,
 		Type:           role.String(),
 		MaxEnrollments: -1,
 		Secret:         secret,
+		Affiliation:    affiliation,
+		Attributes:     toMSPAttrs(attrs),
 	}
 
-	mspClient := resp.MspClient
 	_, err := mspClient.Register(regForm)
 	if err != nil {
 		ctx.Logger().Error().Err(err).Str("enrollId", enrollId).Msg("register ca user failed")
+		return err
+	}
+
+	ctx.Logger().Debug().Str("enrollId", enrollId).Msg("register ca user success")
+	return nil
+}
+
+func toMSPAttrs(attrs []*model.CAAttribute) []msp.Attribute {
+	result := make([]msp.Attribute, 0, len(attrs))
+	for _, attr := range attrs {
+		result = append(result, msp.Attribute{
+			Name:  attr.Name,
+			Value: attr.Value,
+			ECert: attr.ECert,
+		})
+	}
+	return result
+}
+
+func CAEnroll(ctx *model.JWTContext, enrollId, secret string) *model.JWTResponse {
+	resp := caEnrollIdentity(ctx, enrollId, secret)
+	if resp.Err != nil {
+		return resp
+	}
+
+	notAfter, err := putWalletIdentity(ctx, resp.MspClient, enrollId)
+	if err != nil {
 		resp.Err = err
 		return resp
 	}
+	resp.CertNotAfter = notAfter
 
-	ctx.Logger().Debug().Str("enrollId", enrollId).Msg("register ca user success")
+	ctx.Logger().Debug().Str("enrollId", enrollId).Msg("enroll ca user success")
 
 	return resp
 }
 
-func CAEnroll(ctx *model.JWTContext, enrollId, secret string) *model.JWTResponse {
+// caEnrollIdentity enrolls enrollId, the certificate is kept in sdk's credential store
+func caEnrollIdentity(ctx *model.JWTContext, enrollId, secret string) *model.JWTResponse {
 	resp := getMSPClient(ctx)
 	if resp.Err != nil {
 		ctx.Logger().Error().Err(resp.Err).Str("enrollId", enrollId).Msg("enroll ca user, get msp client failed")
@@ -94,56 +142,111 @@ func CAEnroll(ctx *model.JWTContext, enrollId, secret string) *model.JWTResponse
 		return resp
 	}
 
+	return resp
+}
+
+// putWalletIdentity copies enrolled identity from sdk's credential store into wallet
+// expiry(unix time) of the certificate is returned
+func putWalletIdentity(ctx *model.JWTContext, mspClient model.MSPClient, enrollId string) (int64, error) {
 	si, err := mspClient.GetSigningIdentity(enrollId)
 	if err != nil {
-		resp.Err = err
 		ctx.Logger().Error().Err(err).Str("enrollId", enrollId).Msg("enroll ca user, get signing identity failed")
-		return resp
+		return 0, err
 	}
 
 	publicKey := si.EnrollmentCertificate()
 	privateKey, err := si.PrivateKey().Bytes()
 	if err != nil {
-		resp.Err = err
 		ctx.Logger().Error().Err(err).Str("enrollId", enrollId).Msg("enroll ca user, get private key failed")
-		return resp
+		return 0, err
+	}
+
+	cert, err := parseCertPEM(publicKey)
+	if err != nil {
+		ctx.Logger().Error().Err(err).Str("enrollId", enrollId).Msg("enroll ca user, parse certificate failed")
+		return 0, err
 	}
 
 	newIdentity := gateway.NewX509Identity(si.PublicVersion().Identifier().MSPID, string(publicKey), string(privateKey))
-	var wallet *gateway.Wallet
-	if ctx.Wallet != nil {
-		wallet = ctx.Wallet
-	} else {
-		wallet, err = NewWallet(ctx)
-		if err != nil {
-			resp.Err = err
-			return resp
-		}
+	wallet, err := NewWallet(ctx)
+	if err != nil {
+		return 0, err
 	}
 
 	err = wallet.Put(enrollId, newIdentity)
 	if err != nil {
-		resp.Err = err
 		ctx.Logger().Error().Err(err).Str("enrollId", enrollId).Msg("enroll ca user, put it into wallet failed")
-		return resp
+		return 0, err
 	}
+	// pooled gateway still uses old certificate
+	ctx.GatewayPool().Remove(enrollId)
+	return cert.NotAfter.Unix(), nil
+}
 
-	ctx.Logger().Debug().Str("enrollId", enrollId).Msg("enroll ca user success")
+// IsCAUserExist checks enrollId's identity in wallet, wallet errors are taken as not exist
+// use caUserExists if an outage must not be taken as not enrolled
+func IsCAUserExist(ctx *model.JWTContext, enrollId string) bool {
+	ok, _ := caUserExists(ctx, enrollId)
+	return ok
+}
 
-	return resp
+func caUserExists(ctx *model.JWTContext, enrollId string) (bool, error) {
+	wallet, err := NewWallet(ctx)
+	if err != nil {
+		return false, err
+	}
+	ok, err := model.WalletExists(wallet, enrollId)
+	if err != nil {
+		ctx.Logger().Error().Err(err).Str("enrollId", enrollId).Msg("check wallet identity failed")
+		return false, err
+	}
+	return ok, nil
 }
 
-func IsCAUserExist(ctx *model.JWTContext, enrollId string) bool {
-	if ctx.Wallet != nil {
-		return ctx.Wallet.Exists(enrollId)
-	} else {
-		wallet, err := NewWallet(ctx)
-		if err != nil {
-			return false
-		}
-		ctx.Wallet = wallet
-		return wallet.Exists(enrollId)
+// JWTReloadFabric reloads fabric connection config file, only admin can do it
+func JWTReloadFabric(ctx *model.JWTContext) error {
+	claim, err := requireAdmin(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = ctx.FabricClient().Reload()
+	if err != nil {
+		ctx.Logger().Error().Err(err).Str("ccPath", ctx.Opt.FabricGWOption.CCPath).Msg("reload fabric sdk failed")
+		return err
 	}
+	// gateways are connected by the same config file
+	ctx.GatewayPool().Purge()
+	ctx.Logger().Info().Str("username", claim.UserName).Msg("reload fabric sdk success")
+	return nil
+}
+
+// JWTGatewayPoolStats returns usage of gateway pool, only admin can do it
+func JWTGatewayPoolStats(ctx *model.JWTContext) (*model.GatewayPoolStats, error) {
+	if _, err := requireAdmin(ctx); err != nil {
+		return nil, err
+	}
+	stats := ctx.GatewayPool().Stats()
+	return &stats, nil
+}
+
+// StartGatewayPoolSweep closes idle gateways periodically until stop is closed
+func StartGatewayPoolSweep(ctx *model.JWTContext, stop <-chan struct{}) {
+	pool := ctx.GatewayPool()
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+			if n := pool.EvictIdle(); n > 0 {
+				ctx.Logger().Debug().Int("count", n).Msg("close idle gateways")
+			}
+		}
+	}()
 }
 
 func getMSPClient(ctx *model.JWTContext) *model.JWTResponse {
@@ -157,23 +260,247 @@ func getMSPClient(ctx *model.JWTContext) *model.JWTResponse {
 	}
 	ctx.Wallet = wallet
 
-	ccPath := ctx.Opt.FabricGWOption.CCPath
-	sdk, err := fabsdk.New(config.FromFile(ccPath))
+	client, err := ctx.MSPClient()
 	if err != nil {
-		ctx.Logger().Error().Err(err).Msg("create new fabric sdk failed")
+		ctx.Logger().Error().Err(err).Msg("get msp client failed")
 		resp.Err = err
 		return resp
 	}
-	defer sdk.Close()
+	resp.MspClient = client
+
+	return resp
+}
 
-	curOrg := ctx.Opt.FabricGWOption.OrgName
-	client, err := msp.New(sdk.Context(), msp.WithOrg(curOrg))
+// quarantined identities are kept in wallet for audit, they can't be used by gateway
+const walletQuarantinePrefix = "quarantine."
+
+func quarantineLabel(enrollId string) string {
+	return walletQuarantinePrefix + enrollId
+}
+
+// getWalletCert returns the enrollment certificate of enrollId in wallet
+func getWalletCert(ctx *model.JWTContext, enrollId string) (*x509.Certificate, error) {
+	wallet, err := NewWallet(ctx)
 	if err != nil {
-		ctx.Logger().Error().Err(err).Msg("create new msp client failed")
-		resp.Err = err
-		return resp
+		return nil, err
 	}
-	resp.MspClient = client
 
-	return resp
+	id, err := wallet.Get(enrollId)
+	if err != nil {
+		return nil, err
+	}
+	x509Id, ok := id.(*gateway.X509Identity)
+	if !ok {
+		return nil, ErrNoWalletCredential
+	}
+
+	return parseCertPEM([]byte(x509Id.Certificate()))
+}
+
+func parseCertPEM(data []byte) (*x509.Certificate, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, ErrNoWalletCredential
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// CARevokeCert revokes current certificate of enrollId by its serial and AKI
+// the ca identity itself is kept, so it can be enrolled again
+func CARevokeCert(ctx *model.JWTContext, enrollId, reason string) error {
+	cert, err := getWalletCert(ctx, enrollId)
+	if err != nil {
+		ctx.Logger().Error().Err(err).Str("enrollId", enrollId).Msg("revoke ca cert, get cert from wallet failed")
+		return err
+	}
+
+	resp := getMSPClient(ctx)
+	if resp.Err != nil {
+		return resp.Err
+	}
+
+	req := &msp.RevocationRequest{
+		Serial: cert.SerialNumber.Text(16),
+		AKI:    hex.EncodeToString(cert.AuthorityKeyId),
+		Reason: reason,
+	}
+	_, err = resp.MspClient.Revoke(req)
+	if err != nil {
+		ctx.Logger().Error().Err(err).Str("enrollId", enrollId).Str("serial", req.Serial).Msg("revoke ca cert failed")
+		return err
+	}
+
+	ctx.Logger().Info().Str("enrollId", enrollId).Str("serial", req.Serial).Msg("revoke ca cert success")
+	return nil
+}
+
+// CARevokeIdentity revokes all certificates ca issued to enrollId
+// it's used when wallet has no certificate to revoke by serial
+// revoked is false if enrollId isn't registered in ca
+func CARevokeIdentity(ctx *model.JWTContext, enrollId, reason string) (bool, error) {
+	resp := getMSPClient(ctx)
+	if resp.Err != nil {
+		return false, resp.Err
+	}
+
+	caId, err := getCAIdentity(ctx, resp.MspClient, enrollId)
+	if err != nil {
+		return false, err
+	}
+	if caId == nil {
+		ctx.Logger().Warn().Str("enrollId", enrollId).Msg("revoke ca identity, not registered in ca")
+		return false, nil
+	}
+
+	req := &msp.RevocationRequest{
+		Name:   enrollId,
+		Reason: reason,
+	}
+	_, err = resp.MspClient.Revoke(req)
+	if err != nil {
+		ctx.Logger().Error().Err(err).Str("enrollId", enrollId).Msg("revoke ca identity failed")
+		return false, err
+	}
+
+	ctx.Logger().Info().Str("enrollId", enrollId).Msg("revoke ca identity success")
+	return true, nil
+}
+
+// QuarantineWalletIdentity moves identity of enrollId to a label gateway doesn't use
+func QuarantineWalletIdentity(ctx *model.JWTContext, enrollId string) error {
+	wallet, err := NewWallet(ctx)
+	if err != nil {
+		return err
+	}
+	exist, err := model.WalletExists(wallet, enrollId)
+	if err != nil || !exist {
+		return err
+	}
+
+	id, err := wallet.Get(enrollId)
+	if err != nil {
+		return err
+	}
+	err = wallet.Put(quarantineLabel(enrollId), id)
+	if err != nil {
+		return err
+	}
+	err = wallet.Remove(enrollId)
+	if err != nil {
+		return err
+	}
+	ctx.GatewayPool().Remove(enrollId)
+
+	ctx.Logger().Info().Str("enrollId", enrollId).Msg("quarantine wallet identity success")
+	return nil
+}
+
+// RemoveQuarantinedIdentity drops the identity quarantined by QuarantineWalletIdentity
+func RemoveQuarantinedIdentity(ctx *model.JWTContext, enrollId string) error {
+	wallet, err := NewWallet(ctx)
+	if err != nil {
+		return err
+	}
+	label := quarantineLabel(enrollId)
+	exist, err := model.WalletExists(wallet, label)
+	if err != nil || !exist {
+		return err
+	}
+	return wallet.Remove(label)
+}
+
+// CARemoveIdentity removes enrollId from ca, its certificates are revoked by ca
+// ca server must enable identity removal, see cfg.identities.allowremove
+func CARemoveIdentity(ctx *model.JWTContext, enrollId string) error {
+	resp := getMSPClient(ctx)
+	if resp.Err != nil {
+		return resp.Err
+	}
+
+	req := &msp.RemoveIdentityRequest{
+		ID:    enrollId,
+		Force: true,
+	}
+	_, err := resp.MspClient.RemoveIdentity(req)
+	if err != nil {
+		// it may be removed by last failed call, other errors of ca are returned
+		caId, gerr := getCAIdentity(ctx, resp.MspClient, enrollId)
+		if gerr == nil && caId == nil {
+			ctx.Logger().Warn().Err(err).Str("enrollId", enrollId).Msg("remove ca identity failed, it doesn't exist")
+			return nil
+		}
+		ctx.Logger().Error().Err(err).Str("enrollId", enrollId).Msg("remove ca identity failed")
+		return err
+	}
+
+	ctx.Logger().Info().Str("enrollId", enrollId).Msg("remove ca identity success")
+	return nil
+}
+
+// fabric ca returns this code when it fails to get an identity,
+// the reason may be missing identity or a failed database request
+const caErrCodeGettingUser = "Error Code: 63 "
+
+// messages of code 63 that mean the identity doesn't exist, sql and ldap registries
+var caErrUserNotFound = []string{
+	"sql: no rows in result set",
+	"not found",
+}
+
+// fabric ca rejects registering an existing enrollId with this message
+const caErrUserRegistered = "is already registered"
+
+func isCAUserRegistered(err error) bool {
+	return strings.Contains(err.Error(), caErrUserRegistered)
+}
+
+func isCAUserNotFound(err error) bool {
+	msg := err.Error()
+	if !strings.Contains(msg, caErrCodeGettingUser) {
+		return false
+	}
+	for _, s := range caErrUserNotFound {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// getCAIdentity returns nil if enrollId isn't registered in ca
+// only the not found response of ca means nil, network and auth errors are returned
+func getCAIdentity(ctx *model.JWTContext, mspClient model.MSPClient, enrollId string) (*msp.IdentityResponse, error) {
+	caId, err := mspClient.GetIdentity(enrollId)
+	if err != nil {
+		if isCAUserNotFound(err) {
+			return nil, nil
+		}
+		ctx.Logger().Error().Err(err).Str("enrollId", enrollId).Msg("get ca identity failed")
+		return nil, err
+	}
+	return caId, nil
+}
+
+// RemoveWalletIdentity removes identity of enrollId and its quarantined copy
+func RemoveWalletIdentity(ctx *model.JWTContext, enrollId string) error {
+	wallet, err := NewWallet(ctx)
+	if err != nil {
+		return err
+	}
+	ctx.GatewayPool().Remove(enrollId)
+
+	for _, label := range []string{enrollId, quarantineLabel(enrollId)} {
+		exist, err := model.WalletExists(wallet, label)
+		if err != nil {
+			return err
+		}
+		if !exist {
+			continue
+		}
+		if err = wallet.Remove(label); err != nil {
+			ctx.Logger().Error().Err(err).Str("label", label).Msg("remove wallet identity failed")
+			return err
+		}
+	}
+	return nil
 }
@@ -0,0 +1,110 @@
+package jwtwrapper
+
+import (
+	"github.com/hyperledger/fabric-sdk-go/pkg/client/msp"
+	"github.com/leyle/fabric-user-manager/model"
+)
+
+// JWTUpdateUserCAAttrs replaces user's ca attributes, only admin can do it
+// affiliation is kept if it's empty, attributes not in attrs are removed
+// user is re-enrolled, so new attributes are put into its certificate
+func JWTUpdateUserCAAttrs(ctx *model.JWTContext, userId, affiliation string, attrs []*model.CAAttribute) *model.JWTResponse {
+	resp := model.InitJWTResponse()
+	claim, err := requireAdmin(ctx)
+	if err != nil {
+		resp.Err = err
+		return resp
+	}
+
+	if err = model.ValidateCAAttrs(attrs); err != nil {
+		resp.Err = err
+		return resp
+	}
+
+	user, err := model.GetUserAccountById(ctx, userId)
+	if err != nil {
+		resp.Err = err
+		return resp
+	}
+	if user == nil {
+		resp.Err = ErrUserNotExist
+		return resp
+	}
+	if user.DeletedAt > 0 {
+		resp.Err = ErrUserDeleted
+		return resp
+	}
+
+	err = updateUserCAAttrs(ctx, user, affiliation, attrs)
+	saveAudit(ctx, model.AuditActionUserCAAttrs, claim, user, err, map[string]interface{}{
+		"affiliation": user.Affiliation,
+		"attrs":       attrs,
+	})
+	if err != nil {
+		resp.Err = err
+		return resp
+	}
+
+	resp.UserAccount = user
+	return resp
+}
+
+func updateUserCAAttrs(ctx *model.JWTContext, user *model.UserAccount, affiliation string, attrs []*model.CAAttribute) error {
+	resp := getMSPClient(ctx)
+	if resp.Err != nil {
+		return resp.Err
+	}
+	mspClient := resp.MspClient
+
+	// affiliation is required by ca, use current one if it's not changed
+	if affiliation == "" {
+		affiliation = user.Affiliation
+	}
+	if affiliation == "" {
+		caId, err := mspClient.GetIdentity(user.Username)
+		if err != nil {
+			ctx.Logger().Error().Err(err).Str("username", user.Username).Msg("get ca identity failed")
+			return err
+		}
+		affiliation = caId.Affiliation
+	}
+
+	// ca removes an attribute when its value is empty
+	mspAttrs := toMSPAttrs(attrs)
+	keep := make(map[string]bool, len(attrs))
+	for _, attr := range attrs {
+		keep[attr.Name] = true
+	}
+	for _, attr := range user.CAAttrs {
+		if !keep[attr.Name] {
+			mspAttrs = append(mspAttrs, msp.Attribute{Name: attr.Name})
+		}
+	}
+
+	req := &msp.IdentityRequest{
+		ID:             user.Username,
+		Affiliation:    affiliation,
+		Attributes:     mspAttrs,
+		Type:           user.Role.String(),
+		MaxEnrollments: -1,
+	}
+	_, err := mspClient.ModifyIdentity(req)
+	if err != nil {
+		ctx.Logger().Error().Err(err).Str("username", user.Username).Msg("modify ca identity failed")
+		return err
+	}
+
+	user.Affiliation = affiliation
+	user.CAAttrs = attrs
+	err = model.UpdateUserAccount(ctx, user)
+	if err != nil {
+		return err
+	}
+	ctx.Logger().Info().Str("username", user.Username).Int("attrs", len(attrs)).Msg("modify ca identity success")
+
+	// disabled user has no valid certificate, it's enrolled with new attributes when enabled
+	if !user.Valid {
+		return nil
+	}
+	return reenrollUser(ctx, user)
+}
@@ -0,0 +1,158 @@
+package jwtwrapper
+
+import (
+	"github.com/hyperledger/fabric-sdk-go/pkg/client/msp"
+	"github.com/leyle/fabric-user-manager/model"
+	"time"
+)
+
+// JWTReenrollUser renews user's enrollment certificate at once, only admin can do it
+func JWTReenrollUser(ctx *model.JWTContext, userId string) *model.JWTResponse {
+	resp := model.InitJWTResponse()
+	claim, err := requireAdmin(ctx)
+	if err != nil {
+		resp.Err = err
+		return resp
+	}
+
+	user, err := model.GetUserAccountById(ctx, userId)
+	if err != nil {
+		resp.Err = err
+		return resp
+	}
+	if user == nil {
+		resp.Err = ErrUserNotExist
+		return resp
+	}
+	if user.DeletedAt > 0 {
+		resp.Err = ErrUserDeleted
+		return resp
+	}
+	// disabled user's certificate has been revoked, it's enrolled again when enabled
+	if !user.Valid {
+		resp.Err = ErrUserIsInvalid
+		return resp
+	}
+
+	err = reenrollUser(ctx, user)
+	saveAudit(ctx, model.AuditActionUserReenroll, claim, user, err, nil)
+	if err != nil {
+		resp.Err = err
+		return resp
+	}
+
+	resp.UserAccount = user
+	return resp
+}
+
+// reenrollUser gets a new certificate for user and puts it into wallet
+// Reenroll needs the current certificate in sdk's credential store, if it's not there,
+// e.g. enrolled by another instance, user is enrolled again by its secret
+func reenrollUser(ctx *model.JWTContext, user *model.UserAccount) error {
+	resp := getMSPClient(ctx)
+	if resp.Err != nil {
+		return resp.Err
+	}
+	mspClient := resp.MspClient
+
+	err := mspClient.Reenroll(user.Username)
+	if err != nil {
+		ctx.Logger().Warn().Err(err).Str("username", user.Username).Msg("reenroll ca user failed, try enroll by secret")
+		// registered user's ca secret is its id
+		err = mspClient.Enroll(user.Username, msp.WithSecret(user.Id))
+		if err != nil {
+			ctx.Logger().Error().Err(err).Str("username", user.Username).Msg("enroll ca user failed")
+			return err
+		}
+	}
+
+	notAfter, err := putWalletIdentity(ctx, mspClient, user.Username)
+	if err != nil {
+		return err
+	}
+
+	user.CertNotAfter = notAfter
+	err = model.UpdateUserAccount(ctx, user)
+	if err != nil {
+		return err
+	}
+
+	ctx.Logger().Info().Str("username", user.Username).Int64("certNotAfter", notAfter).Msg("reenroll ca user success")
+	return nil
+}
+
+// enrollUser enrolls user by its secret and saves certificate expiry
+func enrollUser(ctx *model.JWTContext, user *model.UserAccount) error {
+	resp := CAEnroll(ctx, user.Username, user.Id)
+	if resp.Err != nil {
+		return resp.Err
+	}
+	user.CertNotAfter = resp.CertNotAfter
+	return model.UpdateUserAccount(ctx, user)
+}
+
+// RenewExpiringCerts reenrolls valid users whose certificate expires within renewal window
+// users enrolled before expiry is tracked get it from wallet first
+func RenewExpiringCerts(ctx *model.JWTContext) error {
+	valid := true
+	query := &model.UserQuery{
+		Valid: &valid,
+		Limit: purgeScanLimit,
+	}
+
+	var expiring []*model.UserAccount
+	deadline := time.Now().Add(ctx.Opt.CertRenewOpt.Window()).Unix()
+	for {
+		list, err := model.ListUserAccounts(ctx, query)
+		if err != nil {
+			return err
+		}
+		for _, ua := range list.Users {
+			if ua.CertNotAfter == 0 {
+				cert, err := getWalletCert(ctx, ua.Username)
+				if err != nil {
+					ctx.Logger().Warn().Err(err).Str("username", ua.Username).Msg("get wallet cert failed, skip it")
+					continue
+				}
+				ua.CertNotAfter = cert.NotAfter.Unix()
+				if err = model.UpdateUserAccount(ctx, ua); err != nil {
+					continue
+				}
+			}
+			if ua.CertNotAfter <= deadline {
+				expiring = append(expiring, ua)
+			}
+		}
+		if list.Bookmark == "" {
+			break
+		}
+		query.Bookmark = list.Bookmark
+	}
+
+	for _, ua := range expiring {
+		err := reenrollUser(ctx, ua)
+		saveAudit(ctx, model.AuditActionUserReenroll, nil, ua, err, nil)
+		if err != nil {
+			ctx.Logger().Error().Err(err).Str("username", ua.Username).Msg("renew expiring cert failed")
+		}
+	}
+	return nil
+}
+
+// StartCertRenew renews expiring certificates periodically until stop is closed
+func StartCertRenew(ctx *model.JWTContext, stop <-chan struct{}) {
+	go func() {
+		ticker := time.NewTicker(ctx.Opt.CertRenewOpt.CheckInterval())
+		defer ticker.Stop()
+		for {
+			if err := RenewExpiringCerts(ctx); err != nil {
+				ctx.Logger().Error().Err(err).Msg("renew expiring certs failed")
+			}
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
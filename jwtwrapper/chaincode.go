@@ -0,0 +1,113 @@
+package jwtwrapper
+
+import (
+	"errors"
+	"github.com/hyperledger/fabric-sdk-go/pkg/gateway"
+	"github.com/leyle/fabric-user-manager/model"
+)
+
+var ErrEmptyChaincodeFunc = errors.New("chaincode function can't be empty")
+
+type ChaincodeRequest struct {
+	Channel   string
+	Chaincode string
+	Function  string
+	Args      []string
+
+	// private data passed to chaincode, it's not stored on ledger
+	Transient map[string][]byte
+}
+
+type ChaincodeResult struct {
+	// only submitted transaction has it, evaluation isn't sent to orderer
+	TxId    string `json:"txId,omitempty"`
+	Payload string `json:"payload"`
+}
+
+// JWTSubmitTransaction submits transaction by current user's wallet identity,
+// it returns after transaction is committed
+func JWTSubmitTransaction(ctx *model.JWTContext, req *ChaincodeRequest) (*ChaincodeResult, error) {
+	return invokeChaincode(ctx, req, true)
+}
+
+// JWTEvaluateTransaction queries chaincode by current user's wallet identity
+func JWTEvaluateTransaction(ctx *model.JWTContext, req *ChaincodeRequest) (*ChaincodeResult, error) {
+	return invokeChaincode(ctx, req, false)
+}
+
+// getPooledGateway returns a gateway shared by requests of the same user
+func getPooledGateway(ctx *model.JWTContext, enrollId string) (*gateway.Gateway, func(), error) {
+	conn, release, err := ctx.GatewayPool().Get(enrollId, func() (model.GatewayConn, error) {
+		return NewGateway(ctx, enrollId)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return conn.(*gateway.Gateway), release, nil
+}
+
+func invokeChaincode(ctx *model.JWTContext, req *ChaincodeRequest, submit bool) (*ChaincodeResult, error) {
+	claim := GetCurUser(ctx.C)
+	if claim == nil {
+		return nil, ErrContextNoClaim
+	}
+	if req.Function == "" {
+		return nil, ErrEmptyChaincodeFunc
+	}
+
+	// enrollId is username, see registerUser
+	gw, release, err := getPooledGateway(ctx, claim.UserName)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	network, err := gw.GetNetwork(req.Channel)
+	if err != nil {
+		ctx.Logger().Error().Err(err).Str("channel", req.Channel).Msg("get fabric network failed")
+		return nil, err
+	}
+	contract := network.GetContract(req.Chaincode)
+
+	var opts []gateway.TransactionOption
+	if len(req.Transient) > 0 {
+		opts = append(opts, gateway.WithTransient(req.Transient))
+	}
+	txn, err := contract.CreateTransaction(req.Function, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	logger := ctx.Logger().With().Str("username", claim.UserName).Str("channel", req.Channel).
+		Str("chaincode", req.Chaincode).Str("function", req.Function).Logger()
+
+	result := &ChaincodeResult{}
+	if !submit {
+		payload, err := txn.Evaluate(req.Args...)
+		if err != nil {
+			logger.Error().Err(err).Msg("evaluate transaction failed")
+			return nil, err
+		}
+		result.Payload = string(payload)
+		return result, nil
+	}
+
+	// commit event carries transaction id, it's queued before Submit returns
+	commit := txn.RegisterCommitEvent()
+	payload, err := txn.Submit(req.Args...)
+	if err != nil {
+		logger.Error().Err(err).Msg("submit transaction failed")
+		return nil, err
+	}
+	select {
+	case event := <-commit:
+		if event != nil {
+			result.TxId = event.TxID
+		}
+	default:
+	}
+	result.Payload = string(payload)
+
+	logger.Info().Str("txId", result.TxId).Msg("submit transaction success")
+	return result, nil
+}
@@ -0,0 +1,235 @@
+package jwtwrapper
+
+import (
+	"errors"
+	"github.com/hyperledger/fabric-sdk-go/pkg/client/event"
+	"github.com/hyperledger/fabric-sdk-go/pkg/common/providers/fab"
+	mspctx "github.com/hyperledger/fabric-sdk-go/pkg/common/providers/msp"
+	"github.com/hyperledger/fabric-sdk-go/pkg/fab/events/deliverclient/seek"
+	"github.com/hyperledger/fabric-sdk-go/pkg/fabsdk"
+	"github.com/hyperledger/fabric-sdk-go/pkg/gateway"
+	"github.com/leyle/fabric-user-manager/model"
+	"sync"
+)
+
+// event stream types
+const (
+	EventTypeChaincode = "chaincode"
+	EventTypeBlock     = "block"
+	EventTypeCommit    = "commit"
+)
+
+var (
+	ErrInvalidEventType = errors.New("event type must be chaincode, block or commit")
+	ErrEmptyEventTarget = errors.New("chaincode is required by chaincode event, txId is required by commit event")
+)
+
+type EventRequest struct {
+	Channel string
+	Type    string
+
+	// chaincode event, filter is a regular expression of event name, empty means all
+	Chaincode   string
+	EventFilter string
+
+	// commit event
+	TxId string
+
+	// resume from this block, nil means from the newest block
+	FromBlock *uint64
+}
+
+// StreamEvent is sent to client, fields are set by its type
+type StreamEvent struct {
+	Type        string `json:"type"`
+	BlockNumber uint64 `json:"blockNumber"`
+	TxId        string `json:"txId,omitempty"`
+
+	// chaincode event
+	Chaincode string `json:"chaincode,omitempty"`
+	EventName string `json:"eventName,omitempty"`
+	Payload   string `json:"payload,omitempty"`
+
+	// commit event, and transactions of block event
+	ValidationCode string        `json:"validationCode,omitempty"`
+	Transactions   []*StreamTxId `json:"transactions,omitempty"`
+}
+
+type StreamTxId struct {
+	TxId           string `json:"txId"`
+	ValidationCode string `json:"validationCode"`
+}
+
+// JWTSubscribeEvents subscribes events by current user's wallet identity
+// events are sent to returned channel until stop is called or stream ends,
+// commit stream ends after the transaction's status is sent
+func JWTSubscribeEvents(ctx *model.JWTContext, req *EventRequest) (<-chan *StreamEvent, func(), error) {
+	claim := GetCurUser(ctx.C)
+	if claim == nil {
+		return nil, nil, ErrContextNoClaim
+	}
+	switch req.Type {
+	case EventTypeChaincode:
+		if req.Chaincode == "" {
+			return nil, nil, ErrEmptyEventTarget
+		}
+	case EventTypeCommit:
+		if req.TxId == "" {
+			return nil, nil, ErrEmptyEventTarget
+		}
+	case EventTypeBlock:
+	default:
+		return nil, nil, ErrInvalidEventType
+	}
+
+	client, err := newEventClient(ctx, claim.UserName, req)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	out := make(chan *StreamEvent)
+	done := make(chan struct{})
+	var reg fab.Registration
+
+	switch req.Type {
+	case EventTypeChaincode:
+		var events <-chan *fab.CCEvent
+		reg, events, err = client.RegisterChaincodeEvent(req.Chaincode, req.EventFilter)
+		if err == nil {
+			go forwardEvents(out, done, func() (*StreamEvent, bool) {
+				e, ok := <-events
+				if !ok {
+					return nil, false
+				}
+				return &StreamEvent{
+					Type:        EventTypeChaincode,
+					BlockNumber: e.BlockNumber,
+					TxId:        e.TxID,
+					Chaincode:   e.ChaincodeID,
+					EventName:   e.EventName,
+					Payload:     string(e.Payload),
+				}, true
+			})
+		}
+	case EventTypeBlock:
+		var events <-chan *fab.FilteredBlockEvent
+		reg, events, err = client.RegisterFilteredBlockEvent()
+		if err == nil {
+			go forwardEvents(out, done, func() (*StreamEvent, bool) {
+				e, ok := <-events
+				if !ok {
+					return nil, false
+				}
+				block := e.FilteredBlock
+				se := &StreamEvent{
+					Type:        EventTypeBlock,
+					BlockNumber: block.Number,
+				}
+				for _, tx := range block.FilteredTransactions {
+					se.Transactions = append(se.Transactions, &StreamTxId{
+						TxId:           tx.Txid,
+						ValidationCode: tx.TxValidationCode.String(),
+					})
+				}
+				return se, true
+			})
+		}
+	case EventTypeCommit:
+		var events <-chan *fab.TxStatusEvent
+		reg, events, err = client.RegisterTxStatusEvent(req.TxId)
+		if err == nil {
+			sent := false
+			go forwardEvents(out, done, func() (*StreamEvent, bool) {
+				if sent {
+					return nil, false
+				}
+				e, ok := <-events
+				if !ok {
+					return nil, false
+				}
+				sent = true
+				return &StreamEvent{
+					Type:           EventTypeCommit,
+					BlockNumber:    e.BlockNumber,
+					TxId:           e.TxID,
+					ValidationCode: e.TxValidationCode.String(),
+				}, true
+			})
+		}
+	}
+	if err != nil {
+		ctx.Logger().Error().Err(err).Str("channel", req.Channel).Str("type", req.Type).Msg("register fabric event failed")
+		return nil, nil, err
+	}
+
+	ctx.Logger().Info().Str("username", claim.UserName).Str("channel", req.Channel).Str("type", req.Type).Msg("subscribe fabric events")
+	var once sync.Once
+	stop := func() {
+		once.Do(func() {
+			// event channel is closed by unregister, then forwarding goroutine exits
+			client.Unregister(reg)
+			close(done)
+		})
+	}
+	return out, stop, nil
+}
+
+// forwardEvents sends events from next to out until next ends or done is closed
+func forwardEvents(out chan<- *StreamEvent, done <-chan struct{}, next func() (*StreamEvent, bool)) {
+	defer close(out)
+	for {
+		e, ok := next()
+		if !ok {
+			return
+		}
+		select {
+		case out <- e:
+		case <-done:
+			return
+		}
+	}
+}
+
+// newEventClient creates event client signed by enrollId's wallet identity
+// full blocks are delivered, so chaincode events have payload
+func newEventClient(ctx *model.JWTContext, enrollId string, req *EventRequest) (*event.Client, error) {
+	wallet, err := NewWallet(ctx)
+	if err != nil {
+		return nil, err
+	}
+	id, err := wallet.Get(enrollId)
+	if err != nil {
+		ctx.Logger().Error().Err(err).Str("enrollId", enrollId).Msg("get wallet identity failed")
+		return nil, err
+	}
+	x509Id, ok := id.(*gateway.X509Identity)
+	if !ok {
+		return nil, ErrNoWalletCredential
+	}
+
+	fc := ctx.FabricClient()
+	mspClient, err := fc.MSPClient()
+	if err != nil {
+		return nil, err
+	}
+	si, err := mspClient.CreateSigningIdentity(mspctx.WithCert([]byte(x509Id.Certificate())), mspctx.WithPrivateKey([]byte(x509Id.Key())))
+	if err != nil {
+		ctx.Logger().Error().Err(err).Str("enrollId", enrollId).Msg("create signing identity failed")
+		return nil, err
+	}
+	sdk, err := fc.SDK()
+	if err != nil {
+		return nil, err
+	}
+
+	opts := []event.ClientOption{event.WithBlockEvents()}
+	if req.FromBlock != nil {
+		opts = append(opts, event.WithSeekType(seek.FromBlock), event.WithBlockNum(*req.FromBlock))
+	}
+	client, err := event.New(sdk.ChannelContext(req.Channel, fabsdk.WithIdentity(si)), opts...)
+	if err != nil {
+		ctx.Logger().Error().Err(err).Str("channel", req.Channel).Msg("create fabric event client failed")
+		return nil, err
+	}
+	return client, nil
+}
@@ -0,0 +1,283 @@
+package jwtwrapper
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/hyperledger/fabric-sdk-go/pkg/client/msp"
+	"github.com/hyperledger/fabric-sdk-go/pkg/common/providers/core"
+	mspctx "github.com/hyperledger/fabric-sdk-go/pkg/common/providers/msp"
+	"math/big"
+	"sync"
+	"time"
+)
+
+const fakeMSPID = "Org1MSP"
+
+// fakeCA is an in-memory fabric ca, errors use the text of fabric ca responses
+type fakeCA struct {
+	mu         sync.Mutex
+	identities map[string]*fakeCAIdentity
+	signing    map[string]*fakeSigningIdentity
+	serial     int64
+
+	// names passed to RemoveIdentity, in order
+	removed []string
+
+	// runs before Register checks the name, e.g. another request registers it first
+	beforeRegister func(name string)
+	// returned after Register has taken effect, e.g. its response is lost
+	registerErr error
+	// returned by GetIdentity when it's set
+	getErr error
+	// returned by Enroll when it's set
+	enrollErr error
+}
+
+type fakeCAIdentity struct {
+	resp   *msp.IdentityResponse
+	secret string
+}
+
+func newFakeCA() *fakeCA {
+	return &fakeCA{
+		identities: make(map[string]*fakeCAIdentity),
+		signing:    make(map[string]*fakeSigningIdentity),
+	}
+}
+
+// add registers an identity not created by this service
+func (ca *fakeCA) add(name, typ, secret string) {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	ca.identities[name] = &fakeCAIdentity{
+		resp:   &msp.IdentityResponse{ID: name, Type: typ},
+		secret: secret,
+	}
+}
+
+func (ca *fakeCA) has(name string) bool {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	_, ok := ca.identities[name]
+	return ok
+}
+
+func (ca *fakeCA) wasRemoved(name string) bool {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	for _, n := range ca.removed {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+func caNotFoundErr() error {
+	return errors.New("Response from server: Error Code: 63 - Failed to get User: sql: no rows in result set")
+}
+
+func (ca *fakeCA) Register(request *msp.RegistrationRequest) (string, error) {
+	if ca.beforeRegister != nil {
+		ca.beforeRegister(request.Name)
+	}
+
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	if _, ok := ca.identities[request.Name]; ok {
+		return "", fmt.Errorf("Response from server: Error Code: 74 - Identity '%s' is already registered", request.Name)
+	}
+	ca.identities[request.Name] = &fakeCAIdentity{
+		resp: &msp.IdentityResponse{
+			ID:             request.Name,
+			Type:           request.Type,
+			Affiliation:    request.Affiliation,
+			Attributes:     request.Attributes,
+			MaxEnrollments: request.MaxEnrollments,
+		},
+		secret: request.Secret,
+	}
+	if ca.registerErr != nil {
+		return "", ca.registerErr
+	}
+	return request.Secret, nil
+}
+
+func (ca *fakeCA) Enroll(enrollmentID string, opts ...msp.EnrollmentOption) error {
+	if ca.enrollErr != nil {
+		return ca.enrollErr
+	}
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	if _, ok := ca.identities[enrollmentID]; !ok {
+		return errors.New("Response from server: Error Code: 20 - Authentication failure")
+	}
+	return ca.issue(enrollmentID)
+}
+
+func (ca *fakeCA) Reenroll(enrollmentID string, opts ...msp.EnrollmentOption) error {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	return ca.issue(enrollmentID)
+}
+
+// issue creates a self signed certificate with enrollId as common name
+func (ca *fakeCA) issue(enrollId string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	ca.serial++
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(ca.serial),
+		Subject:      pkix.Name{CommonName: enrollId},
+		NotBefore:    now.Add(-time.Minute),
+		NotAfter:     now.Add(365 * 24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDer, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	ca.signing[enrollId] = &fakeSigningIdentity{
+		id:   enrollId,
+		cert: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		key:  pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDer}),
+	}
+	return nil
+}
+
+func (ca *fakeCA) GetIdentity(ID string, opts ...msp.RequestOption) (*msp.IdentityResponse, error) {
+	if ca.getErr != nil {
+		return nil, ca.getErr
+	}
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	id, ok := ca.identities[ID]
+	if !ok {
+		return nil, caNotFoundErr()
+	}
+	resp := *id.resp
+	return &resp, nil
+}
+
+func (ca *fakeCA) GetAllIdentities(opts ...msp.RequestOption) ([]*msp.IdentityResponse, error) {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	var result []*msp.IdentityResponse
+	for _, id := range ca.identities {
+		resp := *id.resp
+		result = append(result, &resp)
+	}
+	return result, nil
+}
+
+func (ca *fakeCA) ModifyIdentity(request *msp.IdentityRequest) (*msp.IdentityResponse, error) {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	id, ok := ca.identities[request.ID]
+	if !ok {
+		return nil, caNotFoundErr()
+	}
+	id.resp.Attributes = request.Attributes
+	resp := *id.resp
+	return &resp, nil
+}
+
+func (ca *fakeCA) RemoveIdentity(request *msp.RemoveIdentityRequest) (*msp.IdentityResponse, error) {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	ca.removed = append(ca.removed, request.ID)
+	id, ok := ca.identities[request.ID]
+	if !ok {
+		return nil, caNotFoundErr()
+	}
+	delete(ca.identities, request.ID)
+	delete(ca.signing, request.ID)
+	return id.resp, nil
+}
+
+func (ca *fakeCA) Revoke(request *msp.RevocationRequest) (*msp.RevocationResponse, error) {
+	return &msp.RevocationResponse{}, nil
+}
+
+func (ca *fakeCA) GetCAInfo() (*msp.GetCAInfoResponse, error) {
+	return &msp.GetCAInfoResponse{CAName: "ca.org1"}, nil
+}
+
+func (ca *fakeCA) GetSigningIdentity(id string) (mspctx.SigningIdentity, error) {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	si, ok := ca.signing[id]
+	if !ok {
+		return nil, msp.ErrUserNotFound
+	}
+	return si, nil
+}
+
+type fakeSigningIdentity struct {
+	id   string
+	cert []byte
+	key  []byte
+}
+
+func (si *fakeSigningIdentity) Identifier() *mspctx.IdentityIdentifier {
+	return &mspctx.IdentityIdentifier{MSPID: fakeMSPID, ID: si.id}
+}
+
+func (si *fakeSigningIdentity) Verify(msg []byte, sig []byte) error {
+	return nil
+}
+
+func (si *fakeSigningIdentity) Serialize() ([]byte, error) {
+	return si.cert, nil
+}
+
+func (si *fakeSigningIdentity) EnrollmentCertificate() []byte {
+	return si.cert
+}
+
+func (si *fakeSigningIdentity) Sign(msg []byte) ([]byte, error) {
+	return nil, errors.New("fake signing identity can't sign")
+}
+
+func (si *fakeSigningIdentity) PublicVersion() mspctx.Identity {
+	return si
+}
+
+func (si *fakeSigningIdentity) PrivateKey() core.Key {
+	return fakeKey(si.key)
+}
+
+type fakeKey []byte
+
+func (k fakeKey) Bytes() ([]byte, error) {
+	return k, nil
+}
+
+func (k fakeKey) SKI() []byte {
+	return nil
+}
+
+func (k fakeKey) Symmetric() bool {
+	return false
+}
+
+func (k fakeKey) Private() bool {
+	return true
+}
+
+func (k fakeKey) PublicKey() (core.Key, error) {
+	return nil, errors.New("fake key has no public key")
+}
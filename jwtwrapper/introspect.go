@@ -0,0 +1,136 @@
+package jwtwrapper
+
+import (
+	"crypto/subtle"
+	"errors"
+	"github.com/leyle/fabric-user-manager/model"
+)
+
+// RFC 7662 token introspection
+
+var ErrInvalidClient = errors.New("invalid_client")
+
+const (
+	TokenTypeHintAccessToken  = "access_token"
+	TokenTypeHintRefreshToken = "refresh_token"
+)
+
+// client_id isn't returned, our tokens aren't issued to an oauth2 client
+type IntrospectResponse struct {
+	Active    bool   `json:"active"`
+	Scope     string `json:"scope,omitempty"`
+	Username  string `json:"username,omitempty"`
+	TokenType string `json:"token_type,omitempty"`
+	Exp       int64  `json:"exp,omitempty"`
+	Iat       int64  `json:"iat,omitempty"`
+	Nbf       int64  `json:"nbf,omitempty"`
+	Sub       string `json:"sub,omitempty"`
+	Aud       string `json:"aud,omitempty"`
+	Iss       string `json:"iss,omitempty"`
+	Jti       string `json:"jti,omitempty"`
+}
+
+func inactiveToken() *IntrospectResponse {
+	return &IntrospectResponse{Active: false}
+}
+
+// AuthenticateOAuth2Client checks client credentials of the introspection caller
+func AuthenticateOAuth2Client(ctx *model.JWTContext, clientId, clientSecret string) error {
+	opt := ctx.Opt.OAuth2Opt
+	if opt == nil || clientId == "" {
+		return ErrInvalidClient
+	}
+
+	for _, client := range opt.Clients {
+		if client.ClientId != clientId {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(client.ClientSecret), []byte(clientSecret)) == 1 {
+			return nil
+		}
+		break
+	}
+
+	ctx.Logger().Warn().Str("clientId", clientId).Msg("oauth2 client authentication failed")
+	return ErrInvalidClient
+}
+
+// Introspect returns token's state, an invalid, revoked or expired token
+// or a token of disabled user is reported as inactive
+// hint is only an optimization, the other type is tried if it doesn't match
+func Introspect(ctx *model.JWTContext, token, hint string) *IntrospectResponse {
+	if token == "" {
+		return inactiveToken()
+	}
+
+	if hint == TokenTypeHintRefreshToken {
+		if resp := introspectRefreshToken(ctx, token); resp.Active {
+			return resp
+		}
+		return introspectAccessToken(ctx, token)
+	}
+
+	if resp := introspectAccessToken(ctx, token); resp.Active {
+		return resp
+	}
+	return introspectRefreshToken(ctx, token)
+}
+
+func introspectAccessToken(ctx *model.JWTContext, token string) *IntrospectResponse {
+	resp := ParseJWTToken(ctx, token)
+	if resp.Err != nil {
+		return inactiveToken()
+	}
+	claim := resp.Claim
+
+	if !isUserActive(ctx, claim.UserName) {
+		return inactiveToken()
+	}
+
+	return &IntrospectResponse{
+		Active:    true,
+		Scope:     claim.Role.String(),
+		Username:  claim.UserName,
+		TokenType: TokenTypeHintAccessToken,
+		Exp:       claim.ExpiresAt,
+		Iat:       claim.IssuedAt,
+		Nbf:       claim.NotBefore,
+		Sub:       claim.UserId,
+		Aud:       claim.Audience,
+		Iss:       claim.Issuer,
+		Jti:       claim.Id,
+	}
+}
+
+func introspectRefreshToken(ctx *model.JWTContext, token string) *IntrospectResponse {
+	rt, err := model.GetRefreshToken(ctx, hashRefreshToken(token))
+	if err != nil || rt == nil {
+		return inactiveToken()
+	}
+	if rt.Used || rt.Revoked || rt.IsExpired() {
+		return inactiveToken()
+	}
+
+	user, err := model.GetUserAccountByUsername(ctx, rt.Username)
+	if err != nil || user == nil || !user.Valid {
+		return inactiveToken()
+	}
+
+	return &IntrospectResponse{
+		Active:    true,
+		Scope:     user.Role.String(),
+		Username:  user.Username,
+		TokenType: TokenTypeHintRefreshToken,
+		Exp:       rt.ExpiresAt,
+		Iat:       rt.Created.Second,
+		Sub:       user.Id,
+	}
+}
+
+func isUserActive(ctx *model.JWTContext, username string) bool {
+	user, err := model.GetUserAccountByUsername(ctx, username)
+	if err != nil {
+		return false
+	}
+	return user != nil && user.Valid
+}
@@ -1,15 +1,14 @@
 package jwtwrapper
 
 import (
-	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/dgrijalva/jwt-go"
 	"github.com/gin-gonic/gin"
 	"github.com/leyle/fabric-user-manager/model"
-	"github.com/leyle/go-api-starter/couchdb"
 	"github.com/leyle/go-api-starter/logmiddleware"
 	"github.com/leyle/go-api-starter/util"
+	"strings"
 	"time"
 )
 
@@ -28,6 +27,7 @@ var (
 	ErrUserIdExist        = errors.New("username/enrollId has already exists")
 	ErrUserIsInvalid      = errors.New("user is invalid")
 	ErrNoWalletCredential = errors.New("user doesn't register/enroll ca")
+	ErrUserNotExist       = errors.New("user doesn't exist")
 )
 
 // login
@@ -37,6 +37,13 @@ func JWTLogin(ctx *model.JWTContext, username, passwd string) *model.JWTResponse
 	var err error
 	resp := model.InitJWTResponse()
 
+	// too many failed logins from client ip or to username
+	err = checkLoginBlocked(ctx, username)
+	if err != nil {
+		resp.Err = err
+		return resp
+	}
+
 	// query by username and passwd
 	user, err := model.GetUserAccountByUsername(ctx, username)
 	if err != nil {
@@ -45,17 +52,29 @@ func JWTLogin(ctx *model.JWTContext, username, passwd string) *model.JWTResponse
 	}
 	if user == nil {
 		ctx.Logger().Warn().Str("username", username).Msg("JWTLogin, no data refer to username")
-		resp.Err = couchdb.NoIdData
+		verifyDummyPasswd(ctx, passwd)
+		recordLoginFailure(ctx, username, nil)
+		resp.Err = ErrInvalidCredentials
+		return resp
+	}
+
+	// password is not checked when account is locked
+	if user.IsLocked() {
+		ctx.Logger().Warn().Str("username", username).Msg("JWTLogin, account is locked")
+		resp.Err = &LoginLockedError{Until: time.Unix(user.LockedUntil, 0)}
 		return resp
 	}
 
 	// check if password is ok
-	if !user.IsPasswdEqual(passwd) {
+	matched, ok := matchLoginPasswd(user, passwd)
+	if !ok {
 		// if password is wrong
 		ctx.Logger().Warn().Str("username", username).Msg("JWTLogin, wrong password")
-		resp.Err = ErrWrongPasswd
+		recordLoginFailure(ctx, username, user)
+		resp.Err = ErrInvalidCredentials
 		return resp
 	}
+	recordLoginSuccess(ctx, user)
 
 	// check if user status is ok
 	if !user.Valid {
@@ -64,34 +83,44 @@ func JWTLogin(ctx *model.JWTContext, username, passwd string) *model.JWTResponse
 		return resp
 	}
 
-	// password is right, generate jwtwrapper token
-	token, err := createJWTToken(ctx, user)
-	if err != nil {
-		resp.Err = err
+	// upgrade legacy or outdated hash, login still succeeds if it fails
+	// the value which matched is hashed, so the password user has set still works
+	if user.NeedsRehash(ctx.Opt.PasswdHashOpt) {
+		rehashPasswd(ctx, user, matched)
+	}
+
+	// password is right, TOTP check is the second step if it's required
+	if ctx.Opt.MFAOpt.Required(user) {
+		resp = createMFAChallenge(ctx, user)
 		return resp
 	}
 
-	resp.Token = token
-	resp.UserAccount = user
+	// generate jwtwrapper token and refresh token
+	resp = createTokenPair(ctx, user, "")
 	return resp
 }
 
 // register
 // input values are username and password
 // return value is result flag
-func JWTRegister(ctx *model.JWTContext, username, passwd string, role model.UserRole) *model.JWTResponse {
+// JWTRegister creates user account and ca identity
+// role's default attributes in CAAttrOpt are added, attrs with the same name override them
+func JWTRegister(ctx *model.JWTContext, username, passwd string, role model.UserRole, affiliation string, attrs []*model.CAAttribute) *model.JWTResponse {
 	resp := model.InitJWTResponse()
-	claim := GetCurUser(ctx.C)
-	if claim == nil {
-		resp.Err = ErrContextNoClaim
-		ctx.Logger().Error().Err(ErrContextNoClaim).Msg("get user from request context failed")
+	if _, err := requireAdmin(ctx); err != nil {
+		resp.Err = err
 		return resp
 	}
 
-	// check if user role is admin
-	if claim.Role != model.UserRoleAdmin {
-		resp.Err = ErrUserNoPermission
-		ctx.Logger().Error().Err(ErrUserNoPermission).Str("role", claim.Role.String()).Msg("current user is not admin")
+	if err := model.ValidateCAAttrs(attrs); err != nil {
+		resp.Err = err
+		return resp
+	}
+
+	err := ctx.Opt.PasswdPolicyOpt.Check(passwd, nil)
+	if err != nil {
+		ctx.Logger().Warn().Err(err).Str("username", username).Msg("register user failed, password doesn't meet policy")
+		resp.Err = err
 		return resp
 	}
 
@@ -109,7 +138,9 @@ func JWTRegister(ctx *model.JWTContext, username, passwd string, role model.User
 		return resp
 	}
 
-	resp = registerUser(ctx, username, passwd, role)
+	affiliation = ctx.Opt.CAAttrOpt.Affiliation(affiliation)
+	attrs = ctx.Opt.CAAttrOpt.Merge(role, attrs)
+	resp = registerUser(ctx, username, passwd, role, affiliation, attrs)
 	if resp.Err != nil {
 		ctx.Logger().Error().Err(resp.Err).Str("username", username).Msg("register user failed")
 		return resp
@@ -118,20 +149,43 @@ func JWTRegister(ctx *model.JWTContext, username, passwd string, role model.User
 	return resp
 }
 
-func createJWTToken(ctx *model.JWTContext, user *model.UserAccount) (string, error) {
-	expireTime := time.Now().Add(time.Duration(ctx.Opt.JWTOpt.ExpireHours) * time.Hour)
+// requireAdmin returns current user's claim if current user is admin
+func requireAdmin(ctx *model.JWTContext) (*model.JWTClaim, error) {
+	claim := GetCurUser(ctx.C)
+	if claim == nil {
+		ctx.Logger().Error().Err(ErrContextNoClaim).Msg("get user from request context failed")
+		return nil, ErrContextNoClaim
+	}
+
+	// check if user role is admin
+	if claim.Role != model.UserRoleAdmin {
+		ctx.Logger().Error().Err(ErrUserNoPermission).Str("role", claim.Role.String()).Msg("current user is not admin")
+		return nil, ErrUserNoPermission
+	}
+
+	return claim, nil
+}
+
+func createJWTToken(ctx *model.JWTContext, user *model.UserAccount, jti string) (string, error) {
+	if jti == "" {
+		jti = util.GenerateDataId()
+	}
+	expireTime := time.Now().Add(ctx.Opt.JWTOpt.AccessTokenTTL())
 	claim := &model.JWTClaim{
 		UserId:   user.Id,
 		UserName: user.Username,
 		Role:     user.Role,
+
+		MustChangePasswd: user.MustChangePasswd,
+
 		StandardClaims: jwt.StandardClaims{
+			Id:        jti,
 			IssuedAt:  util.CurUnixTime(),
 			ExpiresAt: expireTime.Unix(),
 		},
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claim)
-	tokenStr, err := token.SignedString(ctx.Opt.JWTOpt.Secret)
+	tokenStr, err := signToken(ctx, claim)
 	if err != nil {
 		ctx.Logger().Error().Err(err).Msg("create jwtwrapper token failed")
 		return "", err
@@ -154,21 +208,31 @@ func ParseJWTToken(ctx *model.JWTContext, token string) *model.JWTResponse {
 
 	claim := &model.JWTClaim{}
 
-	tkn, err := jwt.ParseWithClaims(token, claim, func(token *jwt.Token) (interface{}, error) {
-		return ctx.Opt.JWTOpt.Secret, nil
-	})
+	tkn, err := jwt.ParseWithClaims(token, claim, verifyKeyFunc(ctx))
 	if err != nil {
 		ctx.Logger().Error().Err(err).Msg("ParseJWTToken, parse token failed")
 		resp.Err = err
 		return resp
 	}
 
-	if !tkn.Valid {
+	// challenge token can't be used as access token
+	if !tkn.Valid || claim.Purpose != "" {
 		ctx.Logger().Error().Msg("ParseJWTToken, token is invalid")
 		resp.Err = ErrInvalidToken
 		return resp
 	}
 
+	revoked, err := isTokenRevoked(ctx, claim)
+	if err != nil {
+		resp.Err = err
+		return resp
+	}
+	if revoked {
+		ctx.Logger().Warn().Str("username", claim.UserName).Str("jti", claim.Id).Msg("ParseJWTToken, token has been revoked")
+		resp.Err = ErrTokenRevoked
+		return resp
+	}
+
 	resp.Claim = claim
 	resp.Valid = true
 	resp.Token = token
@@ -189,7 +253,12 @@ func Auth(ctx *model.JWTContext) *model.JWTResponse {
 	// check wallet credential exist
 	// enrollId := resp.Claim.UserId
 	enrollId := resp.Claim.UserName
-	if !IsCAUserExist(ctx, enrollId) {
+	exist, err := caUserExists(ctx, enrollId)
+	if err != nil {
+		authRet.Err = err
+		return authRet
+	}
+	if !exist {
 		authRet.Err = ErrNoWalletCredential
 		ctx.Logger().Error().Err(authRet.Err).Msg("user don't have wallet credential")
 		return authRet
@@ -215,47 +284,81 @@ func GetCurUser(c *gin.Context) *model.JWTClaim {
 	return result
 }
 
-func registerUser(ctx *model.JWTContext, username, passwd string, role model.UserRole) *model.JWTResponse {
-	// two steps
-	// 1. register to ca
-	// 2. save data into normal db
+// registerUser runs registration saga
+// db reserve, ca register, ca enroll, wallet put and db activate
+// if a step fails, done steps are undone
+func registerUser(ctx *model.JWTContext, username, passwd string, role model.UserRole, affiliation string, attrs []*model.CAAttribute) *model.JWTResponse {
+	resp := model.InitJWTResponse()
 
-	salt := util.GetCurNoSpaceTime()
 	ua := &model.UserAccount{
-		Id:       createUserDataId(username),
-		Username: username,
-		Salt:     salt,
-		Role:     role,
-		Valid:    true,
-		Created:  util.GetCurTime(),
-	}
-	ua.PassHash = ua.CreatePassHash(passwd, salt)
+		Id:          createUserDataId(username),
+		Username:    username,
+		Role:        role,
+		Valid:       true,
+		Created:     util.GetCurTime(),
+		Affiliation: affiliation,
+		CAAttrs:     attrs,
+	}
 	ua.Updated = ua.Created
+	err := ua.SetPasswd(ctx.Opt.PasswdHashOpt, passwd)
+	if err != nil {
+		resp.Err = err
+		return resp
+	}
 
-	// 1. register to ca
-	// use ua's username as enrollId, ua's id as secret
-	resp := CARegister(ctx, ua.Username, ua.Id, role)
-	if resp.Err != nil {
+	saga, err := newRegisterSaga(ctx, ua)
+	if err != nil {
+		resp.Err = err
 		return resp
 	}
 
-	// 2. save data into normal db
-	resp2 := SaveJWTUser(ctx, ua)
-	if resp2.Err != nil {
-		return resp2
+	err = runRegisterSaga(ctx, saga)
+	if err != nil {
+		resp.Err = err
+		return resp
 	}
 
-	resp2.MspClient = resp.MspClient
-	return resp2
+	resp.UserAccount = saga.User
+	return resp
+}
+
+// matchLoginPasswd returns the value which matches user's hash
+// passwords used to be trimmed before legacy hashing, trimmed value is only tried on legacy hashes,
+// or " pw " would be accepted for "pw"
+func matchLoginPasswd(user *model.UserAccount, passwd string) (string, bool) {
+	if user.IsPasswdEqual(passwd) {
+		return passwd, true
+	}
+	if user.PHCHash != "" {
+		return "", false
+	}
+	trimmed := strings.TrimSpace(passwd)
+	if trimmed != passwd && user.IsPasswdEqual(trimmed) {
+		return trimmed, true
+	}
+	return "", false
+}
+
+func rehashPasswd(ctx *model.JWTContext, user *model.UserAccount, passwd string) {
+	err := user.SetPasswd(ctx.Opt.PasswdHashOpt, passwd)
+	if err != nil {
+		ctx.Logger().Error().Err(err).Str("username", user.Username).Msg("rehash password failed")
+		return
+	}
+
+	err = model.UpdateUserAccount(ctx, user)
+	if err != nil {
+		ctx.Logger().Error().Err(err).Str("username", user.Username).Msg("save rehashed password failed")
+		return
+	}
+	ctx.Logger().Info().Str("username", user.Username).Msg("rehash password success")
 }
 
 func SaveJWTUser(ctx *model.JWTContext, ua *model.UserAccount) *model.JWTResponse {
 	resp := model.InitJWTResponse()
 
-	uaData, _ := json.Marshal(ua)
-	err := ctx.Ds(model.DBNameUserAccount).CreateDoc(ctx.C.Request.Context(), ua.Id, uaData)
+	err := model.SaveUserAccount(ctx, ua)
 	if err != nil {
-		ctx.Logger().Error().Err(err).Str("username", ua.Username).Msg("create user failed")
 		resp.Err = err
 		return resp
 	}
@@ -0,0 +1,107 @@
+package jwtwrapper
+
+import (
+	"errors"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/leyle/fabric-user-manager/model"
+	"github.com/leyle/go-api-starter/util"
+)
+
+var (
+	ErrUnknownSigningKey = errors.New("unknown token signing key")
+	ErrNoSigningKey      = errors.New("no active token signing key")
+)
+
+// JWKS returns public keys used to verify our tokens
+// HS256 keys are never published
+func JWKS(ctx *model.JWTContext) *model.JWKSet {
+	return ctx.Opt.JWTOpt.Ring().JWKSet()
+}
+
+func signToken(ctx *model.JWTContext, claim jwt.Claims) (string, error) {
+	key := ctx.Opt.JWTOpt.Ring().Active()
+	if key == nil {
+		ctx.Logger().Error().Err(ErrNoSigningKey).Msg("sign token failed")
+		return "", ErrNoSigningKey
+	}
+
+	token := jwt.NewWithClaims(key.Method(), claim)
+	token.Header["kid"] = key.Id
+
+	return token.SignedString(key.SignKey())
+}
+
+// signChallengeToken signs a non-access token with the active key's challenge key
+// typ is set too, so it's told apart from access tokens without verifying it
+func signChallengeToken(ctx *model.JWTContext, claim jwt.Claims) (string, error) {
+	key := ctx.Opt.JWTOpt.Ring().Active()
+	if key == nil {
+		ctx.Logger().Error().Err(ErrNoSigningKey).Msg("sign challenge token failed")
+		return "", ErrNoSigningKey
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claim)
+	token.Header["kid"] = key.Id
+	token.Header["typ"] = model.ChallengeTokenType
+
+	return token.SignedString(key.ChallengeKey())
+}
+
+// challengeKeyFunc is verifyKeyFunc of challenge tokens, only HS256 and challenge typ are accepted
+func challengeKeyFunc(ctx *model.JWTContext) jwt.Keyfunc {
+	return func(token *jwt.Token) (interface{}, error) {
+		if typ, _ := token.Header["typ"].(string); typ != model.ChallengeTokenType {
+			return nil, ErrInvalidToken
+		}
+		if token.Method.Alg() != jwt.SigningMethodHS256.Alg() {
+			return nil, ErrInvalidToken
+		}
+
+		kid, _ := token.Header["kid"].(string)
+		key := ctx.Opt.JWTOpt.Ring().Get(kid)
+		if key == nil {
+			return nil, ErrUnknownSigningKey
+		}
+		if key.RetireAt > 0 && util.CurUnixTime() >= key.RetireAt {
+			return nil, ErrUnknownSigningKey
+		}
+
+		return key.ChallengeKey(), nil
+	}
+}
+
+// verifyKeyFunc finds the key by token's kid
+// token's alg must be the key's alg, so a public key can't be used as HS256 secret
+func verifyKeyFunc(ctx *model.JWTContext) jwt.Keyfunc {
+	return func(token *jwt.Token) (interface{}, error) {
+		// challenge token is signed by another key, it fails anyway, but it's rejected early
+		if typ, _ := token.Header["typ"].(string); typ == model.ChallengeTokenType {
+			return nil, ErrInvalidToken
+		}
+
+		kid, _ := token.Header["kid"].(string)
+		if kid == "" {
+			// tokens created by old version don't have kid, they are signed by config key
+			// it's looked up in the ring too, so they are rejected after it's retired
+			cfgKey, err := ctx.Opt.JWTOpt.SigningKey()
+			if err != nil {
+				return nil, ErrUnknownSigningKey
+			}
+			kid = cfgKey.Id
+		}
+		key := ctx.Opt.JWTOpt.Ring().Get(kid)
+		if key == nil {
+			return nil, ErrUnknownSigningKey
+		}
+
+		if key.RetireAt > 0 && util.CurUnixTime() >= key.RetireAt {
+			return nil, ErrUnknownSigningKey
+		}
+
+		if token.Method.Alg() != key.Method().Alg() {
+			return nil, ErrInvalidToken
+		}
+
+		return key.VerifyKey(), nil
+	}
+}
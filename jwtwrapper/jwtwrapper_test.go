@@ -0,0 +1,117 @@
+package jwtwrapper
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/leyle/fabric-user-manager/internal/couchdbtest"
+	"github.com/leyle/fabric-user-manager/model"
+	"github.com/leyle/go-api-starter/util"
+	"net/http/httptest"
+	"testing"
+)
+
+const testPasswd = "Correct-Horse-42"
+
+// setupCtx returns a context of a request, couchdb is in memory and users are kept by memory store
+func setupCtx(t *testing.T) *model.JWTContext {
+	t.Helper()
+	srv := couchdbtest.NewServer()
+	t.Cleanup(srv.Close)
+
+	opt := &model.Option{
+		CouchDBOpt: srv.Option(),
+		UserStore:  model.NewMemoryUserStore(),
+		Registrar: &model.FabricCARegistrar{
+			EnrollId: "orgadmin",
+			Secret:   "passwd",
+		},
+		FabricGWOption: &model.FabricGWOption{
+			WalletBackend: model.WalletBackendMemory,
+			OrgName:       "org1",
+		},
+		JWTOpt: &model.JWTOption{
+			Secret: []byte("hello"),
+		},
+		PasswdHashOpt: &model.PasswdHashOption{
+			Algorithm:  model.PasswdAlgBcrypt,
+			BcryptCost: 4,
+		},
+		LoginThrottleOpt: &model.LoginThrottleOption{
+			MaxFailedAttempts: 3,
+		},
+		MFAOpt: &model.MFAOption{},
+	}
+
+	ctx := &model.JWTContext{
+		Opt:          opt,
+		Revocation:   model.NewRevocationCache(0),
+		LoginLimiter: model.NewLoginLimiter(opt.LoginThrottleOpt),
+	}
+
+	wallet, err := model.NewWallet(opt.FabricGWOption, opt.CouchDBOpt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx.Wallet = wallet
+
+	for _, db := range []string{
+		model.DBNameRefreshToken,
+		model.DBNameTokenRevocation,
+		model.DBNameJWTKey,
+		model.DBNameRegisterSaga,
+		model.DBNameAuditLog,
+	} {
+		if err := ctx.Ds(db).CreateDatabase(ctx.Context()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return newRequestCtx(ctx)
+}
+
+// newRequestCtx returns a context of a new request sharing ctx's services
+func newRequestCtx(ctx *model.JWTContext) *model.JWTContext {
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest("POST", "/api/test", nil)
+	return ctx.New(c)
+}
+
+// createTestUser saves a valid user with testPasswd
+func createTestUser(t *testing.T, ctx *model.JWTContext, username string, role model.UserRole) *model.UserAccount {
+	t.Helper()
+	ua := &model.UserAccount{
+		Id:       util.GenerateDataId(),
+		Username: username,
+		Role:     role,
+		Valid:    true,
+		Created:  util.GetCurTime(),
+	}
+	ua.Updated = ua.Created
+	if err := ua.SetPasswd(ctx.Opt.PasswdHashOpt, testPasswd); err != nil {
+		t.Fatal(err)
+	}
+	if err := model.SaveUserAccount(ctx, ua); err != nil {
+		t.Fatal(err)
+	}
+	return ua
+}
+
+// loginAs sets user as the caller of ctx's request
+func loginAs(ctx *model.JWTContext, user *model.UserAccount) {
+	SetCurUser(ctx.C, &model.JWTClaim{
+		UserId:   user.Id,
+		UserName: user.Username,
+		Role:     user.Role,
+	})
+}
+
+func getTestUser(t *testing.T, ctx *model.JWTContext, id string) *model.UserAccount {
+	t.Helper()
+	ua, err := model.GetUserAccountById(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ua == nil {
+		t.Fatalf("user %s doesn't exist", id)
+	}
+	return ua
+}
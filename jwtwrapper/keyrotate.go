@@ -0,0 +1,296 @@
+package jwtwrapper
+
+import (
+	"errors"
+	"github.com/leyle/fabric-user-manager/model"
+	"github.com/leyle/go-api-starter/util"
+	"time"
+)
+
+var ErrRetireActiveKey = errors.New("active signing key can't be retired")
+
+const defaultKeyRotationCheckMinutes = 5
+
+// JWTKeyInfo is the public view of a key in the ring
+type JWTKeyInfo struct {
+	Kid        string `json:"kid"`
+	Algorithm  string `json:"algorithm"`
+	Status     string `json:"status"`
+	FromConfig bool   `json:"fromConfig"`
+	Created    int64  `json:"created"`
+	RetireAt   int64  `json:"retireAt"`
+}
+
+func newJWTKeyInfo(ring *model.KeyRing, key *model.JWTKey) *JWTKeyInfo {
+	info := &JWTKeyInfo{
+		Kid:        key.Id,
+		Algorithm:  key.Algorithm,
+		Status:     model.JWTKeyStatusVerify,
+		FromConfig: key.Created == 0,
+		Created:    key.Created,
+		RetireAt:   key.RetireAt,
+	}
+	if ring.IsActive(key.Id) {
+		info.Status = model.JWTKeyStatusActive
+	}
+	return info
+}
+
+// list keys in the ring, only admin can do it
+func JWTListSigningKeys(ctx *model.JWTContext) ([]*JWTKeyInfo, error) {
+	if _, err := requireAdmin(ctx); err != nil {
+		return nil, err
+	}
+
+	ring := ctx.Opt.JWTOpt.Ring()
+	var infos []*JWTKeyInfo
+	for _, key := range ring.Keys() {
+		infos = append(infos, newJWTKeyInfo(ring, key))
+	}
+	return infos, nil
+}
+
+// rotate signing key now, only admin can do it
+// if alg is empty, rotation option's algorithm is used
+func JWTRotateSigningKey(ctx *model.JWTContext, alg string) (*JWTKeyInfo, error) {
+	if _, err := requireAdmin(ctx); err != nil {
+		return nil, err
+	}
+
+	key, err := RotateSigningKey(ctx, alg)
+	if err != nil {
+		return nil, err
+	}
+	return newJWTKeyInfo(ctx.Opt.JWTOpt.Ring(), key), nil
+}
+
+// retire a verify-only key now, tokens signed by it become invalid, only admin can do it
+func JWTRetireSigningKey(ctx *model.JWTContext, kid string) error {
+	if _, err := requireAdmin(ctx); err != nil {
+		return err
+	}
+	return RetireSigningKey(ctx, kid)
+}
+
+// LoadKeyRing loads generated keys from db into the ring
+// keys retired by other instances are dropped, config key's retirement is applied too
+func LoadKeyRing(ctx *model.JWTContext) error {
+	docs, err := model.GetJWTKeyDocs(ctx)
+	if err != nil {
+		return err
+	}
+
+	ring := ctx.Opt.JWTOpt.Ring()
+	encryptKey := keyEncryptKey(ctx)
+
+	var active *model.JWTKey
+	var cfgDoc *model.JWTKeyDoc
+	loaded := make(map[string]bool)
+	for _, doc := range docs {
+		if doc.FromConfig {
+			cfgDoc = doc
+			continue
+		}
+		key, err := doc.Key(encryptKey)
+		if err != nil {
+			ctx.Logger().Error().Err(err).Str("kid", doc.Id).Msg("load jwt key failed")
+			continue
+		}
+		loaded[key.Id] = true
+
+		// if two instances rotated at the same time, the newest one wins
+		if doc.Status == model.JWTKeyStatusActive && (active == nil || key.Created > active.Created) {
+			active = key
+		}
+		ring.Add(key, false)
+	}
+	if active != nil && !ring.IsActive(active.Id) {
+		ring.Add(active, true)
+	}
+
+	for _, key := range ring.Keys() {
+		if key.Created != 0 && !loaded[key.Id] {
+			ring.Remove(key.Id)
+		}
+	}
+
+	if cfgDoc != nil {
+		applyConfigKeyDoc(ring, cfgDoc)
+	}
+
+	return nil
+}
+
+// applyConfigKeyDoc sets config key's retire time, or drops it if it has been retired
+func applyConfigKeyDoc(ring *model.KeyRing, doc *model.JWTKeyDoc) {
+	key := ring.Get(doc.Id)
+	if key == nil || key.Created != 0 {
+		return
+	}
+	switch doc.Status {
+	case model.JWTKeyStatusRetired:
+		ring.Remove(key.Id)
+	case model.JWTKeyStatusVerify:
+		if key.RetireAt != doc.RetireAt && !ring.IsActive(key.Id) {
+			demoted := *key
+			demoted.RetireAt = doc.RetireAt
+			ring.Add(&demoted, false)
+		}
+	}
+}
+
+// RotateSigningKey generates a new active key
+// previous active key becomes verify-only, it's retired after the retain time
+// empty alg means KeyRotation.Algorithm, then the current active key's algorithm
+func RotateSigningKey(ctx *model.JWTContext, alg string) (*model.JWTKey, error) {
+	opt := ctx.Opt.JWTOpt
+	if alg == "" && opt.KeyRotation != nil {
+		alg = opt.KeyRotation.Algorithm
+	}
+	// a RS256 deployment must not switch to HS256, it isn't published in JWKS
+	if alg == "" {
+		if active := opt.Ring().Active(); active != nil {
+			alg = active.Algorithm
+		}
+	}
+
+	key, err := model.GenerateJWTKey(alg)
+	if err != nil {
+		ctx.Logger().Error().Err(err).Str("algorithm", alg).Msg("generate jwt key failed")
+		return nil, err
+	}
+
+	doc, err := model.NewJWTKeyDoc(key, model.JWTKeyStatusActive, keyEncryptKey(ctx))
+	if err != nil {
+		ctx.Logger().Error().Err(err).Msg("encrypt jwt key failed")
+		return nil, err
+	}
+	err = model.SaveJWTKeyDoc(ctx, doc)
+	if err != nil {
+		return nil, err
+	}
+
+	ring := opt.Ring()
+	prev := ring.Active()
+	ring.Add(key, true)
+
+	if prev != nil {
+		// keys in the ring are read without lock, so we replace it instead of modifying it
+		demoted := *prev
+		demoted.RetireAt = time.Now().Add(opt.RetainTTL()).Unix()
+		ring.Add(&demoted, false)
+
+		prevDoc, err := model.GetJWTKeyDoc(ctx, prev.Id)
+		if err != nil {
+			return nil, err
+		}
+		if prevDoc != nil {
+			prevDoc.Status = model.JWTKeyStatusVerify
+			prevDoc.RetireAt = demoted.RetireAt
+			err = model.UpdateJWTKeyDoc(ctx, prevDoc)
+		} else if prev.Created == 0 {
+			// config key isn't in db, its retirement is saved so other instances and restarts see it
+			err = model.SaveJWTKeyDoc(ctx, model.NewConfigKeyDoc(&demoted, model.JWTKeyStatusVerify))
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	ctx.Logger().Info().Str("kid", key.Id).Str("algorithm", key.Algorithm).Msg("rotate signing key success")
+	return key, nil
+}
+
+// RetireSigningKey removes a verify-only key
+func RetireSigningKey(ctx *model.JWTContext, kid string) error {
+	ring := ctx.Opt.JWTOpt.Ring()
+	if ring.IsActive(kid) {
+		return ErrRetireActiveKey
+	}
+	if ring.Get(kid) == nil {
+		return ErrUnknownSigningKey
+	}
+
+	doc, err := model.GetJWTKeyDoc(ctx, kid)
+	if err != nil {
+		return err
+	}
+	if doc != nil {
+		// retired key is never used again, drop key material
+		doc.Status = model.JWTKeyStatusRetired
+		doc.Secret = ""
+		doc.PrivKey = ""
+		err = model.UpdateJWTKeyDoc(ctx, doc)
+	} else if key := ring.Get(kid); key.Created == 0 {
+		err = model.SaveJWTKeyDoc(ctx, model.NewConfigKeyDoc(key, model.JWTKeyStatusRetired))
+	}
+	if err != nil {
+		return err
+	}
+
+	ring.Remove(kid)
+	ctx.Logger().Info().Str("kid", kid).Msg("retire signing key success")
+	return nil
+}
+
+// CheckKeyRotation reloads keys, retires expired verify-only keys
+// and rotates the active key if it's older than the interval
+func CheckKeyRotation(ctx *model.JWTContext) error {
+	err := LoadKeyRing(ctx)
+	if err != nil {
+		return err
+	}
+
+	ring := ctx.Opt.JWTOpt.Ring()
+	now := util.CurUnixTime()
+	for _, key := range ring.Keys() {
+		if key.RetireAt > 0 && now >= key.RetireAt && !ring.IsActive(key.Id) {
+			if err = RetireSigningKey(ctx, key.Id); err != nil {
+				return err
+			}
+		}
+	}
+
+	rotation := ctx.Opt.JWTOpt.KeyRotation
+	if rotation == nil || rotation.IntervalHours <= 0 {
+		return nil
+	}
+	interval := int64(rotation.IntervalHours) * int64(time.Hour/time.Second)
+	active := ring.Active()
+	if active == nil || active.Created == 0 || now-active.Created >= interval {
+		_, err = RotateSigningKey(ctx, "")
+		return err
+	}
+
+	return nil
+}
+
+// StartKeyRotation checks key rotation periodically until stop is closed
+func StartKeyRotation(ctx *model.JWTContext, stop <-chan struct{}) {
+	minutes := defaultKeyRotationCheckMinutes
+	if rotation := ctx.Opt.JWTOpt.KeyRotation; rotation != nil && rotation.CheckMinutes > 0 {
+		minutes = rotation.CheckMinutes
+	}
+
+	go func() {
+		ticker := time.NewTicker(time.Duration(minutes) * time.Minute)
+		defer ticker.Stop()
+		for {
+			if err := CheckKeyRotation(ctx); err != nil {
+				ctx.Logger().Error().Err(err).Msg("check key rotation failed")
+			}
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+func keyEncryptKey(ctx *model.JWTContext) []byte {
+	if rotation := ctx.Opt.JWTOpt.KeyRotation; rotation != nil {
+		return rotation.EncryptKey
+	}
+	return nil
+}
@@ -0,0 +1,176 @@
+package jwtwrapper
+
+import (
+	"errors"
+	"github.com/leyle/fabric-user-manager/model"
+	"sync"
+	"time"
+)
+
+// wrong username and wrong password get the same error, so usernames can't be probed
+var ErrInvalidCredentials = errors.New("invalid username or password")
+
+// LoginLockedError is returned when account or client ip is locked by failed logins
+type LoginLockedError struct {
+	Until time.Time
+}
+
+func (e *LoginLockedError) Error() string {
+	return "too many failed login attempts, please try again later"
+}
+
+func (e *LoginLockedError) RetryAfter() time.Duration {
+	d := time.Until(e.Until)
+	if d < time.Second {
+		d = time.Second
+	}
+	return d
+}
+
+// failed attempts are saved again after a conflict at most this times
+const maxLoginFailureRetry = 3
+
+var (
+	dummyHashOnce sync.Once
+	dummyHash     string
+)
+
+// verifyDummyPasswd costs the same time as a real verification
+// it's used when username doesn't exist
+func verifyDummyPasswd(ctx *model.JWTContext, passwd string) {
+	dummyHashOnce.Do(func() {
+		dummyHash, _ = model.HashPasswd(ctx.Opt.PasswdHashOpt, "dummy password")
+	})
+	if dummyHash != "" {
+		_, _ = model.VerifyPasswd(dummyHash, passwd)
+	}
+}
+
+func loginClientIP(ctx *model.JWTContext) string {
+	if ctx.C == nil {
+		return ""
+	}
+	return ctx.C.ClientIP()
+}
+
+// checkLoginBlocked checks client ip and username in memory
+func checkLoginBlocked(ctx *model.JWTContext, username string) error {
+	keys := []string{model.LoginLimitUserKey(username)}
+	if ip := loginClientIP(ctx); ip != "" {
+		keys = append(keys, model.LoginLimitIPKey(ip))
+	}
+
+	for _, key := range keys {
+		if until := ctx.LoginLimiter.BlockedUntil(key); !until.IsZero() {
+			ctx.Logger().Warn().Str("key", key).Time("until", until).Msg("login is blocked")
+			return &LoginLockedError{Until: until}
+		}
+	}
+	return nil
+}
+
+// recordLoginFailure counts failed login of client ip, username and account
+// user is nil if username doesn't exist
+func recordLoginFailure(ctx *model.JWTContext, username string, user *model.UserAccount) {
+	opt := ctx.LoginLimiter.Option()
+	if ip := loginClientIP(ctx); ip != "" {
+		ctx.LoginLimiter.Fail(model.LoginLimitIPKey(ip), opt.IPMaxFailedAttempts)
+	}
+
+	if user == nil {
+		ctx.LoginLimiter.Fail(model.LoginLimitUserKey(username), opt.MaxFailedAttempts)
+		return
+	}
+
+	// account lockout is saved in db, so it's shared by all instances
+	// concurrent failures conflict on rev, reload user and count again, or attempts are lost
+	for i := 0; i < maxLoginFailureRetry; i++ {
+		user.FailedAttempts++
+		if d := opt.LockoutDuration(user.FailedAttempts, opt.MaxFailedAttempts); d > 0 {
+			user.LockedUntil = time.Now().Add(d).Unix()
+			ctx.Logger().Warn().Str("username", username).Int("failedAttempts", user.FailedAttempts).Dur("lockout", d).Msg("account is locked")
+		}
+		err := model.UpdateUserAccount(ctx, user)
+		if err == nil {
+			return
+		}
+		if err != model.ErrDocConflict {
+			ctx.Logger().Error().Err(err).Str("username", username).Msg("save failed login attempts failed")
+			return
+		}
+
+		latest, err := model.GetUserAccountById(ctx, user.Id)
+		if err != nil || latest == nil {
+			ctx.Logger().Error().Err(err).Str("username", username).Msg("reload user for failed login attempts failed")
+			return
+		}
+		*user = *latest
+	}
+	ctx.Logger().Error().Str("username", username).Msg("save failed login attempts failed, too many conflicts")
+}
+
+// checkReauthPasswd checks password of a logged in user, e.g. before changing password
+// a stolen token can't be used to guess password, wrong password counts as failed login
+func checkReauthPasswd(ctx *model.JWTContext, user *model.UserAccount, passwd string) error {
+	err := checkLoginBlocked(ctx, user.Username)
+	if err != nil {
+		return err
+	}
+	if user.IsLocked() {
+		return &LoginLockedError{Until: time.Unix(user.LockedUntil, 0)}
+	}
+
+	if !user.IsPasswdEqual(passwd) {
+		recordLoginFailure(ctx, user.Username, user)
+		return ErrWrongPasswd
+	}
+	return nil
+}
+
+// recordLoginSuccess clears failed attempts of username
+// client ip counter is not cleared, or one valid account can reset it
+func recordLoginSuccess(ctx *model.JWTContext, user *model.UserAccount) {
+	ctx.LoginLimiter.Reset(model.LoginLimitUserKey(user.Username))
+	if user.FailedAttempts == 0 && user.LockedUntil == 0 {
+		return
+	}
+
+	user.FailedAttempts = 0
+	user.LockedUntil = 0
+	err := model.UpdateUserAccount(ctx, user)
+	if err != nil {
+		ctx.Logger().Error().Err(err).Str("username", user.Username).Msg("reset failed login attempts failed")
+	}
+}
+
+// unlock user's account, only admin can do it
+func JWTUnlockUser(ctx *model.JWTContext, userId string) *model.JWTResponse {
+	resp := model.InitJWTResponse()
+	if _, err := requireAdmin(ctx); err != nil {
+		resp.Err = err
+		return resp
+	}
+
+	user, err := model.GetUserAccountById(ctx, userId)
+	if err != nil {
+		resp.Err = err
+		return resp
+	}
+	if user == nil {
+		resp.Err = ErrUserNotExist
+		return resp
+	}
+
+	user.FailedAttempts = 0
+	user.LockedUntil = 0
+	err = model.UpdateUserAccount(ctx, user)
+	if err != nil {
+		resp.Err = err
+		return resp
+	}
+	ctx.LoginLimiter.Reset(model.LoginLimitUserKey(user.Username))
+
+	ctx.Logger().Info().Str("username", user.Username).Msg("unlock user success")
+	resp.UserAccount = user
+	return resp
+}
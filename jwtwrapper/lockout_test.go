@@ -0,0 +1,139 @@
+package jwtwrapper
+
+import (
+	"github.com/leyle/fabric-user-manager/model"
+	"testing"
+)
+
+func TestJWTLoginLockout(t *testing.T) {
+	tests := []struct {
+		name string
+		// passwords tried in order, the last one is checked with wantErr
+		passwds []string
+		wantErr error
+		// login is refused by lockout before password is checked
+		wantLockedErr bool
+		wantLocked    bool
+		wantAttempts  int
+	}{
+		{
+			name:    "right password",
+			passwds: []string{testPasswd},
+		},
+		{
+			name:         "below limit",
+			passwds:      []string{"wrong", "wrong"},
+			wantErr:      ErrInvalidCredentials,
+			wantAttempts: 2,
+		},
+		{
+			name:         "success resets counter",
+			passwds:      []string{"wrong", "wrong", testPasswd},
+			wantAttempts: 0,
+		},
+		{
+			name:         "locked at limit",
+			passwds:      []string{"wrong", "wrong", "wrong"},
+			wantErr:      ErrInvalidCredentials,
+			wantLocked:   true,
+			wantAttempts: 3,
+		},
+		{
+			name:          "locked account refuses right password",
+			passwds:       []string{"wrong", "wrong", "wrong", testPasswd},
+			wantLockedErr: true,
+			wantLocked:    true,
+			wantAttempts:  3,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := setupCtx(t)
+			user := createTestUser(t, ctx, "alice", model.UserRoleUser)
+
+			var resp *model.JWTResponse
+			for _, passwd := range tt.passwds {
+				resp = JWTLogin(newRequestCtx(ctx), user.Username, passwd)
+			}
+
+			if tt.wantLockedErr {
+				locked, ok := resp.Err.(*LoginLockedError)
+				if !ok || locked.RetryAfter() <= 0 {
+					t.Fatalf("login error = %v, want LoginLockedError", resp.Err)
+				}
+			} else if resp.Err != tt.wantErr {
+				t.Fatalf("login error = %v, want %v", resp.Err, tt.wantErr)
+			}
+			if resp.Err == nil && resp.Token == "" {
+				t.Fatal("no token returned")
+			}
+
+			saved := getTestUser(t, ctx, user.Id)
+			if saved.FailedAttempts != tt.wantAttempts {
+				t.Errorf("failed attempts = %d, want %d", saved.FailedAttempts, tt.wantAttempts)
+			}
+			if saved.IsLocked() != tt.wantLocked {
+				t.Errorf("locked = %v, want %v", saved.IsLocked(), tt.wantLocked)
+			}
+		})
+	}
+}
+
+// failures recorded by other instances must not be overwritten by a stale copy
+func TestRecordLoginFailureConflict(t *testing.T) {
+	ctx := setupCtx(t)
+	user := createTestUser(t, ctx, "alice", model.UserRoleUser)
+
+	stale := getTestUser(t, ctx, user.Id)
+	for i := 0; i < 2; i++ {
+		recordLoginFailure(ctx, user.Username, getTestUser(t, ctx, user.Id))
+	}
+	recordLoginFailure(ctx, user.Username, stale)
+
+	saved := getTestUser(t, ctx, user.Id)
+	if saved.FailedAttempts != 3 {
+		t.Fatalf("failed attempts = %d, want 3", saved.FailedAttempts)
+	}
+	if !saved.IsLocked() {
+		t.Fatal("account isn't locked")
+	}
+}
+
+// unknown usernames are counted in memory, so they can't be told from real ones
+func TestJWTLoginUnknownUser(t *testing.T) {
+	ctx := setupCtx(t)
+
+	for i := 0; i < 3; i++ {
+		resp := JWTLogin(newRequestCtx(ctx), "nobody", "wrong")
+		if resp.Err != ErrInvalidCredentials {
+			t.Fatalf("login %d error = %v, want %v", i, resp.Err, ErrInvalidCredentials)
+		}
+	}
+
+	resp := JWTLogin(newRequestCtx(ctx), "nobody", "wrong")
+	if _, ok := resp.Err.(*LoginLockedError); !ok {
+		t.Fatalf("login error = %v, want LoginLockedError", resp.Err)
+	}
+}
+
+func TestJWTChangePasswdThrottle(t *testing.T) {
+	ctx := setupCtx(t)
+	user := createTestUser(t, ctx, "alice", model.UserRoleUser)
+
+	for i := 0; i < 3; i++ {
+		reqCtx := newRequestCtx(ctx)
+		loginAs(reqCtx, user)
+		resp := JWTChangePasswd(reqCtx, "wrong", "New-Passwd-2024!")
+		if resp.Err != ErrWrongPasswd {
+			t.Fatalf("change %d error = %v, want %v", i, resp.Err, ErrWrongPasswd)
+		}
+	}
+
+	reqCtx := newRequestCtx(ctx)
+	loginAs(reqCtx, user)
+	resp := JWTChangePasswd(reqCtx, testPasswd, "New-Passwd-2024!")
+	if _, ok := resp.Err.(*LoginLockedError); !ok {
+		t.Fatalf("change error = %v, want LoginLockedError", resp.Err)
+	}
+}
@@ -0,0 +1,348 @@
+package jwtwrapper
+
+import (
+	"errors"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/leyle/fabric-user-manager/model"
+	"github.com/leyle/go-api-starter/util"
+	"time"
+)
+
+var (
+	ErrInvalidMFACode      = errors.New("invalid totp code or recovery code")
+	ErrMFAAlreadyEnabled   = errors.New("totp has already been enabled")
+	ErrMFANotEnrolled      = errors.New("totp enrollment hasn't been started")
+	ErrMFANotEnabled       = errors.New("totp isn't enabled")
+	ErrMFARequired         = errors.New("totp is required for current user")
+	ErrInvalidMFAChallenge = errors.New("invalid mfa challenge token")
+)
+
+// createMFAChallenge returns a short-lived token, it's exchanged for token pair by JWTLoginMFA
+// it's signed by challenge key, so it can't be verified by public keys in JWKS
+func createMFAChallenge(ctx *model.JWTContext, user *model.UserAccount) *model.JWTResponse {
+	resp := model.InitJWTResponse()
+	claim := &model.JWTClaim{
+		UserId:   user.Id,
+		UserName: user.Username,
+		Role:     user.Role,
+		Purpose:  model.TokenPurposeMFA,
+		StandardClaims: jwt.StandardClaims{
+			Id:        util.GenerateDataId(),
+			IssuedAt:  util.CurUnixTime(),
+			ExpiresAt: time.Now().Add(ctx.Opt.MFAOpt.ChallengeTTL()).Unix(),
+		},
+	}
+
+	token, err := signChallengeToken(ctx, claim)
+	if err != nil {
+		ctx.Logger().Error().Err(err).Msg("create mfa challenge failed")
+		resp.Err = err
+		return resp
+	}
+
+	resp.UserAccount = user
+	resp.MFA = &model.MFAResult{
+		Challenge:      token,
+		EnrollRequired: !user.MFAEnabled,
+	}
+	return resp
+}
+
+func parseMFAChallenge(ctx *model.JWTContext, challenge string) (*model.JWTClaim, error) {
+	claim := &model.JWTClaim{}
+	tkn, err := jwt.ParseWithClaims(challenge, claim, challengeKeyFunc(ctx))
+	if err != nil || !tkn.Valid || claim.Purpose != model.TokenPurposeMFA {
+		ctx.Logger().Warn().Err(err).Msg("parse mfa challenge failed")
+		return nil, ErrInvalidMFAChallenge
+	}
+
+	// password change or session revocation also revokes challenges
+	revoked, err := isTokenRevoked(ctx, claim)
+	if err != nil {
+		return nil, err
+	}
+	if revoked {
+		return nil, ErrTokenRevoked
+	}
+	return claim, nil
+}
+
+// userFromMFAChallenge returns user of a valid challenge
+func userFromMFAChallenge(ctx *model.JWTContext, challenge string) (*model.JWTClaim, *model.UserAccount, error) {
+	claim, err := parseMFAChallenge(ctx, challenge)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	user, err := model.GetUserAccountById(ctx, claim.UserId)
+	if err != nil {
+		return nil, nil, err
+	}
+	if user == nil {
+		return nil, nil, ErrInvalidMFAChallenge
+	}
+	if !user.Valid {
+		return nil, nil, ErrUserIsInvalid
+	}
+	return claim, user, nil
+}
+
+// second step of login
+// if user hasn't enabled TOTP, code is checked with the secret from JWTLoginMFAEnroll
+// and TOTP is enabled, recovery codes are returned in resp.MFA
+func JWTLoginMFA(ctx *model.JWTContext, challenge, code, recoveryCode string) *model.JWTResponse {
+	resp := model.InitJWTResponse()
+	claim, user, err := userFromMFAChallenge(ctx, challenge)
+	if err != nil {
+		resp.Err = err
+		return resp
+	}
+
+	var codes []string
+	if user.MFAEnabled {
+		err = verifyMFACode(ctx, user, code, recoveryCode)
+	} else {
+		codes, err = confirmMFAEnroll(ctx, user, code)
+	}
+	if err != nil {
+		resp.Err = err
+		return resp
+	}
+
+	// challenge can only be used once
+	err = RevokeToken(ctx, claim)
+	if err != nil {
+		resp.Err = err
+		return resp
+	}
+
+	resp = createTokenPair(ctx, user, "")
+	if len(codes) > 0 {
+		resp.MFA = &model.MFAResult{RecoveryCodes: codes}
+	}
+	return resp
+}
+
+// start TOTP enrollment by challenge, it's used when TOTP is required but not enabled
+func JWTLoginMFAEnroll(ctx *model.JWTContext, challenge string) *model.JWTResponse {
+	resp := model.InitJWTResponse()
+	_, user, err := userFromMFAChallenge(ctx, challenge)
+	if err != nil {
+		resp.Err = err
+		return resp
+	}
+
+	return startMFAEnroll(ctx, user)
+}
+
+// start TOTP enrollment of current user
+func JWTEnrollMFA(ctx *model.JWTContext) *model.JWTResponse {
+	resp := model.InitJWTResponse()
+	user, err := currentUser(ctx)
+	if err != nil {
+		resp.Err = err
+		return resp
+	}
+
+	return startMFAEnroll(ctx, user)
+}
+
+// confirm TOTP enrollment of current user, recovery codes are returned in resp.MFA
+func JWTConfirmMFA(ctx *model.JWTContext, code string) *model.JWTResponse {
+	resp := model.InitJWTResponse()
+	user, err := currentUser(ctx)
+	if err != nil {
+		resp.Err = err
+		return resp
+	}
+
+	codes, err := confirmMFAEnroll(ctx, user, code)
+	if err != nil {
+		resp.Err = err
+		return resp
+	}
+
+	resp.UserAccount = user
+	resp.MFA = &model.MFAResult{RecoveryCodes: codes}
+	return resp
+}
+
+// disable TOTP of current user, password and a totp code or recovery code are required
+func JWTDisableMFA(ctx *model.JWTContext, passwd, code, recoveryCode string) *model.JWTResponse {
+	resp := model.InitJWTResponse()
+	user, err := currentUser(ctx)
+	if err != nil {
+		resp.Err = err
+		return resp
+	}
+
+	if !user.MFAEnabled {
+		resp.Err = ErrMFANotEnabled
+		return resp
+	}
+	err = checkReauthPasswd(ctx, user, passwd)
+	if err != nil {
+		ctx.Logger().Warn().Err(err).Str("username", user.Username).Msg("JWTDisableMFA, check password failed")
+		resp.Err = err
+		return resp
+	}
+	if ctx.Opt.MFAOpt != nil && ctx.Opt.MFAOpt.RequireForAdmin && user.Role == model.UserRoleAdmin {
+		resp.Err = ErrMFARequired
+		return resp
+	}
+
+	// password alone isn't enough, it may have been stolen with the token
+	err = verifyMFACode(ctx, user, code, recoveryCode)
+	if err != nil {
+		resp.Err = err
+		return resp
+	}
+
+	user.ClearMFA()
+	err = model.UpdateUserAccount(ctx, user)
+	if err != nil {
+		resp.Err = err
+		return resp
+	}
+
+	ctx.Logger().Info().Str("username", user.Username).Msg("disable totp success")
+	resp.UserAccount = user
+	return resp
+}
+
+func currentUser(ctx *model.JWTContext) (*model.UserAccount, error) {
+	claim := GetCurUser(ctx.C)
+	if claim == nil {
+		ctx.Logger().Error().Err(ErrContextNoClaim).Msg("get user from request context failed")
+		return nil, ErrContextNoClaim
+	}
+
+	user, err := model.GetUserAccountById(ctx, claim.UserId)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		return nil, ErrUserNotExist
+	}
+	return user, nil
+}
+
+// startMFAEnroll saves a pending secret, it's enabled after a code is confirmed
+func startMFAEnroll(ctx *model.JWTContext, user *model.UserAccount) *model.JWTResponse {
+	resp := model.InitJWTResponse()
+	if user.MFAEnabled {
+		resp.Err = ErrMFAAlreadyEnabled
+		return resp
+	}
+
+	secret, err := model.GenerateTOTPSecret()
+	if err != nil {
+		resp.Err = err
+		return resp
+	}
+	sealed, err := ctx.Opt.MFAOpt.SealSecret(secret)
+	if err != nil {
+		resp.Err = err
+		return resp
+	}
+
+	user.MFAPendingSecret = sealed
+	err = model.UpdateUserAccount(ctx, user)
+	if err != nil {
+		resp.Err = err
+		return resp
+	}
+
+	ctx.Logger().Info().Str("username", user.Username).Msg("start totp enrollment")
+	resp.UserAccount = user
+	resp.MFA = &model.MFAResult{
+		Secret: secret,
+		URI:    model.TOTPURI(ctx.Opt.MFAOpt.IssuerName(), user.Username, secret),
+	}
+	return resp
+}
+
+// confirmMFAEnroll checks code with pending secret and enables TOTP
+func confirmMFAEnroll(ctx *model.JWTContext, user *model.UserAccount, code string) ([]string, error) {
+	if user.MFAEnabled {
+		return nil, ErrMFAAlreadyEnabled
+	}
+	if user.MFAPendingSecret == "" {
+		return nil, ErrMFANotEnrolled
+	}
+
+	key := model.LoginLimitMFAKey(user.Id)
+	if until := ctx.LoginLimiter.BlockedUntil(key); !until.IsZero() {
+		return nil, &LoginLockedError{Until: until}
+	}
+
+	secret, err := ctx.Opt.MFAOpt.OpenSecret(user.MFAPendingSecret)
+	if err != nil {
+		return nil, err
+	}
+	step, ok := model.VerifyTOTP(secret, code, time.Now(), 0)
+	if !ok {
+		ctx.LoginLimiter.Fail(key, ctx.LoginLimiter.Option().MaxFailedAttempts)
+		ctx.Logger().Warn().Str("username", user.Username).Msg("confirm totp failed, wrong code")
+		return nil, ErrInvalidMFACode
+	}
+
+	codes, hashed, err := ctx.Opt.MFAOpt.GenerateRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+
+	user.MFAEnabled = true
+	user.MFASecret = user.MFAPendingSecret
+	user.MFAPendingSecret = ""
+	user.MFALastStep = step
+	user.RecoveryCodes = hashed
+	err = model.UpdateUserAccount(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+	ctx.LoginLimiter.Reset(key)
+
+	ctx.Logger().Info().Str("username", user.Username).Msg("enable totp success")
+	return codes, nil
+}
+
+// verifyMFACode checks TOTP code, or recovery code if code is empty
+func verifyMFACode(ctx *model.JWTContext, user *model.UserAccount, code, recoveryCode string) error {
+	key := model.LoginLimitMFAKey(user.Id)
+	if until := ctx.LoginLimiter.BlockedUntil(key); !until.IsZero() {
+		return &LoginLockedError{Until: until}
+	}
+
+	ok := false
+	if code != "" {
+		secret, err := ctx.Opt.MFAOpt.OpenSecret(user.MFASecret)
+		if err != nil {
+			return err
+		}
+		var step int64
+		step, ok = model.VerifyTOTP(secret, code, time.Now(), user.MFALastStep)
+		if ok {
+			user.MFALastStep = step
+		}
+	} else if recoveryCode != "" {
+		ok = user.UseRecoveryCode(recoveryCode)
+		if ok {
+			ctx.Logger().Warn().Str("username", user.Username).Int("left", len(user.RecoveryCodes)).Msg("recovery code is used")
+		}
+	}
+
+	if !ok {
+		ctx.LoginLimiter.Fail(key, ctx.LoginLimiter.Option().MaxFailedAttempts)
+		ctx.Logger().Warn().Str("username", user.Username).Msg("verify totp failed")
+		return ErrInvalidMFACode
+	}
+
+	// last step and used recovery code must be saved, or they can be used again
+	err := model.UpdateUserAccount(ctx, user)
+	if err != nil {
+		return err
+	}
+	ctx.LoginLimiter.Reset(key)
+	return nil
+}
@@ -0,0 +1,275 @@
+package jwtwrapper
+
+import (
+	"github.com/leyle/fabric-user-manager/model"
+	"testing"
+	"time"
+)
+
+type mfaFixture struct {
+	user          *model.UserAccount
+	secret        string
+	recoveryCodes []string
+}
+
+// enableTestMFA enables TOTP of user with the code of previous step,
+// so the code of current step can still be used once
+func enableTestMFA(t *testing.T, ctx *model.JWTContext, user *model.UserAccount) *mfaFixture {
+	t.Helper()
+	resp := startMFAEnroll(ctx, getTestUser(t, ctx, user.Id))
+	if resp.Err != nil {
+		t.Fatal(resp.Err)
+	}
+	secret := resp.MFA.Secret
+
+	code := totpCode(t, secret, model.TOTPStep(time.Now())-1)
+	codes, err := confirmMFAEnroll(ctx, getTestUser(t, ctx, user.Id), code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &mfaFixture{
+		user:          getTestUser(t, ctx, user.Id),
+		secret:        secret,
+		recoveryCodes: codes,
+	}
+}
+
+func totpCode(t *testing.T, secret string, step int64) string {
+	t.Helper()
+	code, err := model.TOTPCode(secret, step)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return code
+}
+
+func loginChallenge(t *testing.T, ctx *model.JWTContext, username string) string {
+	t.Helper()
+	resp := JWTLogin(newRequestCtx(ctx), username, testPasswd)
+	if resp.Err != nil {
+		t.Fatal(resp.Err)
+	}
+	if resp.MFA == nil || resp.MFA.Challenge == "" || resp.Token != "" {
+		t.Fatal("login doesn't return a challenge only")
+	}
+	return resp.MFA.Challenge
+}
+
+func TestJWTLoginMFA(t *testing.T) {
+	curCode := func(t *testing.T, m *mfaFixture) string {
+		return totpCode(t, m.secret, model.TOTPStep(time.Now()))
+	}
+
+	tests := []struct {
+		name string
+		// prepare returns challenge, totp code and recovery code to finish login
+		prepare func(t *testing.T, ctx *model.JWTContext, m *mfaFixture) (string, string, string)
+		wantErr error
+	}{
+		{
+			name: "totp code",
+			prepare: func(t *testing.T, ctx *model.JWTContext, m *mfaFixture) (string, string, string) {
+				return loginChallenge(t, ctx, m.user.Username), curCode(t, m), ""
+			},
+		},
+		{
+			name: "wrong totp code",
+			prepare: func(t *testing.T, ctx *model.JWTContext, m *mfaFixture) (string, string, string) {
+				return loginChallenge(t, ctx, m.user.Username), "000000", ""
+			},
+			wantErr: ErrInvalidMFACode,
+		},
+		{
+			name: "replayed totp code",
+			prepare: func(t *testing.T, ctx *model.JWTContext, m *mfaFixture) (string, string, string) {
+				code := curCode(t, m)
+				if resp := JWTLoginMFA(ctx, loginChallenge(t, ctx, m.user.Username), code, ""); resp.Err != nil {
+					t.Fatal(resp.Err)
+				}
+				return loginChallenge(t, ctx, m.user.Username), code, ""
+			},
+			wantErr: ErrInvalidMFACode,
+		},
+		{
+			name: "recovery code",
+			prepare: func(t *testing.T, ctx *model.JWTContext, m *mfaFixture) (string, string, string) {
+				return loginChallenge(t, ctx, m.user.Username), "", m.recoveryCodes[0]
+			},
+		},
+		{
+			name: "reused recovery code",
+			prepare: func(t *testing.T, ctx *model.JWTContext, m *mfaFixture) (string, string, string) {
+				if resp := JWTLoginMFA(ctx, loginChallenge(t, ctx, m.user.Username), "", m.recoveryCodes[0]); resp.Err != nil {
+					t.Fatal(resp.Err)
+				}
+				return loginChallenge(t, ctx, m.user.Username), "", m.recoveryCodes[0]
+			},
+			wantErr: ErrInvalidMFACode,
+		},
+		{
+			name: "reused challenge",
+			prepare: func(t *testing.T, ctx *model.JWTContext, m *mfaFixture) (string, string, string) {
+				challenge := loginChallenge(t, ctx, m.user.Username)
+				if resp := JWTLoginMFA(ctx, challenge, "", m.recoveryCodes[0]); resp.Err != nil {
+					t.Fatal(resp.Err)
+				}
+				return challenge, "", m.recoveryCodes[1]
+			},
+			wantErr: ErrTokenRevoked,
+		},
+		{
+			name: "access token as challenge",
+			prepare: func(t *testing.T, ctx *model.JWTContext, m *mfaFixture) (string, string, string) {
+				resp := createTokenPair(ctx, m.user, "")
+				if resp.Err != nil {
+					t.Fatal(resp.Err)
+				}
+				return resp.Token, curCode(t, m), ""
+			},
+			wantErr: ErrInvalidMFAChallenge,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := setupCtx(t)
+			m := enableTestMFA(t, ctx, createTestUser(t, ctx, "alice", model.UserRoleUser))
+
+			challenge, code, recoveryCode := tt.prepare(t, ctx, m)
+			resp := JWTLoginMFA(ctx, challenge, code, recoveryCode)
+			if resp.Err != tt.wantErr {
+				t.Fatalf("login mfa error = %v, want %v", resp.Err, tt.wantErr)
+			}
+			if tt.wantErr == nil && (resp.Token == "" || resp.RefreshToken == "") {
+				t.Fatal("no token pair returned")
+			}
+		})
+	}
+}
+
+func TestMFAChallengeIsNotAccessToken(t *testing.T) {
+	ctx := setupCtx(t)
+	m := enableTestMFA(t, ctx, createTestUser(t, ctx, "alice", model.UserRoleUser))
+
+	challenge := loginChallenge(t, ctx, m.user.Username)
+	if resp := ParseJWTToken(ctx, challenge); resp.Err == nil {
+		t.Fatal("challenge is accepted as access token")
+	}
+}
+
+func TestJWTLoginMFALockout(t *testing.T) {
+	ctx := setupCtx(t)
+	m := enableTestMFA(t, ctx, createTestUser(t, ctx, "alice", model.UserRoleUser))
+
+	for i := 0; i < 3; i++ {
+		resp := JWTLoginMFA(ctx, loginChallenge(t, ctx, m.user.Username), "000000", "")
+		if resp.Err != ErrInvalidMFACode {
+			t.Fatalf("login mfa %d error = %v, want %v", i, resp.Err, ErrInvalidMFACode)
+		}
+	}
+
+	// right code is refused too
+	resp := JWTLoginMFA(ctx, loginChallenge(t, ctx, m.user.Username), "", m.recoveryCodes[0])
+	if _, ok := resp.Err.(*LoginLockedError); !ok {
+		t.Fatalf("login mfa error = %v, want LoginLockedError", resp.Err)
+	}
+}
+
+func TestJWTDisableMFA(t *testing.T) {
+	tests := []struct {
+		name string
+		// wrong passwords tried before disabling
+		failures      int
+		passwd        string
+		code          func(t *testing.T, m *mfaFixture) (string, string)
+		wantErr       error
+		wantLockedErr bool
+		wantAttempts  int
+	}{
+		{
+			name:   "totp code",
+			passwd: testPasswd,
+			code: func(t *testing.T, m *mfaFixture) (string, string) {
+				return totpCode(t, m.secret, model.TOTPStep(time.Now())), ""
+			},
+		},
+		{
+			name:   "recovery code",
+			passwd: testPasswd,
+			code: func(t *testing.T, m *mfaFixture) (string, string) {
+				return "", m.recoveryCodes[0]
+			},
+		},
+		{
+			name:   "password only",
+			passwd: testPasswd,
+			code: func(t *testing.T, m *mfaFixture) (string, string) {
+				return "", ""
+			},
+			wantErr: ErrInvalidMFACode,
+		},
+		{
+			name:   "wrong code",
+			passwd: testPasswd,
+			code: func(t *testing.T, m *mfaFixture) (string, string) {
+				return "000000", ""
+			},
+			wantErr: ErrInvalidMFACode,
+		},
+		{
+			name:   "wrong password",
+			passwd: "wrong",
+			code: func(t *testing.T, m *mfaFixture) (string, string) {
+				return "", m.recoveryCodes[0]
+			},
+			wantErr:      ErrWrongPasswd,
+			wantAttempts: 1,
+		},
+		{
+			name:     "locked by wrong passwords",
+			failures: 3,
+			passwd:   testPasswd,
+			code: func(t *testing.T, m *mfaFixture) (string, string) {
+				return "", m.recoveryCodes[0]
+			},
+			wantLockedErr: true,
+			wantAttempts:  3,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := setupCtx(t)
+			m := enableTestMFA(t, ctx, createTestUser(t, ctx, "alice", model.UserRoleUser))
+
+			disable := func(passwd, code, recoveryCode string) *model.JWTResponse {
+				reqCtx := newRequestCtx(ctx)
+				loginAs(reqCtx, m.user)
+				return JWTDisableMFA(reqCtx, passwd, code, recoveryCode)
+			}
+			for i := 0; i < tt.failures; i++ {
+				if resp := disable("wrong", "", m.recoveryCodes[0]); resp.Err != ErrWrongPasswd {
+					t.Fatalf("disable %d error = %v, want %v", i, resp.Err, ErrWrongPasswd)
+				}
+			}
+
+			code, recoveryCode := tt.code(t, m)
+			resp := disable(tt.passwd, code, recoveryCode)
+			if tt.wantLockedErr {
+				if _, ok := resp.Err.(*LoginLockedError); !ok {
+					t.Fatalf("disable error = %v, want LoginLockedError", resp.Err)
+				}
+			} else if resp.Err != tt.wantErr {
+				t.Fatalf("disable error = %v, want %v", resp.Err, tt.wantErr)
+			}
+
+			saved := getTestUser(t, ctx, m.user.Id)
+			if saved.MFAEnabled != (resp.Err != nil) {
+				t.Errorf("mfa enabled = %v after disable error %v", saved.MFAEnabled, resp.Err)
+			}
+			if saved.FailedAttempts != tt.wantAttempts {
+				t.Errorf("failed attempts = %d, want %d", saved.FailedAttempts, tt.wantAttempts)
+			}
+		})
+	}
+}
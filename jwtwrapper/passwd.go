@@ -0,0 +1,126 @@
+package jwtwrapper
+
+import (
+	"errors"
+	"github.com/leyle/fabric-user-manager/model"
+	"github.com/leyle/go-api-starter/util"
+)
+
+var (
+	ErrMustChangePasswd = errors.New("password must be changed before using other apis")
+	ErrSamePasswd       = errors.New("new password must be different from old password")
+)
+
+// change password
+// current user's all sessions are revoked, a new token pair is returned
+func JWTChangePasswd(ctx *model.JWTContext, oldPasswd, newPasswd string) *model.JWTResponse {
+	resp := model.InitJWTResponse()
+	claim := GetCurUser(ctx.C)
+	if claim == nil {
+		resp.Err = ErrContextNoClaim
+		ctx.Logger().Error().Err(ErrContextNoClaim).Msg("get user from request context failed")
+		return resp
+	}
+
+	user, err := model.GetUserAccountById(ctx, claim.UserId)
+	if err != nil {
+		resp.Err = err
+		return resp
+	}
+	if user == nil {
+		resp.Err = ErrUserNotExist
+		return resp
+	}
+
+	err = checkReauthPasswd(ctx, user, oldPasswd)
+	if err != nil {
+		ctx.Logger().Warn().Err(err).Str("username", user.Username).Msg("JWTChangePasswd, check old password failed")
+		resp.Err = err
+		return resp
+	}
+
+	if oldPasswd == newPasswd {
+		resp.Err = ErrSamePasswd
+		return resp
+	}
+
+	err = ctx.Opt.PasswdPolicyOpt.Check(newPasswd, user)
+	if err != nil {
+		ctx.Logger().Warn().Err(err).Str("username", user.Username).Msg("JWTChangePasswd, password doesn't meet policy")
+		resp.Err = err
+		return resp
+	}
+
+	err = user.ChangePasswd(ctx.Opt.PasswdHashOpt, ctx.Opt.PasswdPolicyOpt, newPasswd)
+	if err != nil {
+		resp.Err = err
+		return resp
+	}
+	user.MustChangePasswd = false
+	err = model.UpdateUserAccount(ctx, user)
+	if err != nil {
+		resp.Err = err
+		return resp
+	}
+
+	// other sessions are revoked, the new token returned to caller is kept
+	jti := util.GenerateDataId()
+	err = revokeUserTokensExcept(ctx, user.Id, jti)
+	if err != nil {
+		resp.Err = err
+		return resp
+	}
+
+	ctx.Logger().Info().Str("username", user.Username).Msg("change password success")
+	resp = createTokenPairWithId(ctx, user, "", jti)
+	return resp
+}
+
+// reset password, only admin can do it
+// a temporary password is returned in resp.Passwd, user must change it after login
+func JWTResetPasswd(ctx *model.JWTContext, userId string) *model.JWTResponse {
+	resp := model.InitJWTResponse()
+	if _, err := requireAdmin(ctx); err != nil {
+		resp.Err = err
+		return resp
+	}
+
+	user, err := model.GetUserAccountById(ctx, userId)
+	if err != nil {
+		resp.Err = err
+		return resp
+	}
+	if user == nil {
+		resp.Err = ErrUserNotExist
+		return resp
+	}
+
+	passwd, err := ctx.Opt.PasswdPolicyOpt.GenerateTempPasswd()
+	if err != nil {
+		resp.Err = err
+		return resp
+	}
+
+	err = user.ChangePasswd(ctx.Opt.PasswdHashOpt, ctx.Opt.PasswdPolicyOpt, passwd)
+	if err != nil {
+		resp.Err = err
+		return resp
+	}
+	user.MustChangePasswd = true
+	err = model.UpdateUserAccount(ctx, user)
+	if err != nil {
+		resp.Err = err
+		return resp
+	}
+
+	err = RevokeUserTokens(ctx, user.Id)
+	if err != nil {
+		resp.Err = err
+		return resp
+	}
+
+	ctx.Logger().Info().Str("username", user.Username).Msg("reset password success")
+	resp.UserAccount = user
+	resp.Passwd = passwd
+	return resp
+}
@@ -0,0 +1,275 @@
+package jwtwrapper
+
+import (
+	"github.com/leyle/fabric-user-manager/model"
+	"strings"
+	"time"
+)
+
+const defaultReconcileIntervalMinutes = 60
+
+// mismatch types found by reconciliation
+const (
+	// ca identity without db user
+	ReconcileOrphanCAIdentity = "orphanCAIdentity"
+
+	// wallet identity without db user
+	ReconcileOrphanWallet = "orphanWallet"
+
+	// active db user and ca identity exist, but wallet identity is missing
+	ReconcileMissingWallet = "missingWallet"
+
+	// active db user without ca identity
+	ReconcileMissingCAIdentity = "missingCAIdentity"
+
+	// deleted db user whose ca identity or wallet identity still exists
+	ReconcileDeletedUserLeft = "deletedUserLeft"
+)
+
+type ReconcileIssue struct {
+	Type     string `json:"type"`
+	EnrollId string `json:"enrollId"`
+	UserId   string `json:"userId,omitempty"`
+	Repaired bool   `json:"repaired"`
+	Err      string `json:"err,omitempty"`
+}
+
+type ReconcileReport struct {
+	StartedAt    int64             `json:"startedAt"`
+	FinishedAt   int64             `json:"finishedAt"`
+	Repair       bool              `json:"repair"`
+	CAIdentities int               `json:"caIdentities"`
+	WalletLabels int               `json:"walletLabels"`
+	DBUsers      int               `json:"dbUsers"`
+	Issues       []*ReconcileIssue `json:"issues"`
+}
+
+// reconcile by api, only admin can do it
+// orphan ca identities are only removed by this api
+func JWTReconcile(ctx *model.JWTContext, repair bool) (*ReconcileReport, error) {
+	claim, err := requireAdmin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ctx.Logger().Info().Str("username", claim.UserName).Bool("repair", repair).Msg("start reconciliation")
+	return Reconcile(ctx, repair, repair)
+}
+
+// Reconcile compares db users, wallet identities and ca identities
+// if repair is true, mismatches are repaired, repair results are in the report
+// orphan ca identities are reported but kept unless removeOrphanCA is true too
+func Reconcile(ctx *model.JWTContext, repair, removeOrphanCA bool) (*ReconcileReport, error) {
+	report := &ReconcileReport{
+		StartedAt: time.Now().Unix(),
+		Repair:    repair,
+		Issues:    []*ReconcileIssue{},
+	}
+
+	// 1. ca identities
+	resp := getMSPClient(ctx)
+	if resp.Err != nil {
+		return nil, resp.Err
+	}
+	caIds, err := resp.MspClient.GetAllIdentities()
+	if err != nil {
+		ctx.Logger().Error().Err(err).Msg("reconcile, get ca identities failed")
+		return nil, err
+	}
+	caSet := make(map[string]string, len(caIds))
+	for _, id := range caIds {
+		caSet[id.ID] = id.Type
+	}
+	report.CAIdentities = len(caSet)
+
+	// 2. wallet identities, quarantined ones are kept for audit
+	wallet, err := NewWallet(ctx)
+	if err != nil {
+		return nil, err
+	}
+	labels, err := wallet.List()
+	if err != nil {
+		ctx.Logger().Error().Err(err).Msg("reconcile, list wallet failed")
+		return nil, err
+	}
+	walletSet := make(map[string]bool, len(labels))
+	for _, label := range labels {
+		if !strings.HasPrefix(label, walletQuarantinePrefix) {
+			walletSet[label] = true
+		}
+	}
+	report.WalletLabels = len(walletSet)
+
+	// 3. db users
+	users, err := listAllUsers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	userSet := make(map[string]*model.UserAccount, len(users))
+	for _, ua := range users {
+		userSet[ua.Username] = ua
+	}
+	report.DBUsers = len(users)
+
+	ignored := reconcileIgnored(ctx)
+
+	for _, ua := range users {
+		// pending registration is handled by saga recovery
+		if ua.RegisterPending || ignored[ua.Username] {
+			continue
+		}
+		_, inCA := caSet[ua.Username]
+		inWallet := walletSet[ua.Username]
+
+		switch {
+		case ua.DeletedAt > 0:
+			if inCA || inWallet {
+				report.add(ctx, repair, ReconcileDeletedUserLeft, ua.Username, ua, func() error {
+					return deleteUser(ctx, ua, false)
+				})
+			}
+		case !ua.Valid:
+			// disabled user's wallet identity is quarantined
+		case !inCA:
+			report.add(ctx, repair, ReconcileMissingCAIdentity, ua.Username, ua, func() error {
+				// wallet may still have the old identity, it's replaced by enrollUser
+				err := caRegisterIdentity(ctx, resp.MspClient, ua.Username, ua.Id, ua.Role, ua.Affiliation, ua.CAAttrs)
+				if err != nil {
+					return err
+				}
+				return enrollUser(ctx, ua)
+			})
+		case !inWallet:
+			report.add(ctx, repair, ReconcileMissingWallet, ua.Username, ua, func() error {
+				return enrollUser(ctx, ua)
+			})
+		}
+	}
+
+	for enrollId, idType := range caSet {
+		if userSet[enrollId] != nil || ignored[enrollId] {
+			continue
+		}
+		// network nodes are registered by operators
+		if idType == string(model.UserRolePeer) || idType == string(model.UserRoleOrderer) {
+			continue
+		}
+		// removing a ca identity can't be undone, it's only done by admin's request
+		enrollId := enrollId
+		report.add(ctx, repair && removeOrphanCA, ReconcileOrphanCAIdentity, enrollId, nil, func() error {
+			if err := CARemoveIdentity(ctx, enrollId); err != nil {
+				return err
+			}
+			return RemoveWalletIdentity(ctx, enrollId)
+		})
+	}
+
+	for label := range walletSet {
+		if userSet[label] != nil || ignored[label] {
+			continue
+		}
+		// it's reported with its ca identity
+		if _, inCA := caSet[label]; inCA {
+			continue
+		}
+		label := label
+		report.add(ctx, repair, ReconcileOrphanWallet, label, nil, func() error {
+			return RemoveWalletIdentity(ctx, label)
+		})
+	}
+
+	report.FinishedAt = time.Now().Unix()
+	ctx.Logger().Info().Int("issues", len(report.Issues)).Bool("repair", repair).Msg("reconciliation finished")
+	return report, nil
+}
+
+func (r *ReconcileReport) add(ctx *model.JWTContext, repair bool, issueType, enrollId string, ua *model.UserAccount, fix func() error) {
+	issue := &ReconcileIssue{
+		Type:     issueType,
+		EnrollId: enrollId,
+	}
+	if ua != nil {
+		issue.UserId = ua.Id
+	}
+	r.Issues = append(r.Issues, issue)
+	ctx.Logger().Warn().Str("type", issueType).Str("enrollId", enrollId).Msg("reconcile, mismatch found")
+
+	if !repair {
+		return
+	}
+
+	err := fix()
+	if err != nil {
+		issue.Err = err.Error()
+	} else {
+		issue.Repaired = true
+	}
+
+	target := ua
+	if target == nil {
+		target = &model.UserAccount{Username: enrollId}
+	}
+	// background job has no request
+	var actor *model.JWTClaim
+	if ctx.C != nil {
+		actor = GetCurUser(ctx.C)
+	}
+	saveAudit(ctx, model.AuditActionReconcileRepair, actor, target, err, map[string]interface{}{
+		"type": issueType,
+	})
+}
+
+func reconcileIgnored(ctx *model.JWTContext) map[string]bool {
+	ignored := map[string]bool{
+		ctx.Opt.Registrar.EnrollId: true,
+	}
+	if opt := ctx.Opt.ReconcileOpt; opt != nil {
+		for _, id := range opt.IgnoreIdentities {
+			ignored[id] = true
+		}
+	}
+	return ignored
+}
+
+func listAllUsers(ctx *model.JWTContext) ([]*model.UserAccount, error) {
+	var users []*model.UserAccount
+	query := &model.UserQuery{
+		Limit: purgeScanLimit,
+	}
+	for {
+		list, err := model.ListUserAccounts(ctx, query)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, list.Users...)
+		if list.Bookmark == "" {
+			break
+		}
+		query.Bookmark = list.Bookmark
+	}
+	return users, nil
+}
+
+// StartReconcile runs reconciliation periodically until stop is closed
+func StartReconcile(ctx *model.JWTContext, stop <-chan struct{}) {
+	opt := ctx.Opt.ReconcileOpt
+	minutes := defaultReconcileIntervalMinutes
+	if opt.IntervalMinutes > 0 {
+		minutes = opt.IntervalMinutes
+	}
+
+	go func() {
+		ticker := time.NewTicker(time.Duration(minutes) * time.Minute)
+		defer ticker.Stop()
+		for {
+			// scheduled run never removes ca identities, they may be created out of this service
+			if _, err := Reconcile(ctx, opt.Repair, false); err != nil {
+				ctx.Logger().Error().Err(err).Msg("reconcile failed")
+			}
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
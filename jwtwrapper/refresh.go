@@ -0,0 +1,175 @@
+package jwtwrapper
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"github.com/leyle/fabric-user-manager/model"
+	"github.com/leyle/go-api-starter/util"
+	"time"
+)
+
+var (
+	ErrInvalidRefreshToken = errors.New("invalid refresh token")
+	ErrRefreshTokenExpired = errors.New("refresh token has expired")
+	ErrRefreshTokenReused  = errors.New("refresh token has been used, all tokens of this login are revoked")
+)
+
+const refreshTokenBytes = 32
+
+// refresh
+// input value is the refresh token returned by login or last refresh
+// the refresh token can only be used once, a new access token and refresh token are returned
+// if a used refresh token is replayed, the whole token family is revoked
+func JWTRefresh(ctx *model.JWTContext, refreshToken string) *model.JWTResponse {
+	resp := model.InitJWTResponse()
+
+	rt, err := model.GetRefreshToken(ctx, hashRefreshToken(refreshToken))
+	if err != nil {
+		resp.Err = err
+		return resp
+	}
+	if rt == nil {
+		ctx.Logger().Warn().Msg("JWTRefresh, no data refer to refresh token")
+		resp.Err = ErrInvalidRefreshToken
+		return resp
+	}
+
+	if rt.Revoked {
+		ctx.Logger().Warn().Str("familyId", rt.FamilyId).Msg("JWTRefresh, refresh token has been revoked")
+		resp.Err = ErrInvalidRefreshToken
+		return resp
+	}
+
+	if rt.Used {
+		// someone replays an old refresh token, it may be stolen
+		// revoke the whole family, the real owner has to login again
+		ctx.Logger().Warn().Str("familyId", rt.FamilyId).Str("username", rt.Username).Msg("JWTRefresh, refresh token reuse detected")
+		if err = revokeRefreshTokenFamily(ctx, rt.FamilyId); err != nil {
+			resp.Err = err
+			return resp
+		}
+		resp.Err = ErrRefreshTokenReused
+		return resp
+	}
+
+	if rt.IsExpired() {
+		ctx.Logger().Warn().Str("familyId", rt.FamilyId).Msg("JWTRefresh, refresh token has expired")
+		resp.Err = ErrRefreshTokenExpired
+		return resp
+	}
+
+	// mark it used, the rev check makes sure only one request wins
+	rt.Used = true
+	err = model.UpdateRefreshToken(ctx, rt)
+	if err != nil {
+		if err == model.ErrDocConflict {
+			err = ErrInvalidRefreshToken
+		}
+		resp.Err = err
+		return resp
+	}
+
+	user, err := model.GetUserAccountById(ctx, rt.UserId)
+	if err != nil {
+		resp.Err = err
+		return resp
+	}
+	if user == nil || !user.Valid {
+		ctx.Logger().Warn().Str("userId", rt.UserId).Msg("JWTRefresh failed, user is invalid")
+		resp.Err = ErrUserIsInvalid
+		return resp
+	}
+
+	resp = createTokenPair(ctx, user, rt.FamilyId)
+	if resp.Err != nil {
+		return resp
+	}
+
+	ctx.Logger().Debug().Str("username", user.Username).Msg("refresh token success")
+	return resp
+}
+
+// createTokenPair generates access token and refresh token
+// familyId is empty when user login, a new family is started
+func createTokenPair(ctx *model.JWTContext, user *model.UserAccount, familyId string) *model.JWTResponse {
+	return createTokenPairWithId(ctx, user, familyId, "")
+}
+
+// createTokenPairWithId uses jti as access token's id, empty jti means a new one
+func createTokenPairWithId(ctx *model.JWTContext, user *model.UserAccount, familyId, jti string) *model.JWTResponse {
+	resp := model.InitJWTResponse()
+
+	token, err := createJWTToken(ctx, user, jti)
+	if err != nil {
+		resp.Err = err
+		return resp
+	}
+
+	if familyId == "" {
+		familyId = util.GenerateDataId()
+	}
+	refreshToken, err := createRefreshToken(ctx, user, familyId)
+	if err != nil {
+		resp.Err = err
+		return resp
+	}
+
+	resp.Token = token
+	resp.RefreshToken = refreshToken
+	resp.UserAccount = user
+	return resp
+}
+
+func createRefreshToken(ctx *model.JWTContext, user *model.UserAccount, familyId string) (string, error) {
+	buf := make([]byte, refreshTokenBytes)
+	if _, err := rand.Read(buf); err != nil {
+		ctx.Logger().Error().Err(err).Msg("generate refresh token failed")
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(buf)
+
+	expireTime := time.Now().Add(ctx.Opt.JWTOpt.RefreshTokenTTL())
+	rt := &model.RefreshToken{
+		Id:        hashRefreshToken(token),
+		FamilyId:  familyId,
+		UserId:    user.Id,
+		Username:  user.Username,
+		ExpiresAt: expireTime.Unix(),
+		Created:   util.GetCurTime(),
+	}
+	rt.Updated = rt.Created
+
+	err := model.SaveRefreshToken(ctx, rt)
+	if err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+func revokeRefreshTokenFamily(ctx *model.JWTContext, familyId string) error {
+	rts, err := model.GetActiveRefreshTokensByFamily(ctx, familyId)
+	if err != nil {
+		return err
+	}
+	return revokeRefreshTokens(ctx, rts)
+}
+
+func revokeRefreshTokens(ctx *model.JWTContext, rts []*model.RefreshToken) error {
+	for _, rt := range rts {
+		if rt.Revoked {
+			continue
+		}
+		rt.Revoked = true
+		err := model.UpdateRefreshToken(ctx, rt)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func hashRefreshToken(token string) string {
+	return util.Sha256(token)
+}
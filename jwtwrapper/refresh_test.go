@@ -0,0 +1,171 @@
+package jwtwrapper
+
+import (
+	"github.com/leyle/fabric-user-manager/model"
+	"testing"
+)
+
+func TestJWTRefresh(t *testing.T) {
+	tests := []struct {
+		name string
+		// setup returns the refresh token to use, and the token which must be dead after it
+		setup   func(t *testing.T, ctx *model.JWTContext, login *model.JWTResponse) (token, dead string)
+		wantErr error
+	}{
+		{
+			name: "rotate",
+			setup: func(t *testing.T, ctx *model.JWTContext, login *model.JWTResponse) (string, string) {
+				return login.RefreshToken, ""
+			},
+		},
+		{
+			name: "unknown token",
+			setup: func(t *testing.T, ctx *model.JWTContext, login *model.JWTResponse) (string, string) {
+				return "not-a-refresh-token", ""
+			},
+			wantErr: ErrInvalidRefreshToken,
+		},
+		{
+			name: "reuse revokes family",
+			setup: func(t *testing.T, ctx *model.JWTContext, login *model.JWTResponse) (string, string) {
+				resp := JWTRefresh(ctx, login.RefreshToken)
+				if resp.Err != nil {
+					t.Fatal(resp.Err)
+				}
+				return login.RefreshToken, resp.RefreshToken
+			},
+			wantErr: ErrRefreshTokenReused,
+		},
+		{
+			name: "expired",
+			setup: func(t *testing.T, ctx *model.JWTContext, login *model.JWTResponse) (string, string) {
+				rt, err := model.GetRefreshToken(ctx, hashRefreshToken(login.RefreshToken))
+				if err != nil {
+					t.Fatal(err)
+				}
+				rt.ExpiresAt = 1
+				if err = model.UpdateRefreshToken(ctx, rt); err != nil {
+					t.Fatal(err)
+				}
+				return login.RefreshToken, ""
+			},
+			wantErr: ErrRefreshTokenExpired,
+		},
+		{
+			name: "revoked user",
+			setup: func(t *testing.T, ctx *model.JWTContext, login *model.JWTResponse) (string, string) {
+				if err := RevokeUserTokens(ctx, login.UserAccount.Id); err != nil {
+					t.Fatal(err)
+				}
+				return login.RefreshToken, ""
+			},
+			wantErr: ErrInvalidRefreshToken,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := setupCtx(t)
+			user := createTestUser(t, ctx, "alice", model.UserRoleUser)
+			login := createTokenPair(ctx, user, "")
+			if login.Err != nil {
+				t.Fatal(login.Err)
+			}
+
+			token, dead := tt.setup(t, ctx, login)
+			resp := JWTRefresh(ctx, token)
+			if resp.Err != tt.wantErr {
+				t.Fatalf("refresh error = %v, want %v", resp.Err, tt.wantErr)
+			}
+			if tt.wantErr == nil {
+				if resp.RefreshToken == "" || resp.RefreshToken == token {
+					t.Fatal("refresh token isn't rotated")
+				}
+				if again := JWTRefresh(ctx, token); again.Err != ErrRefreshTokenReused {
+					t.Fatalf("second refresh error = %v, want %v", again.Err, ErrRefreshTokenReused)
+				}
+			}
+			if dead != "" {
+				if resp := JWTRefresh(ctx, dead); resp.Err != ErrInvalidRefreshToken {
+					t.Fatalf("refresh of revoked family error = %v, want %v", resp.Err, ErrInvalidRefreshToken)
+				}
+			}
+		})
+	}
+}
+
+// family is larger than a search page, all its live tokens are revoked
+func TestRevokeRefreshTokenFamily(t *testing.T) {
+	ctx := setupCtx(t)
+	user := createTestUser(t, ctx, "alice", model.UserRoleUser)
+
+	const familyId = "family"
+	const count = 450
+	for i := 0; i < count; i++ {
+		if _, err := createRefreshToken(ctx, user, familyId); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := revokeRefreshTokenFamily(ctx, familyId); err != nil {
+		t.Fatal(err)
+	}
+
+	rts, err := model.GetActiveRefreshTokensByFamily(ctx, familyId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rts) != 0 {
+		t.Fatalf("%d tokens are still active", len(rts))
+	}
+}
+
+func TestRevokeUserTokensCutoff(t *testing.T) {
+	ctx := setupCtx(t)
+	user := createTestUser(t, ctx, "alice", model.UserRoleUser)
+	other := createTestUser(t, ctx, "bob", model.UserRoleUser)
+
+	old := createTokenPair(ctx, user, "")
+	kept := createTokenPairWithId(ctx, user, "", "kept-jti")
+	otherToken := createTokenPair(ctx, other, "")
+	for _, resp := range []*model.JWTResponse{old, kept, otherToken} {
+		if resp.Err != nil {
+			t.Fatal(resp.Err)
+		}
+	}
+
+	if err := revokeUserTokensExcept(ctx, user.Id, "kept-jti"); err != nil {
+		t.Fatal(err)
+	}
+
+	// cache of this instance and db read by another instance must agree
+	fresh := newRequestCtx(ctx)
+	fresh.Revocation = model.NewRevocationCache(0)
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr error
+	}{
+		{"issued before cutoff", old.Token, ErrTokenRevoked},
+		{"kept by jti", kept.Token, nil},
+		{"other user", otherToken.Token, nil},
+	}
+	for _, tt := range tests {
+		for _, c := range []*model.JWTContext{ctx, fresh} {
+			resp := ParseJWTToken(c, tt.token)
+			if resp.Err != tt.wantErr {
+				t.Errorf("%s: parse error = %v, want %v", tt.name, resp.Err, tt.wantErr)
+			}
+		}
+	}
+
+	for _, token := range []string{old.RefreshToken, kept.RefreshToken} {
+		if resp := JWTRefresh(ctx, token); resp.Err != ErrInvalidRefreshToken {
+			t.Errorf("refresh error = %v, want %v", resp.Err, ErrInvalidRefreshToken)
+		}
+	}
+	if resp := JWTRefresh(ctx, otherToken.RefreshToken); resp.Err != nil {
+		t.Errorf("refresh of other user failed: %v", resp.Err)
+	}
+}
@@ -0,0 +1,162 @@
+package jwtwrapper
+
+import (
+	"errors"
+	"github.com/leyle/fabric-user-manager/model"
+	"github.com/leyle/go-api-starter/util"
+)
+
+var ErrTokenRevoked = errors.New("token has been revoked")
+
+// logout
+// revoke current request's token, if refreshToken is not empty, its family is revoked too
+func JWTLogout(ctx *model.JWTContext, refreshToken string) *model.JWTResponse {
+	resp := model.InitJWTResponse()
+	claim := GetCurUser(ctx.C)
+	if claim == nil {
+		resp.Err = ErrContextNoClaim
+		ctx.Logger().Error().Err(ErrContextNoClaim).Msg("get user from request context failed")
+		return resp
+	}
+
+	err := RevokeToken(ctx, claim)
+	if err != nil {
+		resp.Err = err
+		return resp
+	}
+
+	if refreshToken != "" {
+		rt, err := model.GetRefreshToken(ctx, hashRefreshToken(refreshToken))
+		if err != nil {
+			resp.Err = err
+			return resp
+		}
+		// only the owner can revoke it
+		if rt != nil && rt.UserId == claim.UserId {
+			err = revokeRefreshTokenFamily(ctx, rt.FamilyId)
+			if err != nil {
+				resp.Err = err
+				return resp
+			}
+		}
+	}
+
+	ctx.Logger().Debug().Str("username", claim.UserName).Msg("logout success")
+	return resp
+}
+
+// revoke all sessions of the user, only admin can do it
+func JWTRevokeUserSessions(ctx *model.JWTContext, userId string) *model.JWTResponse {
+	resp := model.InitJWTResponse()
+	if _, err := requireAdmin(ctx); err != nil {
+		resp.Err = err
+		return resp
+	}
+
+	user, err := model.GetUserAccountById(ctx, userId)
+	if err != nil {
+		resp.Err = err
+		return resp
+	}
+	if user == nil {
+		resp.Err = ErrUserNotExist
+		return resp
+	}
+
+	err = RevokeUserTokens(ctx, userId)
+	if err != nil {
+		resp.Err = err
+		return resp
+	}
+
+	resp.UserAccount = user
+	return resp
+}
+
+// RevokeToken revokes a single access token by its jti
+func RevokeToken(ctx *model.JWTContext, claim *model.JWTClaim) error {
+	if claim.Id == "" {
+		// token created by old version doesn't have jti
+		// we can only revoke all tokens of the user
+		return RevokeUserTokens(ctx, claim.UserId)
+	}
+
+	rt := &model.RevokedToken{
+		Id:        claim.Id,
+		UserId:    claim.UserId,
+		ExpiresAt: claim.ExpiresAt,
+		Created:   util.GetCurTime(),
+	}
+	err := model.SaveRevokedToken(ctx, rt)
+	if err != nil {
+		return err
+	}
+	ctx.Revocation.SetToken(claim.Id, true, claim.ExpiresAt)
+
+	return nil
+}
+
+// RevokeUserTokens revokes all access tokens issued until now and all refresh tokens of the user
+func RevokeUserTokens(ctx *model.JWTContext, userId string) error {
+	return revokeUserTokensExcept(ctx, userId, "")
+}
+
+// revokeUserTokensExcept is RevokeUserTokens, but access token with keepTokenId is kept,
+// it's the token issued to the caller right after the revocation
+func revokeUserTokensExcept(ctx *model.JWTContext, userId, keepTokenId string) error {
+	cutoff := util.CurUnixTime()
+	err := model.SaveTokenCutoff(ctx, userId, cutoff, keepTokenId)
+	if err != nil {
+		return err
+	}
+	ctx.Revocation.SetUserCutoff(userId, cutoff, keepTokenId)
+
+	rts, err := model.GetActiveRefreshTokensByUser(ctx, userId)
+	if err != nil {
+		return err
+	}
+	err = revokeRefreshTokens(ctx, rts)
+	if err != nil {
+		return err
+	}
+
+	ctx.Logger().Info().Str("userId", userId).Int64("cutoff", cutoff).Msg("revoke user tokens success")
+	return nil
+}
+
+func isTokenRevoked(ctx *model.JWTContext, claim *model.JWTClaim) (bool, error) {
+	// tokens issued until user's cutoff are revoked, iat is in seconds,
+	// so tokens of the same second are revoked too, except the one kept by jti
+	cutoff, keepTokenId, ok := ctx.Revocation.UserCutoff(claim.UserId)
+	if !ok {
+		tc, err := model.GetTokenCutoff(ctx, claim.UserId)
+		if err != nil {
+			return false, err
+		}
+		if tc != nil {
+			cutoff = tc.Cutoff
+			keepTokenId = tc.KeepTokenId
+		}
+		ctx.Revocation.SetUserCutoff(claim.UserId, cutoff, keepTokenId)
+	}
+	if claim.IssuedAt <= cutoff && (claim.Id == "" || claim.Id != keepTokenId) {
+		return true, nil
+	}
+
+	if claim.Id == "" {
+		return false, nil
+	}
+
+	revoked, ok := ctx.Revocation.TokenRevoked(claim.Id)
+	if ok {
+		return revoked, nil
+	}
+	rt, err := model.GetRevokedToken(ctx, claim.Id)
+	if err != nil {
+		return false, err
+	}
+	revoked = rt != nil
+	ctx.Revocation.SetToken(claim.Id, revoked, claim.ExpiresAt)
+
+	return revoked, nil
+}
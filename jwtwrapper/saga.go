@@ -0,0 +1,377 @@
+package jwtwrapper
+
+import (
+	"fmt"
+	"github.com/leyle/fabric-user-manager/model"
+	"github.com/leyle/go-api-starter/util"
+	"time"
+)
+
+const (
+	// a pending saga not updated for this long is treated as crashed
+	sagaStaleMinutes         = 10
+	sagaRecoveryCheckMinutes = 10
+)
+
+// sagaStep is one step of registration, compensate undoes action
+// compensate is nil if there is nothing to undo
+// applied is set for actions which can't be run twice, it tells if an interrupted action has taken effect
+// prepare runs before such action is marked running, changes it makes to saga are saved with the mark
+type sagaStep struct {
+	name       string
+	prepare    func(ctx *model.JWTContext, saga *model.RegisterSaga) error
+	action     func(ctx *model.JWTContext, saga *model.RegisterSaga) error
+	compensate func(ctx *model.JWTContext, saga *model.RegisterSaga) error
+	applied    func(ctx *model.JWTContext, saga *model.RegisterSaga) (bool, error)
+}
+
+// registration steps, compensations run in reverse order
+var registerSagaSteps = []*sagaStep{
+	{
+		name:       model.RegisterStepReserve,
+		action:     reserveUserAccount,
+		compensate: releaseUserAccount,
+	},
+	{
+		name:    model.RegisterStepCARegister,
+		prepare: checkCAIdentityAbsent,
+		action:  registerCAIdentity,
+		compensate: func(ctx *model.JWTContext, saga *model.RegisterSaga) error {
+			return CARemoveIdentity(ctx, saga.Username)
+		},
+		// ca rejects a registered enrollId, so a crash after register must not register again
+		// identity is ours only if it was absent before register was sent
+		applied: func(ctx *model.JWTContext, saga *model.RegisterSaga) (bool, error) {
+			if !saga.CAAbsent {
+				return false, nil
+			}
+			resp := getMSPClient(ctx)
+			if resp.Err != nil {
+				return false, resp.Err
+			}
+			caId, err := getCAIdentity(ctx, resp.MspClient, saga.Username)
+			if err != nil {
+				return false, err
+			}
+			return caId != nil, nil
+		},
+	},
+	{
+		// certificates are revoked when ca identity is removed, so it needs no compensation
+		name: model.RegisterStepCAEnroll,
+		action: func(ctx *model.JWTContext, saga *model.RegisterSaga) error {
+			return caEnrollIdentity(ctx, saga.Username, saga.UserId).Err
+		},
+	},
+	{
+		name: model.RegisterStepWalletPut,
+		action: func(ctx *model.JWTContext, saga *model.RegisterSaga) error {
+			resp := getMSPClient(ctx)
+			if resp.Err != nil {
+				return resp.Err
+			}
+			notAfter, err := putWalletIdentity(ctx, resp.MspClient, saga.Username)
+			if err != nil {
+				return err
+			}
+			// it's saved on account by activate step
+			saga.User.CertNotAfter = notAfter
+			return nil
+		},
+		compensate: func(ctx *model.JWTContext, saga *model.RegisterSaga) error {
+			return RemoveWalletIdentity(ctx, saga.Username)
+		},
+	},
+	{
+		name:   model.RegisterStepActivate,
+		action: activateUserAccount,
+	},
+}
+
+// newRegisterSaga persists a pending saga, ua is saved by the reserve step
+func newRegisterSaga(ctx *model.JWTContext, ua *model.UserAccount) (*model.RegisterSaga, error) {
+	saga := &model.RegisterSaga{
+		Id:       ua.Id,
+		UserId:   ua.Id,
+		Username: ua.Username,
+		Status:   model.SagaStatusPending,
+		Steps:    []string{},
+		User:     ua,
+		Created:  util.GetCurTime(),
+	}
+	saga.Updated = saga.Created
+
+	err := model.SaveRegisterSaga(ctx, saga)
+	if err != nil {
+		return nil, err
+	}
+	return saga, nil
+}
+
+// runRegisterSaga runs steps which haven't been done
+// if a step fails, done steps are compensated and the step's error is returned
+func runRegisterSaga(ctx *model.JWTContext, saga *model.RegisterSaga) error {
+	for _, step := range registerSagaSteps {
+		if saga.IsDone(step.name) {
+			continue
+		}
+
+		err := runSagaStep(ctx, saga, step)
+		if err != nil {
+			ctx.Logger().Error().Err(err).Str("username", saga.Username).Str("step", step.name).Msg("register saga step failed")
+			rollbackRegisterSaga(ctx, saga, err)
+			return err
+		}
+
+		saga.Steps = append(saga.Steps, step.name)
+		saga.Running = ""
+		err = model.UpdateRegisterSaga(ctx, saga)
+		if err != nil {
+			rollbackRegisterSaga(ctx, saga, err)
+			return err
+		}
+	}
+
+	// password hash isn't saved anymore, activated user is still returned to caller
+	user := saga.User
+	saga.Status = model.SagaStatusDone
+	saga.User = nil
+	err := model.UpdateRegisterSaga(ctx, saga)
+	if err != nil {
+		// user has been activated, it's only logged
+		ctx.Logger().Warn().Err(err).Str("username", saga.Username).Msg("mark register saga done failed")
+	}
+	saga.User = user
+	return nil
+}
+
+// runSagaStep runs step's action
+// step with applied is prepared and marked running first,
+// if it has been marked, action is skipped when it has taken effect
+func runSagaStep(ctx *model.JWTContext, saga *model.RegisterSaga, step *sagaStep) error {
+	if step.applied == nil {
+		return step.action(ctx, saga)
+	}
+
+	if saga.Running == step.name {
+		ok, err := step.applied(ctx, saga)
+		if err != nil {
+			return err
+		}
+		if ok {
+			ctx.Logger().Info().Str("username", saga.Username).Str("step", step.name).Msg("register saga step has been done before crash")
+			return nil
+		}
+	}
+
+	if step.prepare != nil {
+		err := step.prepare(ctx, saga)
+		if err != nil {
+			return err
+		}
+	}
+	saga.Running = step.name
+	err := model.UpdateRegisterSaga(ctx, saga)
+	if err != nil {
+		return err
+	}
+
+	return step.action(ctx, saga)
+}
+
+func runningSagaStep(saga *model.RegisterSaga) *sagaStep {
+	if saga.Running == "" || saga.IsDone(saga.Running) {
+		return nil
+	}
+	for _, step := range registerSagaSteps {
+		if step.name == saga.Running && step.applied != nil {
+			return step
+		}
+	}
+	return nil
+}
+
+// rollbackRegisterSaga compensates done steps in reverse order
+// if a compensation fails, saga is marked failed and left for manual repair
+func rollbackRegisterSaga(ctx *model.JWTContext, saga *model.RegisterSaga, cause error) {
+	saga.Err = cause.Error()
+	// failed action may still have taken effect, e.g. ca registered it but the response is lost
+	if step := runningSagaStep(saga); step != nil {
+		ok, err := step.applied(ctx, saga)
+		if err != nil {
+			// it's unknown if the action has taken effect, it's left for manual repair
+			ctx.Logger().Error().Err(err).Str("username", saga.Username).Str("step", step.name).Msg("register saga, check running step failed")
+			saga.Status = model.SagaStatusFailed
+			saga.Err = fmt.Sprintf("%s; check %s failed: %s", cause.Error(), step.name, err.Error())
+			saga.User = nil
+			_ = model.UpdateRegisterSaga(ctx, saga)
+			return
+		}
+		if ok {
+			saga.Steps = append(saga.Steps, step.name)
+		}
+		saga.Running = ""
+	}
+	for i := len(registerSagaSteps) - 1; i >= 0; i-- {
+		step := registerSagaSteps[i]
+		if !saga.IsDone(step.name) {
+			continue
+		}
+
+		if step.compensate != nil {
+			err := step.compensate(ctx, saga)
+			if err != nil {
+				ctx.Logger().Error().Err(err).Str("username", saga.Username).Str("step", step.name).Msg("register saga compensation failed")
+				saga.Status = model.SagaStatusFailed
+				saga.Err = fmt.Sprintf("%s; compensate %s failed: %s", cause.Error(), step.name, err.Error())
+				// it's repaired by hand, password hash isn't needed
+				saga.User = nil
+				_ = model.UpdateRegisterSaga(ctx, saga)
+				return
+			}
+		}
+		saga.Steps = saga.Steps[:len(saga.Steps)-1]
+	}
+
+	saga.Status = model.SagaStatusRolledBack
+	saga.User = nil
+	err := model.UpdateRegisterSaga(ctx, saga)
+	if err != nil {
+		ctx.Logger().Error().Err(err).Str("username", saga.Username).Msg("mark register saga rolled back failed")
+		return
+	}
+	ctx.Logger().Info().Str("username", saga.Username).Msg("register saga rolled back")
+}
+
+// checkCAIdentityAbsent fails with ErrUserIdExist if wallet or ca has the enrollId,
+// e.g. a peer, the registrar or an identity registered out of this service
+func checkCAIdentityAbsent(ctx *model.JWTContext, saga *model.RegisterSaga) error {
+	exist, err := caUserExists(ctx, saga.Username)
+	if err != nil {
+		return err
+	}
+	if exist {
+		return ErrUserIdExist
+	}
+
+	resp := getMSPClient(ctx)
+	if resp.Err != nil {
+		return resp.Err
+	}
+	caId, err := getCAIdentity(ctx, resp.MspClient, saga.Username)
+	if err != nil {
+		return err
+	}
+	if caId != nil {
+		ctx.Logger().Error().Str("username", saga.Username).Msg("register saga, ca identity has exists")
+		return ErrUserIdExist
+	}
+
+	saga.CAAbsent = true
+	return nil
+}
+
+// registerCAIdentity uses username as enrollId, user id as secret
+func registerCAIdentity(ctx *model.JWTContext, saga *model.RegisterSaga) error {
+	resp := getMSPClient(ctx)
+	if resp.Err != nil {
+		return resp.Err
+	}
+
+	err := caRegisterIdentity(ctx, resp.MspClient, saga.Username, saga.UserId, saga.User.Role, saga.User.Affiliation, saga.User.CAAttrs)
+	if err != nil && isCAUserRegistered(err) {
+		// someone else registered it after absent check, it isn't ours to remove
+		saga.CAAbsent = false
+		return ErrUserIdExist
+	}
+	return err
+}
+
+// reserveUserAccount saves the account as pending, so username is taken but user can't login
+func reserveUserAccount(ctx *model.JWTContext, saga *model.RegisterSaga) error {
+	// it may have been saved before a crash
+	dbUser, err := model.GetUserAccountById(ctx, saga.UserId)
+	if err != nil {
+		return err
+	}
+	if dbUser != nil {
+		return nil
+	}
+
+	ua := *saga.User
+	ua.Valid = false
+	ua.RegisterPending = true
+	return model.SaveUserAccount(ctx, &ua)
+}
+
+func releaseUserAccount(ctx *model.JWTContext, saga *model.RegisterSaga) error {
+	ua, err := model.GetUserAccountById(ctx, saga.UserId)
+	if err != nil {
+		return err
+	}
+	if ua == nil {
+		return nil
+	}
+	return model.DeleteUserAccount(ctx, ua)
+}
+
+func activateUserAccount(ctx *model.JWTContext, saga *model.RegisterSaga) error {
+	ua, err := model.GetUserAccountById(ctx, saga.UserId)
+	if err != nil {
+		return err
+	}
+	if ua == nil {
+		return ErrUserNotExist
+	}
+
+	ua.Valid = true
+	ua.RegisterPending = false
+	ua.CertNotAfter = saga.User.CertNotAfter
+	err = model.UpdateUserAccount(ctx, ua)
+	if err != nil {
+		return err
+	}
+	saga.User = ua
+	return nil
+}
+
+// RecoverRegisterSagas resumes registrations left pending by crashed requests
+// a saga that can't be finished is rolled back
+func RecoverRegisterSagas(ctx *model.JWTContext) error {
+	before := time.Now().Add(-sagaStaleMinutes * time.Minute).Unix()
+	sagas, err := model.GetPendingRegisterSagas(ctx, before)
+	if err != nil {
+		return err
+	}
+
+	for _, saga := range sagas {
+		ctx.Logger().Info().Str("username", saga.Username).Strs("steps", saga.Steps).Msg("resume register saga")
+		if saga.User == nil {
+			rollbackRegisterSaga(ctx, saga, ErrUserNotExist)
+			continue
+		}
+		err = runRegisterSaga(ctx, saga)
+		if err != nil {
+			ctx.Logger().Error().Err(err).Str("username", saga.Username).Msg("resume register saga failed")
+		}
+	}
+	return nil
+}
+
+// StartSagaRecovery checks pending registrations periodically until stop is closed
+func StartSagaRecovery(ctx *model.JWTContext, stop <-chan struct{}) {
+	go func() {
+		ticker := time.NewTicker(sagaRecoveryCheckMinutes * time.Minute)
+		defer ticker.Stop()
+		for {
+			if err := RecoverRegisterSagas(ctx); err != nil {
+				ctx.Logger().Error().Err(err).Msg("recover register sagas failed")
+			}
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
@@ -0,0 +1,307 @@
+package jwtwrapper
+
+import (
+	"errors"
+	"github.com/leyle/fabric-user-manager/model"
+	"github.com/leyle/go-api-starter/util"
+	"strings"
+	"testing"
+)
+
+func setupSagaCtx(t *testing.T) (*model.JWTContext, *fakeCA) {
+	t.Helper()
+	ctx := setupCtx(t)
+	ca := newFakeCA()
+	ctx.MSP = ca
+
+	// registrar is enrolled by bootstrap, so it's in ca and wallet
+	ca.add(ctx.Opt.Registrar.EnrollId, "client", ctx.Opt.Registrar.Secret)
+	if resp := CAEnroll(ctx, ctx.Opt.Registrar.EnrollId, ctx.Opt.Registrar.Secret); resp.Err != nil {
+		t.Fatal(resp.Err)
+	}
+	return ctx, ca
+}
+
+// newTestSaga is registerUser without running the saga
+func newTestSaga(t *testing.T, ctx *model.JWTContext, username string) *model.RegisterSaga {
+	t.Helper()
+	ua := &model.UserAccount{
+		Id:       util.GenerateDataId(),
+		Username: username,
+		Role:     model.UserRoleUser,
+		Valid:    true,
+		Created:  util.GetCurTime(),
+	}
+	ua.Updated = ua.Created
+	if err := ua.SetPasswd(ctx.Opt.PasswdHashOpt, testPasswd); err != nil {
+		t.Fatal(err)
+	}
+	saga, err := newRegisterSaga(ctx, ua)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return saga
+}
+
+func TestRegisterSaga(t *testing.T) {
+	errLost := errors.New("context deadline exceeded")
+
+	tests := []struct {
+		name     string
+		username string
+		setup    func(ctx *model.JWTContext, ca *fakeCA)
+		wantErr  error
+		// wantErrText is used when the error comes from ca
+		wantErrText string
+		wantStatus  string
+		// ca identity must be there after saga, it's removed only if saga created it
+		wantCAIdentity bool
+		wantRemoved    bool
+	}{
+		{
+			name:           "success",
+			username:       "alice",
+			wantStatus:     model.SagaStatusDone,
+			wantCAIdentity: true,
+		},
+		{
+			name:     "name of a peer",
+			username: "peer0",
+			setup: func(ctx *model.JWTContext, ca *fakeCA) {
+				ca.add("peer0", "peer", "peerpw")
+			},
+			wantErr:        ErrUserIdExist,
+			wantStatus:     model.SagaStatusRolledBack,
+			wantCAIdentity: true,
+		},
+		{
+			name:     "name of an orderer",
+			username: "orderer0",
+			setup: func(ctx *model.JWTContext, ca *fakeCA) {
+				ca.add("orderer0", "orderer", "ordererpw")
+			},
+			wantErr:        ErrUserIdExist,
+			wantStatus:     model.SagaStatusRolledBack,
+			wantCAIdentity: true,
+		},
+		{
+			name:     "name of an external identity",
+			username: "external",
+			setup: func(ctx *model.JWTContext, ca *fakeCA) {
+				ca.add("external", "client", "externalpw")
+			},
+			wantErr:        ErrUserIdExist,
+			wantStatus:     model.SagaStatusRolledBack,
+			wantCAIdentity: true,
+		},
+		{
+			name:           "name of the registrar",
+			username:       "orgadmin",
+			wantErr:        ErrUserIdExist,
+			wantStatus:     model.SagaStatusRolledBack,
+			wantCAIdentity: true,
+		},
+		{
+			name:     "concurrent registration wins",
+			username: "alice",
+			setup: func(ctx *model.JWTContext, ca *fakeCA) {
+				ca.beforeRegister = func(name string) {
+					ca.add(name, "client", "otherpw")
+				}
+			},
+			wantErr:        ErrUserIdExist,
+			wantStatus:     model.SagaStatusRolledBack,
+			wantCAIdentity: true,
+		},
+		{
+			name:     "register response lost",
+			username: "alice",
+			setup: func(ctx *model.JWTContext, ca *fakeCA) {
+				ca.registerErr = errLost
+			},
+			wantErr:     errLost,
+			wantStatus:  model.SagaStatusRolledBack,
+			wantRemoved: true,
+		},
+		{
+			name:     "enroll fails",
+			username: "alice",
+			setup: func(ctx *model.JWTContext, ca *fakeCA) {
+				ca.enrollErr = errLost
+			},
+			wantErr:     errLost,
+			wantStatus:  model.SagaStatusRolledBack,
+			wantRemoved: true,
+		},
+		{
+			name:     "ca database fails",
+			username: "alice",
+			setup: func(ctx *model.JWTContext, ca *fakeCA) {
+				ca.getErr = errors.New("Response from server: Error Code: 63 - Failed to get User: database is locked")
+			},
+			wantErrText: "database is locked",
+			wantStatus:  model.SagaStatusRolledBack,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, ca := setupSagaCtx(t)
+			if tt.setup != nil {
+				tt.setup(ctx, ca)
+			}
+
+			saga := newTestSaga(t, ctx, tt.username)
+			err := runRegisterSaga(ctx, saga)
+			switch {
+			case tt.wantErrText != "":
+				if err == nil || !strings.Contains(err.Error(), tt.wantErrText) {
+					t.Fatalf("saga error = %v, want %q", err, tt.wantErrText)
+				}
+			case err != tt.wantErr:
+				t.Fatalf("saga error = %v, want %v", err, tt.wantErr)
+			}
+
+			checkSaga(t, ctx, saga.Id, tt.wantStatus)
+			if ca.has(tt.username) != tt.wantCAIdentity {
+				t.Errorf("ca identity exists = %v, want %v", ca.has(tt.username), tt.wantCAIdentity)
+			}
+			if ca.wasRemoved(tt.username) != tt.wantRemoved {
+				t.Errorf("ca identity removed = %v, want %v", ca.wasRemoved(tt.username), tt.wantRemoved)
+			}
+			if tt.username == ctx.Opt.Registrar.EnrollId && !ctx.Wallet.Exists(tt.username) {
+				t.Error("registrar is removed from wallet")
+			}
+
+			ua, err := model.GetUserAccountById(ctx, saga.UserId)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantStatus == model.SagaStatusDone {
+				if ua == nil || !ua.Valid || ua.RegisterPending {
+					t.Fatal("user isn't activated")
+				}
+				if !ctx.Wallet.Exists(tt.username) {
+					t.Fatal("wallet has no identity")
+				}
+			} else if ua != nil {
+				t.Fatal("reserved user isn't released")
+			}
+		})
+	}
+}
+
+// a crashed request left a saga with caRegister running, recovery resumes it
+func TestRegisterSagaResume(t *testing.T) {
+	tests := []struct {
+		name string
+		// caAbsent is the saga's record, registered is if the identity is in ca now
+		caAbsent       bool
+		registered     bool
+		wantErr        error
+		wantStatus     string
+		wantCAIdentity bool
+		wantRemoved    bool
+	}{
+		{
+			name:           "register took effect",
+			caAbsent:       true,
+			registered:     true,
+			wantStatus:     model.SagaStatusDone,
+			wantCAIdentity: true,
+		},
+		{
+			name:           "register didn't reach ca",
+			caAbsent:       true,
+			wantStatus:     model.SagaStatusDone,
+			wantCAIdentity: true,
+		},
+		{
+			// absent wasn't recorded, the identity belongs to someone else
+			name:           "identity of others",
+			registered:     true,
+			wantErr:        ErrUserIdExist,
+			wantStatus:     model.SagaStatusRolledBack,
+			wantCAIdentity: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, ca := setupSagaCtx(t)
+			saga := newTestSaga(t, ctx, "alice")
+			if err := reserveUserAccount(ctx, saga); err != nil {
+				t.Fatal(err)
+			}
+			saga.Steps = append(saga.Steps, model.RegisterStepReserve)
+			saga.Running = model.RegisterStepCARegister
+			saga.CAAbsent = tt.caAbsent
+			if err := model.UpdateRegisterSaga(ctx, saga); err != nil {
+				t.Fatal(err)
+			}
+			if tt.registered {
+				ca.add("alice", "client", saga.UserId)
+			}
+
+			saved, err := model.GetRegisterSaga(ctx, saga.Id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = runRegisterSaga(ctx, saved)
+			if err != tt.wantErr {
+				t.Fatalf("resume error = %v, want %v", err, tt.wantErr)
+			}
+
+			checkSaga(t, ctx, saga.Id, tt.wantStatus)
+			if ca.has("alice") != tt.wantCAIdentity {
+				t.Errorf("ca identity exists = %v, want %v", ca.has("alice"), tt.wantCAIdentity)
+			}
+			if ca.wasRemoved("alice") != tt.wantRemoved {
+				t.Errorf("ca identity removed = %v, want %v", ca.wasRemoved("alice"), tt.wantRemoved)
+			}
+		})
+	}
+}
+
+// a crash during rollback leaves running step, it's compensated only if the saga created it
+func TestRollbackRegisterSagaRunningStep(t *testing.T) {
+	tests := []struct {
+		name        string
+		caAbsent    bool
+		wantRemoved bool
+	}{
+		{"created by saga", true, true},
+		{"not created by saga", false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, ca := setupSagaCtx(t)
+			saga := newTestSaga(t, ctx, "alice")
+			saga.Running = model.RegisterStepCARegister
+			saga.CAAbsent = tt.caAbsent
+			ca.add("alice", "client", saga.UserId)
+
+			rollbackRegisterSaga(ctx, saga, ErrUserNotExist)
+
+			checkSaga(t, ctx, saga.Id, model.SagaStatusRolledBack)
+			if ca.wasRemoved("alice") != tt.wantRemoved {
+				t.Errorf("ca identity removed = %v, want %v", ca.wasRemoved("alice"), tt.wantRemoved)
+			}
+		})
+	}
+}
+
+func checkSaga(t *testing.T, ctx *model.JWTContext, id, wantStatus string) {
+	t.Helper()
+	saga, err := model.GetRegisterSaga(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saga.Status != wantStatus {
+		t.Errorf("saga status = %s, want %s, err: %s", saga.Status, wantStatus, saga.Err)
+	}
+	if saga.Status != model.SagaStatusPending && saga.User != nil {
+		t.Error("finished saga keeps user")
+	}
+}
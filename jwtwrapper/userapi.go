@@ -0,0 +1,175 @@
+package jwtwrapper
+
+import (
+	"errors"
+	"github.com/leyle/fabric-user-manager/model"
+	"github.com/leyle/go-api-starter/util"
+)
+
+// list users, only admin can do it
+// secret fields are removed from returned users
+func JWTListUsers(ctx *model.JWTContext, query *model.UserQuery) (*model.UserList, error) {
+	if _, err := requireAdmin(ctx); err != nil {
+		return nil, err
+	}
+
+	list, err := model.ListUserAccounts(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, ua := range list.Users {
+		list.Users[i] = ua.Sanitize()
+	}
+	return list, nil
+}
+
+// revocation reason of disabled user's certificate, see golang.org/x/crypto/ocsp
+const disableRevokeReason = "cessationofoperation"
+
+var ErrDisableSelf = errors.New("current user can't disable itself")
+
+// disable user, only admin can do it
+// user can't login, its tokens and certificate are revoked, its wallet identity is quarantined
+// it's safe to call it again if ca revocation failed last time
+func JWTDisableUser(ctx *model.JWTContext, userId, reason string) *model.JWTResponse {
+	resp := model.InitJWTResponse()
+	claim, err := requireAdmin(ctx)
+	if err != nil {
+		resp.Err = err
+		return resp
+	}
+	if claim.UserId == userId {
+		resp.Err = ErrDisableSelf
+		return resp
+	}
+
+	user, err := model.GetUserAccountById(ctx, userId)
+	if err != nil {
+		resp.Err = err
+		return resp
+	}
+	if user == nil {
+		resp.Err = ErrUserNotExist
+		return resp
+	}
+
+	// 1. stop login first
+	if user.Valid {
+		user.Valid = false
+		user.DisabledAt = util.CurUnixTime()
+		user.DisabledReason = reason
+		err = model.UpdateUserAccount(ctx, user)
+		if err != nil {
+			resp.Err = err
+			return resp
+		}
+	}
+
+	// 2. revoke sessions and drop pooled gateway
+	err = RevokeUserTokens(ctx, user.Id)
+	if err != nil {
+		resp.Err = err
+		return resp
+	}
+	ctx.GatewayPool().Remove(user.Username)
+
+	// 3. revoke certificate and quarantine wallet identity
+	if !user.CertRevoked {
+		err = revokeUserCert(ctx, user)
+		if err != nil {
+			resp.Err = err
+			return resp
+		}
+	}
+
+	ctx.Logger().Info().Str("username", user.Username).Str("reason", reason).Msg("disable user success")
+	resp.UserAccount = user
+	return resp
+}
+
+func revokeUserCert(ctx *model.JWTContext, user *model.UserAccount) error {
+	exist, err := caUserExists(ctx, user.Username)
+	if err != nil {
+		return err
+	}
+	if !exist {
+		// wallet lost the certificate, ca still can revoke it by enrollment id
+		revoked, err := CARevokeIdentity(ctx, user.Username, disableRevokeReason)
+		if err != nil || !revoked {
+			return err
+		}
+	} else {
+		err := CARevokeCert(ctx, user.Username, disableRevokeReason)
+		if err != nil {
+			return err
+		}
+		err = QuarantineWalletIdentity(ctx, user.Username)
+		if err != nil {
+			return err
+		}
+	}
+
+	user.CertRevoked = true
+	return model.UpdateUserAccount(ctx, user)
+}
+
+// enable user, only admin can do it
+// revoked certificate can't be used again, user is enrolled again to get a new one
+func JWTEnableUser(ctx *model.JWTContext, userId string) *model.JWTResponse {
+	resp := model.InitJWTResponse()
+	if _, err := requireAdmin(ctx); err != nil {
+		resp.Err = err
+		return resp
+	}
+
+	user, err := model.GetUserAccountById(ctx, userId)
+	if err != nil {
+		resp.Err = err
+		return resp
+	}
+	if user == nil {
+		resp.Err = ErrUserNotExist
+		return resp
+	}
+	if user.DeletedAt > 0 {
+		resp.Err = ErrUserDeleted
+		return resp
+	}
+	if user.Valid {
+		resp.UserAccount = user
+		return resp
+	}
+
+	// registered user's ca secret is its id
+	exist, err := caUserExists(ctx, user.Username)
+	if err != nil {
+		resp.Err = err
+		return resp
+	}
+	if user.CertRevoked || !exist {
+		resp = CAEnroll(ctx, user.Username, user.Id)
+		if resp.Err != nil {
+			return resp
+		}
+		user.CertNotAfter = resp.CertNotAfter
+		err = RemoveQuarantinedIdentity(ctx, user.Username)
+		if err != nil {
+			ctx.Logger().Warn().Err(err).Str("username", user.Username).Msg("remove quarantined identity failed")
+		}
+	}
+
+	user.Valid = true
+	user.DisabledAt = 0
+	user.DisabledReason = ""
+	user.CertRevoked = false
+	err = model.UpdateUserAccount(ctx, user)
+	if err != nil {
+		resp.Err = err
+		return resp
+	}
+
+	ctx.Logger().Info().Str("username", user.Username).Msg("enable user success")
+	resp.UserAccount = user
+	return resp
+}
@@ -0,0 +1,196 @@
+package jwtwrapper
+
+import (
+	"errors"
+	"github.com/leyle/fabric-user-manager/model"
+	"github.com/leyle/go-api-starter/util"
+	"time"
+)
+
+const (
+	defaultPurgeCheckMinutes = 60
+	purgeScanLimit           = 200
+)
+
+var (
+	ErrDeleteSelf      = errors.New("current user can't delete itself")
+	ErrDeleteRegistrar = errors.New("ca registrar can't be deleted")
+	ErrUserDeleted     = errors.New("user has been deleted")
+)
+
+// delete user, only admin can do it
+// ca identity and wallet identity are removed at once,
+// account is soft deleted if retention is configured and hard is false, it's purged later
+func JWTDeleteUser(ctx *model.JWTContext, userId string, hard bool) *model.JWTResponse {
+	resp := model.InitJWTResponse()
+	claim, err := requireAdmin(ctx)
+	if err != nil {
+		resp.Err = err
+		return resp
+	}
+	if claim.UserId == userId {
+		resp.Err = ErrDeleteSelf
+		return resp
+	}
+
+	user, err := model.GetUserAccountById(ctx, userId)
+	if err != nil {
+		resp.Err = err
+		return resp
+	}
+	if user == nil {
+		resp.Err = ErrUserNotExist
+		return resp
+	}
+	if user.Username == ctx.Opt.Registrar.EnrollId {
+		resp.Err = ErrDeleteRegistrar
+		return resp
+	}
+
+	hard = hard || ctx.Opt.UserDeleteOpt.Retention() == 0
+	err = deleteUser(ctx, user, hard)
+	saveAudit(ctx, model.AuditActionUserDelete, claim, user, err, map[string]interface{}{
+		"hard": hard,
+	})
+	if err != nil {
+		resp.Err = err
+		return resp
+	}
+
+	ctx.Logger().Info().Str("username", user.Username).Bool("hard", hard).Msg("delete user success")
+	resp.UserAccount = user
+	return resp
+}
+
+// deleteUser is safe to be called again if it failed
+func deleteUser(ctx *model.JWTContext, user *model.UserAccount, hard bool) error {
+	// 1. stop login, secrets are dropped at once even if account is kept
+	if user.DeletedAt == 0 {
+		user.Valid = false
+		user.DeletedAt = util.CurUnixTime()
+		user.Salt = ""
+		user.PassHash = ""
+		user.PHCHash = ""
+		user.PasswdHistory = nil
+		user.ClearMFA()
+		err := model.UpdateUserAccount(ctx, user)
+		if err != nil {
+			return err
+		}
+	}
+
+	// 2. revoke sessions
+	err := RevokeUserTokens(ctx, user.Id)
+	if err != nil {
+		return err
+	}
+
+	// 3. remove ca identity and wallet identity
+	err = CARemoveIdentity(ctx, user.Username)
+	if err != nil {
+		return err
+	}
+	err = RemoveWalletIdentity(ctx, user.Username)
+	if err != nil {
+		return err
+	}
+	if !user.CertRevoked {
+		user.CertRevoked = true
+		if err = model.UpdateUserAccount(ctx, user); err != nil {
+			return err
+		}
+	}
+
+	// 4. drop account
+	if hard {
+		return model.DeleteUserAccount(ctx, user)
+	}
+	return nil
+}
+
+// PurgeDeletedUsers hard deletes soft deleted users whose retention has passed
+// user store has no index on deletedAt, so all users are scanned
+func PurgeDeletedUsers(ctx *model.JWTContext) error {
+	retention := ctx.Opt.UserDeleteOpt.Retention()
+	if retention == 0 {
+		return nil
+	}
+	deadline := time.Now().Add(-retention).Unix()
+
+	var expired []*model.UserAccount
+	query := &model.UserQuery{
+		Valid: new(bool),
+		Limit: purgeScanLimit,
+	}
+	for {
+		list, err := model.ListUserAccounts(ctx, query)
+		if err != nil {
+			return err
+		}
+		for _, ua := range list.Users {
+			if ua.DeletedAt > 0 && ua.DeletedAt <= deadline {
+				expired = append(expired, ua)
+			}
+		}
+		if list.Bookmark == "" {
+			break
+		}
+		query.Bookmark = list.Bookmark
+	}
+
+	for _, ua := range expired {
+		err := deleteUser(ctx, ua, true)
+		saveAudit(ctx, model.AuditActionUserPurge, nil, ua, err, nil)
+		if err != nil {
+			ctx.Logger().Error().Err(err).Str("username", ua.Username).Msg("purge deleted user failed")
+			continue
+		}
+		ctx.Logger().Info().Str("username", ua.Username).Msg("purge deleted user success")
+	}
+	return nil
+}
+
+// StartUserPurge purges deleted users periodically until stop is closed
+func StartUserPurge(ctx *model.JWTContext, stop <-chan struct{}) {
+	minutes := defaultPurgeCheckMinutes
+	if opt := ctx.Opt.UserDeleteOpt; opt != nil && opt.PurgeCheckMinutes > 0 {
+		minutes = opt.PurgeCheckMinutes
+	}
+
+	go func() {
+		ticker := time.NewTicker(time.Duration(minutes) * time.Minute)
+		defer ticker.Stop()
+		for {
+			if err := PurgeDeletedUsers(ctx); err != nil {
+				ctx.Logger().Error().Err(err).Msg("purge deleted users failed")
+			}
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// saveAudit records result of action, actor is nil for background jobs
+func saveAudit(ctx *model.JWTContext, action string, actor *model.JWTClaim, target *model.UserAccount, err error, detail map[string]interface{}) {
+	log := &model.AuditLog{
+		Action:     action,
+		ActorName:  "system",
+		TargetId:   target.Id,
+		TargetName: target.Username,
+		Success:    err == nil,
+		Detail:     detail,
+	}
+	if actor != nil {
+		log.ActorId = actor.UserId
+		log.ActorName = actor.UserName
+	}
+	if err != nil {
+		log.Err = err.Error()
+	}
+
+	// audit failure doesn't change result of action
+	_ = model.SaveAuditLog(ctx, log)
+}
@@ -0,0 +1,210 @@
+package jwtwrapper
+
+import (
+	"crypto/x509"
+	"errors"
+	"github.com/hyperledger/fabric-sdk-go/pkg/gateway"
+	"github.com/leyle/fabric-user-manager/model"
+)
+
+var (
+	ErrBundleUserMismatch = errors.New("identity bundle doesn't belong to the user")
+	ErrBundleCertOutdated = errors.New("identity bundle's certificate is older than the one in wallet")
+)
+
+// JWTExportIdentity exports user's wallet identity as a bundle encrypted by passwd, only admin can do it
+func JWTExportIdentity(ctx *model.JWTContext, userId, passwd string) (*model.IdentityBundle, error) {
+	claim, err := requireAdmin(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// bundle may leave the server, its password follows the same policy as login password
+	err = ctx.Opt.PasswdPolicyOpt.Check(passwd, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := getBundleUser(ctx, userId)
+	if err != nil {
+		return nil, err
+	}
+
+	bundle, err := exportIdentity(ctx, user.Username, passwd)
+	saveAudit(ctx, model.AuditActionIdentityExport, claim, user, err, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx.Logger().Info().Str("username", user.Username).Str("operator", claim.UserName).Msg("export wallet identity success")
+	return bundle, nil
+}
+
+func exportIdentity(ctx *model.JWTContext, enrollId, passwd string) (*model.IdentityBundle, error) {
+	wallet, err := NewWallet(ctx)
+	if err != nil {
+		return nil, err
+	}
+	exist, err := model.WalletExists(wallet, enrollId)
+	if err != nil {
+		return nil, err
+	}
+	if !exist {
+		return nil, ErrNoWalletCredential
+	}
+	id, err := wallet.Get(enrollId)
+	if err != nil {
+		ctx.Logger().Error().Err(err).Str("enrollId", enrollId).Msg("export wallet identity, get it failed")
+		return nil, err
+	}
+	x509Id, ok := id.(*gateway.X509Identity)
+	if !ok {
+		return nil, ErrNoWalletCredential
+	}
+
+	return model.SealIdentityBundle(enrollId, x509Id.MspID, x509Id.Certificate(), x509Id.Key(), passwd)
+}
+
+// JWTImportIdentity puts identity in bundle into user's wallet, only admin can do it
+// certificate must be issued by the org's ca to the user, and match the private key
+func JWTImportIdentity(ctx *model.JWTContext, userId, passwd string, bundle *model.IdentityBundle) *model.JWTResponse {
+	resp := model.InitJWTResponse()
+	claim, err := requireAdmin(ctx)
+	if err != nil {
+		resp.Err = err
+		return resp
+	}
+
+	user, err := getBundleUser(ctx, userId)
+	if err != nil {
+		resp.Err = err
+		return resp
+	}
+
+	err = importIdentity(ctx, user, passwd, bundle)
+	saveAudit(ctx, model.AuditActionIdentityImport, claim, user, err, nil)
+	if err != nil {
+		resp.Err = err
+		return resp
+	}
+
+	ctx.Logger().Info().Str("username", user.Username).Str("operator", claim.UserName).Int64("certNotAfter", user.CertNotAfter).Msg("import wallet identity success")
+	resp.UserAccount = user
+	return resp
+}
+
+func importIdentity(ctx *model.JWTContext, user *model.UserAccount, passwd string, bundle *model.IdentityBundle) error {
+	key, err := bundle.Open(passwd)
+	if err != nil {
+		return err
+	}
+
+	resp := getMSPClient(ctx)
+	if resp.Err != nil {
+		return resp.Err
+	}
+	caInfo, err := resp.MspClient.GetCAInfo()
+	if err != nil {
+		ctx.Logger().Error().Err(err).Msg("import wallet identity, get ca info failed")
+		return err
+	}
+
+	cert, err := model.VerifyIdentity(bundle.Certificate, key, caInfo.CAChain)
+	if err != nil {
+		ctx.Logger().Warn().Err(err).Str("username", user.Username).Msg("import wallet identity, verify it failed")
+		return err
+	}
+	// ca issues certificate with enrollId as common name
+	if cert.Subject.CommonName != user.Username {
+		return ErrBundleUserMismatch
+	}
+
+	mspId, err := orgMSPID(ctx)
+	if err != nil {
+		return err
+	}
+	if bundle.MspId != mspId {
+		return model.ErrIdentityMSPMismatch
+	}
+
+	wallet, err := NewWallet(ctx)
+	if err != nil {
+		return err
+	}
+	err = checkBundleCertNewer(ctx, wallet, user.Username, cert)
+	if err != nil {
+		return err
+	}
+	err = wallet.Put(user.Username, gateway.NewX509Identity(bundle.MspId, bundle.Certificate, key))
+	if err != nil {
+		ctx.Logger().Error().Err(err).Str("username", user.Username).Msg("import wallet identity, put it into wallet failed")
+		return err
+	}
+	// pooled gateway still uses old identity
+	ctx.GatewayPool().Remove(user.Username)
+
+	user.CertNotAfter = cert.NotAfter.Unix()
+	return model.UpdateUserAccount(ctx, user)
+}
+
+// checkBundleCertNewer rejects a certificate issued before the one in wallet
+// ca client can't list revocations, an older certificate may have been revoked when user was disabled,
+// or replaced by reenroll, so it's never restored over a newer one
+func checkBundleCertNewer(ctx *model.JWTContext, wallet model.Wallet, enrollId string, cert *x509.Certificate) error {
+	// quarantined identity holds the revoked certificate of a disabled user
+	for _, label := range []string{enrollId, quarantineLabel(enrollId)} {
+		exist, err := model.WalletExists(wallet, label)
+		if err != nil {
+			return err
+		}
+		if !exist {
+			continue
+		}
+
+		cur, err := getWalletCert(ctx, label)
+		if err != nil {
+			return err
+		}
+		if cert.NotBefore.Before(cur.NotBefore) {
+			ctx.Logger().Warn().Str("username", enrollId).Str("label", label).Str("serial", cert.SerialNumber.Text(16)).Msg("import wallet identity, certificate is outdated")
+			return ErrBundleCertOutdated
+		}
+	}
+	return nil
+}
+
+// orgMSPID returns msp id of registrar's wallet identity, all users are in the same org
+func orgMSPID(ctx *model.JWTContext) (string, error) {
+	wallet, err := NewWallet(ctx)
+	if err != nil {
+		return "", err
+	}
+	id, err := wallet.Get(ctx.Opt.Registrar.EnrollId)
+	if err != nil {
+		ctx.Logger().Error().Err(err).Str("registrar", ctx.Opt.Registrar.EnrollId).Msg("get registrar's wallet identity failed")
+		return "", err
+	}
+	x509Id, ok := id.(*gateway.X509Identity)
+	if !ok {
+		return "", ErrNoWalletCredential
+	}
+	return x509Id.MspID, nil
+}
+
+// disabled user's certificate has been revoked, deleted user's identity has been removed
+func getBundleUser(ctx *model.JWTContext, userId string) (*model.UserAccount, error) {
+	user, err := model.GetUserAccountById(ctx, userId)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		return nil, ErrUserNotExist
+	}
+	if user.DeletedAt > 0 {
+		return nil, ErrUserDeleted
+	}
+	if !user.Valid {
+		return nil, ErrUserIsInvalid
+	}
+	return user, nil
+}
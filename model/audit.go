@@ -0,0 +1,53 @@
+package model
+
+import (
+	"encoding/json"
+	"github.com/leyle/go-api-starter/util"
+)
+
+const DBNameAuditLog = "auditlog"
+
+// audit actions
+const (
+	AuditActionUserDelete = "user.delete"
+	AuditActionUserPurge  = "user.purge"
+
+	AuditActionUserReenroll = "user.reenroll"
+	AuditActionUserCAAttrs  = "user.caattrs"
+
+	AuditActionIdentityExport = "identity.export"
+	AuditActionIdentityImport = "identity.import"
+
+	AuditActionReconcileRepair = "reconcile.repair"
+)
+
+// AuditLog records who did what to whom, it's never updated
+type AuditLog struct {
+	Id         string                 `json:"id"`
+	Action     string                 `json:"action"`
+	ActorId    string                 `json:"actorId"`
+	ActorName  string                 `json:"actorName"`
+	TargetId   string                 `json:"targetId"`
+	TargetName string                 `json:"targetName"`
+	Success    bool                   `json:"success"`
+	Err        string                 `json:"err,omitempty"`
+	Detail     map[string]interface{} `json:"detail,omitempty"`
+	Created    *util.CurTime          `json:"created"`
+}
+
+func SaveAuditLog(ctx *JWTContext, log *AuditLog) error {
+	if log.Id == "" {
+		log.Id = util.GenerateDataId()
+	}
+	if log.Created == nil {
+		log.Created = util.GetCurTime()
+	}
+
+	data, _ := json.Marshal(log)
+	err := ctx.Ds(DBNameAuditLog).CreateDoc(ctx.Context(), log.Id, data)
+	if err != nil {
+		ctx.Logger().Error().Err(err).Str("action", log.Action).Str("targetId", log.TargetId).Msg("SaveAuditLog failed")
+		return err
+	}
+	return nil
+}
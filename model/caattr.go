@@ -0,0 +1,76 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var ErrEmptyCAAttrName = errors.New("ca attribute name can't be empty")
+
+// attributes with this prefix are fabric ca's own, e.g. hf.Registrar.Roles
+// they give ca permissions, so they can't be set by api
+const reservedCAAttrPrefix = "hf."
+
+// CAAttribute is added into ca identity, chaincode checks it by cid library
+// if ECert is true, it's put into enrollment certificate by default
+type CAAttribute struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+	ECert bool   `json:"ecert"`
+}
+
+type CAAttrOption struct {
+	// used when user is created without affiliation, empty means registrar's affiliation
+	DefaultAffiliation string
+
+	// attributes added to every user of the role, attributes in request override them
+	RoleAttrs map[UserRole][]*CAAttribute
+}
+
+// ValidateCAAttrs checks attributes from api, names must be unique and not reserved
+func ValidateCAAttrs(attrs []*CAAttribute) error {
+	names := make(map[string]bool, len(attrs))
+	for _, attr := range attrs {
+		if attr == nil || strings.TrimSpace(attr.Name) == "" {
+			return ErrEmptyCAAttrName
+		}
+		if strings.HasPrefix(attr.Name, reservedCAAttrPrefix) {
+			return fmt.Errorf("ca attribute[%s] is reserved", attr.Name)
+		}
+		if names[attr.Name] {
+			return fmt.Errorf("ca attribute[%s] is duplicated", attr.Name)
+		}
+		names[attr.Name] = true
+	}
+	return nil
+}
+
+// Affiliation returns affiliation if it's not empty, or the default one
+func (o *CAAttrOption) Affiliation(affiliation string) string {
+	if affiliation != "" || o == nil {
+		return affiliation
+	}
+	return o.DefaultAffiliation
+}
+
+// Merge returns role's default attributes overridden by attrs
+func (o *CAAttrOption) Merge(role UserRole, attrs []*CAAttribute) []*CAAttribute {
+	var defaults []*CAAttribute
+	if o != nil {
+		defaults = o.RoleAttrs[role]
+	}
+
+	result := make([]*CAAttribute, 0, len(defaults)+len(attrs))
+	override := make(map[string]bool, len(attrs))
+	for _, attr := range attrs {
+		override[attr.Name] = true
+	}
+	for _, attr := range defaults {
+		if !override[attr.Name] {
+			cp := *attr
+			result = append(result, &cp)
+		}
+	}
+	return append(result, attrs...)
+}
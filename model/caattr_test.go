@@ -0,0 +1,46 @@
+package model
+
+import "testing"
+
+func TestValidateCAAttrs(t *testing.T) {
+	ok := []*CAAttribute{{Name: "dept", Value: "sales", ECert: true}, {Name: "level", Value: "2"}}
+	if err := ValidateCAAttrs(ok); err != nil {
+		t.Fatal(err)
+	}
+
+	bad := [][]*CAAttribute{
+		{{Name: " "}},
+		{{Name: "hf.Registrar.Roles", Value: "client"}},
+		{{Name: "dept"}, {Name: "dept"}},
+	}
+	for _, attrs := range bad {
+		if err := ValidateCAAttrs(attrs); err == nil {
+			t.Errorf("expect error for %+v", attrs[0])
+		}
+	}
+}
+
+func TestCAAttrOptionMerge(t *testing.T) {
+	opt := &CAAttrOption{
+		DefaultAffiliation: "org1",
+		RoleAttrs: map[UserRole][]*CAAttribute{
+			UserRoleUser: {{Name: "app", Value: "fum", ECert: true}, {Name: "level", Value: "1", ECert: true}},
+		},
+	}
+
+	attrs := opt.Merge(UserRoleUser, []*CAAttribute{{Name: "level", Value: "3"}})
+	if len(attrs) != 2 || attrs[0].Name != "app" || attrs[1].Value != "3" || attrs[1].ECert {
+		t.Fatalf("unexpected merged attrs %+v %+v", attrs[0], attrs[1])
+	}
+	if attrs := opt.Merge(UserRoleAdmin, nil); len(attrs) != 0 {
+		t.Fatalf("expect no attrs for admin, got %d", len(attrs))
+	}
+
+	if opt.Affiliation("") != "org1" || opt.Affiliation("org2.dept") != "org2.dept" {
+		t.Fatal("unexpected affiliation")
+	}
+	var nilOpt *CAAttrOption
+	if nilOpt.Affiliation("") != "" || len(nilOpt.Merge(UserRoleUser, nil)) != 0 {
+		t.Fatal("nil option should add nothing")
+	}
+}
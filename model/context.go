@@ -1,8 +1,8 @@
 package model
 
 import (
+	"context"
 	"github.com/gin-gonic/gin"
-	"github.com/hyperledger/fabric-sdk-go/pkg/gateway"
 	"github.com/leyle/go-api-starter/couchdb"
 	"github.com/leyle/go-api-starter/logmiddleware"
 	"github.com/rs/zerolog"
@@ -12,8 +12,15 @@ type JWTContext struct {
 	C   *gin.Context
 	Opt *Option
 
-	// temp value
-	Wallet *gateway.Wallet
+	// shared by all requests
+	Wallet       Wallet
+	Revocation   *RevocationCache
+	LoginLimiter *LoginLimiter
+	Fabric       *FabricClient
+	Gateways     *GatewayPool
+
+	// ca client used instead of Fabric's, it's only set by tests
+	MSP MSPClient
 }
 
 func (jwtc *JWTContext) New(c *gin.Context) *JWTContext {
@@ -21,6 +28,12 @@ func (jwtc *JWTContext) New(c *gin.Context) *JWTContext {
 		C:      c,
 		Opt:    jwtc.Opt,
 		Wallet: jwtc.Wallet,
+
+		Revocation:   jwtc.Revocation,
+		LoginLimiter: jwtc.LoginLimiter,
+		Fabric:       jwtc.Fabric,
+		Gateways:     jwtc.Gateways,
+		MSP:          jwtc.MSP,
 	}
 	return n
 }
@@ -34,6 +47,53 @@ func (jwtc *JWTContext) Logger() *zerolog.Logger {
 	return logger
 }
 
+// Context returns request's context
+// background jobs don't have a request, a context with console logger is returned
+func (jwtc *JWTContext) Context() context.Context {
+	if jwtc.C == nil {
+		return jwtc.Logger().WithContext(context.Background())
+	}
+	return jwtc.C.Request.Context()
+}
+
+// Users returns the configured user store
+func (jwtc *JWTContext) Users() UserStore {
+	if jwtc.Opt.UserStore == nil {
+		jwtc.Opt.UserStore = NewCouchDBUserStore(jwtc.Opt.CouchDBOpt)
+	}
+	return jwtc.Opt.UserStore
+}
+
+// FabricClient returns the shared fabric client
+// it's created by Init, a context not passed to Init gets its own client
+func (jwtc *JWTContext) FabricClient() *FabricClient {
+	if jwtc.Fabric == nil {
+		jwtc.Fabric = NewFabricClient(jwtc.Opt.FabricGWOption)
+	}
+	return jwtc.Fabric
+}
+
+// MSPClient returns the ca client, it's MSP if it's set
+func (jwtc *JWTContext) MSPClient() (MSPClient, error) {
+	if jwtc.MSP != nil {
+		return jwtc.MSP, nil
+	}
+	client, err := jwtc.FabricClient().MSPClient()
+	if err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+// GatewayPool returns the shared gateway pool
+// it's created by Init, a context not passed to Init gets its own pool
+func (jwtc *JWTContext) GatewayPool() *GatewayPool {
+	if jwtc.Gateways == nil {
+		jwtc.Gateways = NewGatewayPool(jwtc.Opt.GatewayPoolOpt)
+	}
+	return jwtc.Gateways
+}
+
 func (jwtc *JWTContext) Ds(dbName string) *couchdb.CouchDBClient {
 	return couchdb.New(jwtc.Opt.CouchDBOpt, dbName)
 }
@@ -0,0 +1,92 @@
+package model
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/leyle/go-api-starter/couchdb"
+	"github.com/leyle/go-api-starter/httpclient"
+	"github.com/rs/zerolog"
+	"net/http"
+)
+
+var ErrDocConflict = errors.New("document update conflict")
+
+// updateDoc writes doc back with its current _rev
+// it returns the new rev, or ErrDocConflict if someone else has updated the doc
+func updateDoc(ctx *JWTContext, dbName, id string, doc interface{}) (string, error) {
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return "", err
+	}
+
+	body, err := ctx.Ds(dbName).UpdateById(ctx.Context(), id, data)
+	if err != nil {
+		if isCouchDBConflict(err) {
+			return "", ErrDocConflict
+		}
+		return "", err
+	}
+
+	return parseCouchDBRev(body), nil
+}
+
+// couchdb.SearchRequest doesn't support bookmark, so we send _find ourselves
+type couchDBFindRequest struct {
+	Selector interface{} `json:"selector"`
+	Sort     interface{} `json:"sort,omitempty"`
+	Limit    int         `json:"limit"`
+	Bookmark string      `json:"bookmark,omitempty"`
+}
+
+// couchDBFind returns the bookmark of next page, docs are unmarshalled into v
+func couchDBFind(ctx context.Context, opt *couchdb.CouchDBOption, dbName string, req *couchDBFindRequest, v interface{}) (string, error) {
+	protocol := opt.Protocol
+	if protocol == "" {
+		protocol = "http"
+	}
+	url := fmt.Sprintf("%s://%s/%s/_find", protocol, opt.HostPort, dbName)
+
+	auth := base64.StdEncoding.EncodeToString([]byte(opt.User + ":" + opt.Passwd))
+	headers := map[string]string{
+		"Authorization": "Basic " + auth,
+		"Content-Type":  "application/json",
+	}
+
+	data, err := json.Marshal(req)
+	if err != nil {
+		return "", err
+	}
+
+	creq := &httpclient.ClientRequest{
+		Ctx:     ctx,
+		Url:     url,
+		Headers: headers,
+		Body:    data,
+		Timeout: 30,
+		Debug:   true,
+	}
+	resp := httpclient.Post(creq)
+	if resp.Err != nil {
+		return "", resp.Err
+	}
+	if resp.Code != http.StatusOK {
+		err = fmt.Errorf("statusCode[%d], body[%s]", resp.Code, string(resp.Body))
+		zerolog.Ctx(ctx).Error().Err(err).Str("action", "Find").Str("database", dbName).Send()
+		return "", err
+	}
+
+	var ret struct {
+		Bookmark string `json:"bookmark"`
+	}
+	if err = json.Unmarshal(resp.Body, &ret); err != nil {
+		return "", err
+	}
+	if err = json.Unmarshal(resp.Body, v); err != nil {
+		return "", err
+	}
+
+	return ret.Bookmark, nil
+}
@@ -0,0 +1,144 @@
+package model
+
+import (
+	"errors"
+	"github.com/hyperledger/fabric-sdk-go/pkg/client/msp"
+	mspctx "github.com/hyperledger/fabric-sdk-go/pkg/common/providers/msp"
+	"github.com/hyperledger/fabric-sdk-go/pkg/core/config"
+	"github.com/hyperledger/fabric-sdk-go/pkg/fabsdk"
+	"sync"
+	"time"
+)
+
+var ErrFabricClientClosed = errors.New("fabric client has been closed")
+
+// calls started before reload may still use old sdk, it's closed after this delay
+const fabricReloadCloseDelay = time.Minute
+
+// MSPClient is the part of *msp.Client used to manage ca identities
+// tests replace it by a fake ca, see JWTContext.MSP
+type MSPClient interface {
+	Register(request *msp.RegistrationRequest) (string, error)
+	Enroll(enrollmentID string, opts ...msp.EnrollmentOption) error
+	Reenroll(enrollmentID string, opts ...msp.EnrollmentOption) error
+	GetIdentity(ID string, opts ...msp.RequestOption) (*msp.IdentityResponse, error)
+	GetAllIdentities(opts ...msp.RequestOption) ([]*msp.IdentityResponse, error)
+	ModifyIdentity(request *msp.IdentityRequest) (*msp.IdentityResponse, error)
+	RemoveIdentity(request *msp.RemoveIdentityRequest) (*msp.IdentityResponse, error)
+	Revoke(request *msp.RevocationRequest) (*msp.RevocationResponse, error)
+	GetCAInfo() (*msp.GetCAInfoResponse, error)
+	GetSigningIdentity(id string) (mspctx.SigningIdentity, error)
+}
+
+// FabricClient holds one fabric sdk and msp client shared by all requests
+// sdk is created on first use, Reload replaces it after config file changed
+// all methods are safe for concurrent use
+type FabricClient struct {
+	opt *FabricGWOption
+
+	mu     sync.RWMutex
+	sdk    *fabsdk.FabricSDK
+	msp    *msp.Client
+	closed bool
+}
+
+func NewFabricClient(opt *FabricGWOption) *FabricClient {
+	return &FabricClient{
+		opt: opt,
+	}
+}
+
+// MSPClient returns the shared msp client, sdk is created if it doesn't exist
+func (fc *FabricClient) MSPClient() (*msp.Client, error) {
+	_, client, err := fc.get()
+	return client, err
+}
+
+// SDK returns the shared sdk, it's used to create channel clients
+func (fc *FabricClient) SDK() (*fabsdk.FabricSDK, error) {
+	sdk, _, err := fc.get()
+	return sdk, err
+}
+
+func (fc *FabricClient) get() (*fabsdk.FabricSDK, *msp.Client, error) {
+	fc.mu.RLock()
+	sdk, client, closed := fc.sdk, fc.msp, fc.closed
+	fc.mu.RUnlock()
+	if closed {
+		return nil, nil, ErrFabricClientClosed
+	}
+	if sdk != nil {
+		return sdk, client, nil
+	}
+
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	if fc.closed {
+		return nil, nil, ErrFabricClientClosed
+	}
+	// created by others while waiting for lock
+	if fc.sdk != nil {
+		return fc.sdk, fc.msp, nil
+	}
+
+	sdk, client, err := fc.create()
+	if err != nil {
+		return nil, nil, err
+	}
+	fc.sdk = sdk
+	fc.msp = client
+	return sdk, client, nil
+}
+
+// Reload creates sdk from config file again, current sdk is kept if it fails
+func (fc *FabricClient) Reload() error {
+	sdk, client, err := fc.create()
+	if err != nil {
+		return err
+	}
+
+	fc.mu.Lock()
+	if fc.closed {
+		fc.mu.Unlock()
+		sdk.Close()
+		return ErrFabricClientClosed
+	}
+	old := fc.sdk
+	fc.sdk = sdk
+	fc.msp = client
+	fc.mu.Unlock()
+
+	if old != nil {
+		time.AfterFunc(fabricReloadCloseDelay, old.Close)
+	}
+	return nil
+}
+
+// Close releases sdk, MSPClient fails after it
+func (fc *FabricClient) Close() {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	if fc.closed {
+		return
+	}
+	fc.closed = true
+	if fc.sdk != nil {
+		fc.sdk.Close()
+	}
+	fc.sdk = nil
+	fc.msp = nil
+}
+
+func (fc *FabricClient) create() (*fabsdk.FabricSDK, *msp.Client, error) {
+	sdk, err := fabsdk.New(config.FromFile(fc.opt.CCPath))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	client, err := msp.New(sdk.Context(), msp.WithOrg(fc.opt.OrgName))
+	if err != nil {
+		sdk.Close()
+		return nil, nil, err
+	}
+	return sdk, client, nil
+}
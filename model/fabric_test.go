@@ -0,0 +1,33 @@
+package model
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestFabricClientClosed(t *testing.T) {
+	fc := NewFabricClient(&FabricGWOption{CCPath: "/nonexistent/connection.yaml", OrgName: "Org1"})
+
+	// a bad config isn't cached, every caller gets the error
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := fc.MSPClient(); err == nil {
+				t.Error("expect error for missing config file")
+			}
+		}()
+	}
+	wg.Wait()
+
+	if err := fc.Reload(); err == nil {
+		t.Fatal("expect reload error for missing config file")
+	}
+
+	fc.Close()
+	fc.Close()
+	if _, err := fc.MSPClient(); err != ErrFabricClientClosed {
+		t.Fatalf("expect ErrFabricClientClosed, got %v", err)
+	}
+}
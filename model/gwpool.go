@@ -0,0 +1,261 @@
+package model
+
+import (
+	"container/list"
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	ErrGatewayPoolFull   = errors.New("too many fabric gateway connections in use")
+	ErrGatewayPoolClosed = errors.New("fabric gateway pool has been closed")
+)
+
+const (
+	defaultGatewayPoolMaxConns    = 100
+	defaultGatewayPoolIdleSeconds = 300
+)
+
+type GatewayPoolOption struct {
+	// max connections kept by pool, default is 100
+	MaxConns int
+
+	// connection not used for this long is closed, unit is second, default is 300
+	IdleSeconds int
+}
+
+func (o *GatewayPoolOption) maxConns() int {
+	if o == nil || o.MaxConns <= 0 {
+		return defaultGatewayPoolMaxConns
+	}
+	return o.MaxConns
+}
+
+func (o *GatewayPoolOption) IdleTimeout() time.Duration {
+	if o == nil || o.IdleSeconds <= 0 {
+		return defaultGatewayPoolIdleSeconds * time.Second
+	}
+	return time.Duration(o.IdleSeconds) * time.Second
+}
+
+// GatewayConn is a connection kept by GatewayPool, *gateway.Gateway implements it
+type GatewayConn interface {
+	Close()
+}
+
+type GatewayPoolStats struct {
+	Size       int   `json:"size"`
+	InUse      int   `json:"inUse"`
+	MaxConns   int   `json:"maxConns"`
+	Hits       int64 `json:"hits"`
+	Misses     int64 `json:"misses"`
+	Evictions  int64 `json:"evictions"`
+	DialErrors int64 `json:"dialErrors"`
+}
+
+type gatewayEntry struct {
+	enrollId string
+	conn     GatewayConn
+	refs     int
+	lastUsed time.Time
+
+	// removed from pool while in use, it's closed by the last release
+	evicted bool
+}
+
+// GatewayPool keeps one connection per enrollId, least recently used idle one is
+// closed when pool is full, connections in use are never closed
+// all methods are safe for concurrent use
+type GatewayPool struct {
+	maxConns int
+	idle     time.Duration
+
+	mu      sync.Mutex
+	lru     *list.List // front is the most recently used
+	entries map[string]*list.Element
+	stats   GatewayPoolStats
+	closed  bool
+}
+
+func NewGatewayPool(opt *GatewayPoolOption) *GatewayPool {
+	return &GatewayPool{
+		maxConns: opt.maxConns(),
+		idle:     opt.IdleTimeout(),
+		lru:      list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+}
+
+// Get returns connection of enrollId, dial is called if pool doesn't have it
+// release must be called when connection isn't used anymore
+func (p *GatewayPool) Get(enrollId string, dial func() (GatewayConn, error)) (GatewayConn, func(), error) {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil, nil, ErrGatewayPoolClosed
+	}
+	if elem, ok := p.entries[enrollId]; ok {
+		entry := p.use(elem)
+		p.stats.Hits++
+		p.mu.Unlock()
+		return entry.conn, p.releaser(entry), nil
+	}
+	p.stats.Misses++
+	p.mu.Unlock()
+
+	// dialing is slow, it's done without lock
+	conn, err := dial()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err != nil {
+		p.stats.DialErrors++
+		return nil, nil, err
+	}
+	if p.closed {
+		conn.Close()
+		return nil, nil, ErrGatewayPoolClosed
+	}
+
+	// dialed by others at the same time
+	if elem, ok := p.entries[enrollId]; ok {
+		conn.Close()
+		entry := p.use(elem)
+		return entry.conn, p.releaser(entry), nil
+	}
+
+	if p.lru.Len() >= p.maxConns && !p.evictOldestIdle() {
+		conn.Close()
+		return nil, nil, ErrGatewayPoolFull
+	}
+
+	entry := &gatewayEntry{
+		enrollId: enrollId,
+		conn:     conn,
+		refs:     1,
+		lastUsed: time.Now(),
+	}
+	p.entries[enrollId] = p.lru.PushFront(entry)
+	return conn, p.releaser(entry), nil
+}
+
+func (p *GatewayPool) use(elem *list.Element) *gatewayEntry {
+	entry := elem.Value.(*gatewayEntry)
+	entry.refs++
+	entry.lastUsed = time.Now()
+	p.lru.MoveToFront(elem)
+	return entry
+}
+
+func (p *GatewayPool) releaser(entry *gatewayEntry) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			p.mu.Lock()
+			defer p.mu.Unlock()
+			entry.refs--
+			entry.lastUsed = time.Now()
+			if entry.evicted && entry.refs == 0 {
+				entry.conn.Close()
+			}
+		})
+	}
+}
+
+// evictOldestIdle closes the least recently used connection not in use
+func (p *GatewayPool) evictOldestIdle() bool {
+	for elem := p.lru.Back(); elem != nil; elem = elem.Prev() {
+		if elem.Value.(*gatewayEntry).refs == 0 {
+			p.evict(elem)
+			return true
+		}
+	}
+	return false
+}
+
+// evict drops elem from pool, connection in use is closed by its last release
+func (p *GatewayPool) evict(elem *list.Element) {
+	entry := elem.Value.(*gatewayEntry)
+	p.lru.Remove(elem)
+	delete(p.entries, entry.enrollId)
+	p.stats.Evictions++
+	entry.evicted = true
+	if entry.refs == 0 {
+		entry.conn.Close()
+	}
+}
+
+// Remove drops connection of enrollId, e.g. its certificate has changed or user is disabled
+func (p *GatewayPool) Remove(enrollId string) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if elem, ok := p.entries[enrollId]; ok {
+		p.evict(elem)
+	}
+}
+
+// EvictIdle closes connections not used within idle timeout
+func (p *GatewayPool) EvictIdle() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	deadline := time.Now().Add(-p.idle)
+	count := 0
+	for elem := p.lru.Back(); elem != nil; {
+		prev := elem.Prev()
+		entry := elem.Value.(*gatewayEntry)
+		if entry.refs == 0 && entry.lastUsed.Before(deadline) {
+			p.evict(elem)
+			count++
+		}
+		elem = prev
+	}
+	return count
+}
+
+// Purge drops all connections, e.g. fabric config has been reloaded
+func (p *GatewayPool) Purge() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.purge()
+}
+
+func (p *GatewayPool) purge() {
+	for elem := p.lru.Front(); elem != nil; {
+		next := elem.Next()
+		p.evict(elem)
+		elem = next
+	}
+}
+
+// Close drops all connections, Get fails after it
+func (p *GatewayPool) Close() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	p.purge()
+}
+
+func (p *GatewayPool) Stats() GatewayPoolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	stats := p.stats
+	stats.Size = p.lru.Len()
+	stats.MaxConns = p.maxConns
+	for elem := p.lru.Front(); elem != nil; elem = elem.Next() {
+		if elem.Value.(*gatewayEntry).refs > 0 {
+			stats.InUse++
+		}
+	}
+	return stats
+}
@@ -0,0 +1,112 @@
+package model
+
+import (
+	"sync/atomic"
+	"testing"
+)
+
+type fakeConn struct {
+	closed int32
+}
+
+func (c *fakeConn) Close() {
+	atomic.AddInt32(&c.closed, 1)
+}
+
+func dialFake(conns map[string]*fakeConn, id string) func() (GatewayConn, error) {
+	return func() (GatewayConn, error) {
+		c := &fakeConn{}
+		conns[id] = c
+		return c, nil
+	}
+}
+
+func TestGatewayPoolLRU(t *testing.T) {
+	pool := NewGatewayPool(&GatewayPoolOption{MaxConns: 2})
+	conns := map[string]*fakeConn{}
+
+	_, releaseA, _ := pool.Get("a", dialFake(conns, "a"))
+	_, releaseB, _ := pool.Get("b", dialFake(conns, "b"))
+
+	// pool is full and both are in use
+	if _, _, err := pool.Get("c", dialFake(conns, "c")); err != ErrGatewayPoolFull {
+		t.Fatalf("expect ErrGatewayPoolFull, got %v", err)
+	}
+	if conns["c"].closed != 1 {
+		t.Fatal("rejected connection should be closed")
+	}
+
+	releaseA()
+	releaseB()
+	releaseB() // it's safe to release twice
+
+	// a is used again, so b is the least recently used
+	if _, release, _ := pool.Get("a", dialFake(conns, "x")); release != nil {
+		release()
+	}
+	if _, ok := conns["x"]; ok {
+		t.Fatal("pooled connection should be reused")
+	}
+
+	_, releaseC, err := pool.Get("c", dialFake(conns, "c"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	releaseC()
+	if conns["b"].closed != 1 || conns["a"].closed != 0 {
+		t.Fatal("least recently used connection should be evicted")
+	}
+
+	stats := pool.Stats()
+	if stats.Size != 2 || stats.Hits != 1 || stats.Misses != 4 || stats.Evictions != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+func TestGatewayPoolRemoveInUse(t *testing.T) {
+	pool := NewGatewayPool(nil)
+	conns := map[string]*fakeConn{}
+
+	_, release, _ := pool.Get("a", dialFake(conns, "a"))
+	pool.Remove("a")
+	if conns["a"].closed != 0 {
+		t.Fatal("connection in use shouldn't be closed")
+	}
+	release()
+	if conns["a"].closed != 1 {
+		t.Fatal("removed connection should be closed by release")
+	}
+
+	// removed connection isn't reused
+	_, release, _ = pool.Get("a", dialFake(conns, "a"))
+	release()
+	if conns["a"].closed != 0 {
+		t.Fatal("expect a new connection")
+	}
+
+	pool.Close()
+	if conns["a"].closed != 1 {
+		t.Fatal("close should close idle connections")
+	}
+	if _, _, err := pool.Get("a", dialFake(conns, "a")); err != ErrGatewayPoolClosed {
+		t.Fatalf("expect ErrGatewayPoolClosed, got %v", err)
+	}
+}
+
+func TestGatewayPoolEvictIdle(t *testing.T) {
+	pool := NewGatewayPool(nil)
+	pool.idle = 0
+	conns := map[string]*fakeConn{}
+
+	_, releaseA, _ := pool.Get("a", dialFake(conns, "a"))
+	_, releaseB, _ := pool.Get("b", dialFake(conns, "b"))
+	releaseA()
+
+	if n := pool.EvictIdle(); n != 1 {
+		t.Fatalf("expect 1 idle connection evicted, got %d", n)
+	}
+	releaseB()
+	if conns["a"].closed != 1 || conns["b"].closed != 0 {
+		t.Fatal("only idle connection should be evicted")
+	}
+}
@@ -2,15 +2,29 @@ package model
 
 import (
 	"github.com/dgrijalva/jwt-go"
-	"github.com/hyperledger/fabric-sdk-go/pkg/client/msp"
 )
 
 const JWTHeaderName = "X-TOKEN"
 
+// browsers can't set headers on EventSource and WebSocket,
+// event stream apis also accept token from this query parameter or cookie
+const (
+	JWTQueryName  = "access_token"
+	JWTCookieName = "X-TOKEN"
+)
+
+// StandardClaims.Id is the jti, it's used to revoke a single token
 type JWTClaim struct {
 	UserId   string   `json:"userId"`
 	UserName string   `json:"username"`
 	Role     UserRole `json:"role"`
+
+	// token can only be used to change password
+	MustChangePasswd bool `json:"mustChangePasswd,omitempty"`
+
+	// non-empty purpose means it's not an access token, e.g. mfa challenge
+	Purpose string `json:"purpose,omitempty"`
+
 	jwt.StandardClaims
 }
 
@@ -18,6 +32,9 @@ type JWTResponse struct {
 	Err   error  `json:"-"`
 	Token string `json:"token"`
 
+	// when login or refresh token
+	RefreshToken string `json:"refreshToken,omitempty"`
+
 	// when parse token, this may has value
 	Valid bool      `json:"valid"`
 	Claim *JWTClaim `json:"claim"`
@@ -25,8 +42,17 @@ type JWTResponse struct {
 	// when create user account
 	UserAccount *UserAccount `json:"-"`
 
+	// when admin resets password, it's the temporary password
+	Passwd string `json:"-"`
+
+	// when login needs TOTP check or when TOTP is enrolled
+	MFA *MFAResult `json:"-"`
+
 	// when create ca account
-	MspClient *msp.Client `json:"-"`
+	MspClient MSPClient `json:"-"`
+
+	// when enroll ca account, expiry(unix time) of the certificate put into wallet
+	CertNotAfter int64 `json:"-"`
 }
 
 func InitJWTResponse() *JWTResponse {
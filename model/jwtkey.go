@@ -0,0 +1,308 @@
+package model
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/leyle/go-api-starter/util"
+	"math/big"
+	"time"
+)
+
+const (
+	JWTAlgHS256 = "HS256"
+	JWTAlgRS256 = "RS256"
+	JWTAlgES256 = "ES256"
+	JWTAlgEdDSA = "EdDSA"
+)
+
+// kid of the key built from JWTOption.Secret when no KeyId is set
+const defaultHS256KeyId = "default"
+
+const challengeKeyLabel = "fabric-user-manager challenge token"
+
+var (
+	ErrUnsupportedJWTAlg = errors.New("unsupported jwt signing algorithm")
+	ErrInvalidJWTKey     = errors.New("invalid jwt key")
+)
+
+// JWTKey is a key used to sign or verify jwt tokens
+// HS256 uses Secret, others use PEM encoded PrivateKey
+type JWTKey struct {
+	Id         string
+	Algorithm  string
+	Secret     []byte
+	PrivateKey []byte
+
+	// unix time, zero means the key comes from config
+	Created int64
+	// unix time after which a verify-only key is dropped, zero means never
+	RetireAt int64
+
+	method    jwt.SigningMethod
+	signKey   interface{}
+	verifyKey interface{}
+}
+
+// Load parses the key material, it must be called before other methods
+func (k *JWTKey) Load() error {
+	if k.Algorithm == "" {
+		k.Algorithm = JWTAlgHS256
+	}
+
+	switch k.Algorithm {
+	case JWTAlgHS256:
+		if len(k.Secret) == 0 {
+			return fmt.Errorf("%w, HS256 needs secret", ErrInvalidJWTKey)
+		}
+		k.method = jwt.SigningMethodHS256
+		k.signKey = k.Secret
+		k.verifyKey = k.Secret
+		if k.Id == "" {
+			k.Id = defaultHS256KeyId
+		}
+		return nil
+	case JWTAlgRS256:
+		k.method = jwt.SigningMethodRS256
+	case JWTAlgES256:
+		k.method = jwt.SigningMethodES256
+	case JWTAlgEdDSA:
+		k.method = SigningMethodEdDSA
+	default:
+		return fmt.Errorf("%w: %s", ErrUnsupportedJWTAlg, k.Algorithm)
+	}
+
+	privateKey, err := parsePrivateKeyPEM(k.PrivateKey)
+	if err != nil {
+		return err
+	}
+
+	switch pk := privateKey.(type) {
+	case *rsa.PrivateKey:
+		if k.Algorithm != JWTAlgRS256 {
+			return fmt.Errorf("%w, rsa key can't be used by %s", ErrInvalidJWTKey, k.Algorithm)
+		}
+		k.signKey = pk
+		k.verifyKey = &pk.PublicKey
+	case *ecdsa.PrivateKey:
+		if k.Algorithm != JWTAlgES256 || pk.Curve != elliptic.P256() {
+			return fmt.Errorf("%w, ES256 needs a P-256 ecdsa key", ErrInvalidJWTKey)
+		}
+		k.signKey = pk
+		k.verifyKey = &pk.PublicKey
+	case ed25519.PrivateKey:
+		if k.Algorithm != JWTAlgEdDSA {
+			return fmt.Errorf("%w, ed25519 key can't be used by %s", ErrInvalidJWTKey, k.Algorithm)
+		}
+		k.signKey = pk
+		k.verifyKey = pk.Public()
+	default:
+		return fmt.Errorf("%w, unknown private key type %T", ErrInvalidJWTKey, privateKey)
+	}
+
+	if k.Id == "" {
+		k.Id = k.JWK().Thumbprint()
+	}
+
+	return nil
+}
+
+// GenerateJWTKey creates a new random key of the algorithm
+func GenerateJWTKey(alg string) (*JWTKey, error) {
+	if alg == "" {
+		alg = JWTAlgHS256
+	}
+
+	key := &JWTKey{
+		Algorithm: alg,
+		Created:   time.Now().Unix(),
+	}
+
+	var privateKey interface{}
+	var err error
+	switch alg {
+	case JWTAlgHS256:
+		key.Secret = make([]byte, 32)
+		_, err = rand.Read(key.Secret)
+	case JWTAlgRS256:
+		privateKey, err = rsa.GenerateKey(rand.Reader, 2048)
+	case JWTAlgES256:
+		privateKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case JWTAlgEdDSA:
+		_, privateKey, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedJWTAlg, alg)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if privateKey != nil {
+		der, err := x509.MarshalPKCS8PrivateKey(privateKey)
+		if err != nil {
+			return nil, err
+		}
+		key.PrivateKey = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	}
+
+	if alg == JWTAlgHS256 {
+		// secret's hash must not be exposed as kid
+		key.Id = util.GenerateDataId()
+	}
+
+	if err = key.Load(); err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+// ChallengeKey returns a HS256 secret derived from the key's private material
+// it signs tokens which aren't access tokens, e.g. mfa challenge, it's never published in JWKS,
+// so verifiers using the public key can't accept them as access tokens
+func (k *JWTKey) ChallengeKey() []byte {
+	material := k.Secret
+	if k.Algorithm != JWTAlgHS256 {
+		material = k.PrivateKey
+	}
+	mac := hmac.New(sha256.New, material)
+	mac.Write([]byte(challengeKeyLabel))
+	return mac.Sum(nil)
+}
+
+func (k *JWTKey) Method() jwt.SigningMethod {
+	return k.method
+}
+
+func (k *JWTKey) SignKey() interface{} {
+	return k.signKey
+}
+
+func (k *JWTKey) VerifyKey() interface{} {
+	return k.verifyKey
+}
+
+// JWK returns the public part of the key, symmetric key returns nil
+func (k *JWTKey) JWK() *JWK {
+	jwk := &JWK{
+		Kid: k.Id,
+		Alg: k.Algorithm,
+		Use: "sig",
+	}
+
+	switch pub := k.verifyKey.(type) {
+	case *rsa.PublicKey:
+		jwk.Kty = "RSA"
+		jwk.N = b64(pub.N.Bytes())
+		jwk.E = b64(big.NewInt(int64(pub.E)).Bytes())
+	case *ecdsa.PublicKey:
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		jwk.Kty = "EC"
+		jwk.Crv = pub.Curve.Params().Name
+		jwk.X = b64(padBytes(pub.X.Bytes(), size))
+		jwk.Y = b64(padBytes(pub.Y.Bytes(), size))
+	case ed25519.PublicKey:
+		jwk.Kty = "OKP"
+		jwk.Crv = "Ed25519"
+		jwk.X = b64(pub)
+	default:
+		return nil
+	}
+
+	return jwk
+}
+
+// JWK is a json web key, RFC 7517
+type JWK struct {
+	Kty string `json:"kty"`
+	Use string `json:"use,omitempty"`
+	Kid string `json:"kid,omitempty"`
+	Alg string `json:"alg,omitempty"`
+
+	// RSA
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+
+	// EC and OKP
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+type JWKSet struct {
+	Keys []*JWK `json:"keys"`
+}
+
+// Thumbprint returns RFC 7638 thumbprint of the key
+func (jwk *JWK) Thumbprint() string {
+	// required members in lexicographic order
+	var members interface{}
+	switch jwk.Kty {
+	case "RSA":
+		members = struct {
+			E   string `json:"e"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+		}{jwk.E, jwk.Kty, jwk.N}
+	case "EC":
+		members = struct {
+			Crv string `json:"crv"`
+			Kty string `json:"kty"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		}{jwk.Crv, jwk.Kty, jwk.X, jwk.Y}
+	default:
+		members = struct {
+			Crv string `json:"crv"`
+			Kty string `json:"kty"`
+			X   string `json:"x"`
+		}{jwk.Crv, jwk.Kty, jwk.X}
+	}
+
+	data, _ := json.Marshal(members)
+	sum := sha256.Sum256(data)
+	return b64(sum[:])
+}
+
+func parsePrivateKeyPEM(data []byte) (crypto.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%w, no PEM data found", ErrInvalidJWTKey)
+	}
+
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		return x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+
+	return nil, fmt.Errorf("%w, unsupported PEM type %s", ErrInvalidJWTKey, block.Type)
+}
+
+func b64(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func padBytes(data []byte, size int) []byte {
+	if len(data) >= size {
+		return data
+	}
+	buf := make([]byte, size)
+	copy(buf[size-len(data):], data)
+	return buf
+}
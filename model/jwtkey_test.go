@@ -0,0 +1,152 @@
+package model
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"github.com/dgrijalva/jwt-go"
+	"testing"
+)
+
+func pkcs8PEM(t *testing.T, key interface{}) []byte {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+}
+
+func TestJWTKeySignVerify(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+
+	keys := []*JWTKey{
+		{Algorithm: JWTAlgHS256, Secret: []byte("hello")},
+		{Algorithm: JWTAlgRS256, PrivateKey: pkcs8PEM(t, rsaKey)},
+		{Algorithm: JWTAlgES256, PrivateKey: pkcs8PEM(t, ecKey)},
+		{Algorithm: JWTAlgEdDSA, PrivateKey: pkcs8PEM(t, edKey)},
+	}
+
+	for _, key := range keys {
+		if err := key.Load(); err != nil {
+			t.Fatal(key.Algorithm, err)
+		}
+		if key.Id == "" {
+			t.Fatal(key.Algorithm, "kid should not be empty")
+		}
+
+		token := jwt.NewWithClaims(key.Method(), &jwt.StandardClaims{Subject: "user"})
+		tokenStr, err := token.SignedString(key.SignKey())
+		if err != nil {
+			t.Fatal(key.Algorithm, err)
+		}
+
+		parsed, err := jwt.Parse(tokenStr, func(*jwt.Token) (interface{}, error) {
+			return key.VerifyKey(), nil
+		})
+		if err != nil || !parsed.Valid {
+			t.Fatal(key.Algorithm, err)
+		}
+
+		jwk := key.JWK()
+		if key.Algorithm == JWTAlgHS256 {
+			if jwk != nil {
+				t.Fatal("HS256 key must not be published")
+			}
+			continue
+		}
+		if jwk == nil || jwk.Kid != key.Id {
+			t.Fatal(key.Algorithm, "invalid jwk")
+		}
+	}
+}
+
+func TestJWTKeyAlgMismatch(t *testing.T) {
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	key := &JWTKey{Algorithm: JWTAlgRS256, PrivateKey: pkcs8PEM(t, ecKey)}
+	if err := key.Load(); err == nil {
+		t.Fatal("ecdsa key should not be loaded as RS256")
+	}
+}
+
+func TestJWTKeyChallengeKey(t *testing.T) {
+	key := &JWTKey{Algorithm: JWTAlgHS256, Secret: []byte("hello")}
+	if err := key.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	// challenge token can't be verified as an access token
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, &jwt.StandardClaims{Subject: "user"})
+	tokenStr, err := token.SignedString(key.ChallengeKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = jwt.Parse(tokenStr, func(*jwt.Token) (interface{}, error) {
+		return key.VerifyKey(), nil
+	})
+	if err == nil {
+		t.Fatal("challenge token should not be verified by access token key")
+	}
+
+	other := &JWTKey{Algorithm: JWTAlgHS256, Secret: []byte("world")}
+	if err = other.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if string(key.ChallengeKey()) == string(other.ChallengeKey()) {
+		t.Fatal("challenge key should depend on key material")
+	}
+}
+
+func TestKeyRing(t *testing.T) {
+	ring := NewKeyRing()
+
+	first, err := GenerateJWTKey(JWTAlgES256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := GenerateJWTKey(JWTAlgHS256)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ring.Add(first, false)
+	if !ring.IsActive(first.Id) {
+		t.Fatal("first key should be active")
+	}
+	ring.Add(second, true)
+	if !ring.IsActive(second.Id) || ring.Get(first.Id) == nil {
+		t.Fatal("old key should be kept for verifying")
+	}
+	if ring.Remove(second.Id) {
+		t.Fatal("active key should not be removed")
+	}
+	if len(ring.JWKSet().Keys) != 1 {
+		t.Fatal("only asymmetric key should be published")
+	}
+}
+
+func TestJWTKeyDocEncrypt(t *testing.T) {
+	encryptKey := []byte("0123456789abcdef0123456789abcdef")
+	for _, alg := range []string{JWTAlgHS256, JWTAlgEdDSA} {
+		key, err := GenerateJWTKey(alg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		doc, err := NewJWTKeyDoc(key, JWTKeyStatusActive, encryptKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		loaded, err := doc.Key(encryptKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if loaded.Id != key.Id || string(loaded.Secret) != string(key.Secret) || string(loaded.PrivateKey) != string(key.PrivateKey) {
+			t.Fatal(alg, "key changed after save and load")
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package model
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"github.com/leyle/go-api-starter/couchdb"
+	"github.com/leyle/go-api-starter/util"
+)
+
+const DBNameJWTKey = "jwtkey"
+
+const (
+	JWTKeyStatusActive  = "active"
+	JWTKeyStatusVerify  = "verify"
+	JWTKeyStatusRetired = "retired"
+)
+
+// JWTKeyDoc is a generated signing key saved in db, so all instances share the same keys
+// doc id is the kid
+type JWTKeyDoc struct {
+	Id        string        `json:"id"`
+	Rev       string        `json:"_rev,omitempty"`
+	Algorithm string        `json:"algorithm"`
+	Status    string        `json:"status"`
+	Encrypted bool          `json:"encrypted"`
+	Secret    string        `json:"secret,omitempty"`
+	PrivKey   string        `json:"privateKey,omitempty"`
+	CreatedAt int64         `json:"createdAt"`
+	RetireAt  int64         `json:"retireAt"`
+	Updated   *util.CurTime `json:"updated"`
+
+	// key comes from config, doc only records its status, key material isn't saved
+	FromConfig bool `json:"fromConfig,omitempty"`
+}
+
+// NewConfigKeyDoc records status of the config key, so all instances retire it
+func NewConfigKeyDoc(key *JWTKey, status string) *JWTKeyDoc {
+	return &JWTKeyDoc{
+		Id:         key.Id,
+		Algorithm:  key.Algorithm,
+		Status:     status,
+		RetireAt:   key.RetireAt,
+		Updated:    util.GetCurTime(),
+		FromConfig: true,
+	}
+}
+
+func NewJWTKeyDoc(key *JWTKey, status string, encryptKey []byte) (*JWTKeyDoc, error) {
+	doc := &JWTKeyDoc{
+		Id:        key.Id,
+		Algorithm: key.Algorithm,
+		Status:    status,
+		CreatedAt: key.Created,
+		RetireAt:  key.RetireAt,
+		Updated:   util.GetCurTime(),
+	}
+
+	secret := base64.StdEncoding.EncodeToString(key.Secret)
+	privKey := string(key.PrivateKey)
+	if len(encryptKey) > 0 {
+		var err error
+		if secret, err = util.Encrypt(encryptKey, secret); err != nil {
+			return nil, err
+		}
+		if privKey, err = util.Encrypt(encryptKey, privKey); err != nil {
+			return nil, err
+		}
+		doc.Encrypted = true
+	}
+	doc.Secret = secret
+	doc.PrivKey = privKey
+
+	return doc, nil
+}
+
+// Key decrypts and loads the key
+func (doc *JWTKeyDoc) Key(encryptKey []byte) (*JWTKey, error) {
+	secret := doc.Secret
+	privKey := doc.PrivKey
+	if doc.Encrypted {
+		var err error
+		if secret, err = util.Decrypt(encryptKey, secret); err != nil {
+			return nil, err
+		}
+		if privKey, err = util.Decrypt(encryptKey, privKey); err != nil {
+			return nil, err
+		}
+	}
+
+	rawSecret, err := base64.StdEncoding.DecodeString(secret)
+	if err != nil {
+		return nil, err
+	}
+
+	key := &JWTKey{
+		Id:         doc.Id,
+		Algorithm:  doc.Algorithm,
+		Secret:     rawSecret,
+		PrivateKey: []byte(privKey),
+		Created:    doc.CreatedAt,
+		RetireAt:   doc.RetireAt,
+	}
+	if err = key.Load(); err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+// GetJWTKeyDocs returns active and verify-only keys, and the config key's doc of any status
+func GetJWTKeyDocs(ctx *JWTContext) ([]*JWTKeyDoc, error) {
+	selector := map[string]interface{}{
+		"$or": []map[string]interface{}{
+			{
+				"status": map[string]interface{}{
+					"$in": []string{JWTKeyStatusActive, JWTKeyStatusVerify},
+				},
+			},
+			{
+				"fromConfig": true,
+			},
+		},
+	}
+	searchReq := &couchdb.SearchRequest{
+		Selector: selector,
+		Limit:    1000,
+	}
+
+	type Resp struct {
+		Docs []*JWTKeyDoc `json:"docs"`
+	}
+	var respDocs *Resp
+	_, err := ctx.Ds(DBNameJWTKey).Search(ctx.Context(), searchReq, &respDocs)
+	if err != nil {
+		ctx.Logger().Error().Err(err).Msg("GetJWTKeyDocs failed")
+		return nil, err
+	}
+
+	return respDocs.Docs, nil
+}
+
+func GetJWTKeyDoc(ctx *JWTContext, kid string) (*JWTKeyDoc, error) {
+	var doc *JWTKeyDoc
+	_, err := ctx.Ds(DBNameJWTKey).GetById(ctx.Context(), kid, &doc)
+	if err != nil {
+		if err == couchdb.NoIdData {
+			return nil, nil
+		}
+		ctx.Logger().Error().Err(err).Str("kid", kid).Msg("GetJWTKeyDoc failed")
+		return nil, err
+	}
+	return doc, nil
+}
+
+func SaveJWTKeyDoc(ctx *JWTContext, doc *JWTKeyDoc) error {
+	data, _ := json.Marshal(doc)
+	err := ctx.Ds(DBNameJWTKey).CreateDoc(ctx.Context(), doc.Id, data)
+	if err != nil {
+		ctx.Logger().Error().Err(err).Str("kid", doc.Id).Msg("SaveJWTKeyDoc failed")
+		return err
+	}
+	return nil
+}
+
+func UpdateJWTKeyDoc(ctx *JWTContext, doc *JWTKeyDoc) error {
+	doc.Updated = util.GetCurTime()
+	rev, err := updateDoc(ctx, DBNameJWTKey, doc.Id, doc)
+	if err != nil {
+		ctx.Logger().Error().Err(err).Str("kid", doc.Id).Msg("UpdateJWTKeyDoc failed")
+		return err
+	}
+	doc.Rev = rev
+	return nil
+}
@@ -0,0 +1,88 @@
+package model
+
+import (
+	"sort"
+	"sync"
+)
+
+// KeyRing holds one active signing key and several verify-only keys
+// verify-only keys are selected by token's kid, so tokens signed by
+// a rotated key keep working until the key is retired
+type KeyRing struct {
+	mu     sync.RWMutex
+	active *JWTKey
+	keys   map[string]*JWTKey
+}
+
+func NewKeyRing() *KeyRing {
+	return &KeyRing{
+		keys: make(map[string]*JWTKey),
+	}
+}
+
+// Active returns the key used to sign new tokens
+func (kr *KeyRing) Active() *JWTKey {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	return kr.active
+}
+
+// Get returns the key by kid, it may be active or verify-only
+func (kr *KeyRing) Get(kid string) *JWTKey {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	return kr.keys[kid]
+}
+
+// Keys returns all keys, newest first
+func (kr *KeyRing) Keys() []*JWTKey {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	keys := make([]*JWTKey, 0, len(kr.keys))
+	for _, k := range kr.keys {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].Created > keys[j].Created
+	})
+	return keys
+}
+
+// Add puts a loaded key into the ring, if activate is true, it becomes the signing key
+func (kr *KeyRing) Add(key *JWTKey, activate bool) {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	kr.keys[key.Id] = key
+	if activate || kr.active == nil {
+		kr.active = key
+	}
+}
+
+// Remove drops a verify-only key, the active key can't be removed
+func (kr *KeyRing) Remove(kid string) bool {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	if kr.active != nil && kr.active.Id == kid {
+		return false
+	}
+	delete(kr.keys, kid)
+	return true
+}
+
+func (kr *KeyRing) IsActive(kid string) bool {
+	active := kr.Active()
+	return active != nil && active.Id == kid
+}
+
+// JWKSet returns public keys of all asymmetric keys in the ring
+func (kr *KeyRing) JWKSet() *JWKSet {
+	set := &JWKSet{
+		Keys: []*JWK{},
+	}
+	for _, k := range kr.Keys() {
+		if jwk := k.JWK(); jwk != nil {
+			set.Keys = append(set.Keys, jwk)
+		}
+	}
+	return set
+}
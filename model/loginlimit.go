@@ -0,0 +1,178 @@
+package model
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	defaultMaxFailedAttempts   = 5
+	defaultIPMaxFailedAttempts = 20
+	defaultLoginWindowMinutes  = 15
+	defaultLockoutSeconds      = 60
+	defaultMaxLockoutMinutes   = 60
+)
+
+type LoginThrottleOption struct {
+	// account is locked after this many failed logins in a row, default is 5
+	MaxFailedAttempts int
+
+	// an ip is blocked after this many failed logins in the window, default is 20
+	IPMaxFailedAttempts int
+
+	// failed logins of an ip or an unknown username older than this are forgotten
+	// unit is minute, default is 15
+	WindowMinutes int
+
+	// first lockout lasts this long, it's doubled for each further failure
+	// unit is second, default is 60
+	LockoutSeconds int
+
+	// upper limit of lockout, unit is minute, default is 60
+	MaxLockoutMinutes int
+}
+
+func (o *LoginThrottleOption) withDefault() *LoginThrottleOption {
+	opt := LoginThrottleOption{}
+	if o != nil {
+		opt = *o
+	}
+	if opt.MaxFailedAttempts <= 0 {
+		opt.MaxFailedAttempts = defaultMaxFailedAttempts
+	}
+	if opt.IPMaxFailedAttempts <= 0 {
+		opt.IPMaxFailedAttempts = defaultIPMaxFailedAttempts
+	}
+	if opt.WindowMinutes <= 0 {
+		opt.WindowMinutes = defaultLoginWindowMinutes
+	}
+	if opt.LockoutSeconds <= 0 {
+		opt.LockoutSeconds = defaultLockoutSeconds
+	}
+	if opt.MaxLockoutMinutes <= 0 {
+		opt.MaxLockoutMinutes = defaultMaxLockoutMinutes
+	}
+	return &opt
+}
+
+// LockoutDuration returns how long to lock after failures failed attempts
+// it's zero before max attempts is reached, then doubles for each failure
+func (o *LoginThrottleOption) LockoutDuration(failures, max int) time.Duration {
+	opt := o.withDefault()
+	if failures < max {
+		return 0
+	}
+
+	d := time.Duration(opt.LockoutSeconds) * time.Second
+	limit := time.Duration(opt.MaxLockoutMinutes) * time.Minute
+	for i := max; i < failures && d < limit; i++ {
+		d *= 2
+	}
+	if d > limit {
+		d = limit
+	}
+	return d
+}
+
+// LoginLimiter tracks failed logins in memory by ip and by username
+// usernames that don't exist are tracked too, so they look the same as real ones
+type LoginLimiter struct {
+	mu      sync.Mutex
+	opt     *LoginThrottleOption
+	entries map[string]*loginAttempt
+}
+
+type loginAttempt struct {
+	failures     int
+	first        time.Time
+	blockedUntil time.Time
+}
+
+func NewLoginLimiter(opt *LoginThrottleOption) *LoginLimiter {
+	return &LoginLimiter{
+		opt:     opt.withDefault(),
+		entries: make(map[string]*loginAttempt),
+	}
+}
+
+func LoginLimitIPKey(ip string) string {
+	return "ip:" + ip
+}
+
+func LoginLimitUserKey(username string) string {
+	return "user:" + username
+}
+
+func LoginLimitMFAKey(userId string) string {
+	return "mfa:" + userId
+}
+
+// BlockedUntil returns the time when key is allowed to login again
+// zero time means it's not blocked
+func (l *LoginLimiter) BlockedUntil(key string) time.Time {
+	if l == nil {
+		return time.Time{}
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	e, ok := l.entries[key]
+	if !ok || time.Now().After(e.blockedUntil) {
+		return time.Time{}
+	}
+	return e.blockedUntil
+}
+
+// Fail records a failed login, max is the number of failures before blocking
+func (l *LoginLimiter) Fail(key string, max int) time.Time {
+	if l == nil {
+		return time.Time{}
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.purge()
+
+	now := time.Now()
+	window := time.Duration(l.opt.WindowMinutes) * time.Minute
+	e, ok := l.entries[key]
+	if !ok || now.Sub(e.first) > window {
+		e = &loginAttempt{first: now}
+		l.entries[key] = e
+	}
+	e.failures++
+	if d := l.opt.LockoutDuration(e.failures, max); d > 0 {
+		e.blockedUntil = now.Add(d)
+	}
+	return e.blockedUntil
+}
+
+func (l *LoginLimiter) Reset(key string) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.entries, key)
+}
+
+func (l *LoginLimiter) Option() *LoginThrottleOption {
+	if l == nil {
+		return (*LoginThrottleOption)(nil).withDefault()
+	}
+	return l.opt
+}
+
+// purge drops expired entries, caller must hold the lock
+func (l *LoginLimiter) purge() {
+	const purgeThreshold = 10000
+	if len(l.entries) < purgeThreshold {
+		return
+	}
+
+	now := time.Now()
+	window := time.Duration(l.opt.WindowMinutes) * time.Minute
+	for k, e := range l.entries {
+		if now.Sub(e.first) > window && now.After(e.blockedUntil) {
+			delete(l.entries, k)
+		}
+	}
+}
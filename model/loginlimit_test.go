@@ -0,0 +1,55 @@
+package model
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLockoutDuration(t *testing.T) {
+	opt := &LoginThrottleOption{LockoutSeconds: 10, MaxLockoutMinutes: 1}
+
+	cases := map[int]time.Duration{
+		2: 0,
+		3: 10 * time.Second,
+		4: 20 * time.Second,
+		5: 40 * time.Second,
+		6: time.Minute,
+		9: time.Minute,
+	}
+	for failures, expect := range cases {
+		if d := opt.LockoutDuration(failures, 3); d != expect {
+			t.Errorf("failures %d, expect %s, got %s", failures, expect, d)
+		}
+	}
+}
+
+func TestLoginLimiter(t *testing.T) {
+	l := NewLoginLimiter(&LoginThrottleOption{LockoutSeconds: 60})
+	key := LoginLimitIPKey("127.0.0.1")
+
+	for i := 0; i < 2; i++ {
+		l.Fail(key, 3)
+		if !l.BlockedUntil(key).IsZero() {
+			t.Fatal("should not be blocked before max attempts")
+		}
+	}
+
+	until := l.Fail(key, 3)
+	if until.IsZero() || l.BlockedUntil(key) != until {
+		t.Fatal("should be blocked after max attempts")
+	}
+	if !l.BlockedUntil(LoginLimitUserKey("127.0.0.1")).IsZero() {
+		t.Fatal("other key should not be blocked")
+	}
+
+	l.Reset(key)
+	if !l.BlockedUntil(key).IsZero() {
+		t.Fatal("should not be blocked after reset")
+	}
+
+	var nilLimiter *LoginLimiter
+	nilLimiter.Fail(key, 1)
+	if !nilLimiter.BlockedUntil(key).IsZero() {
+		t.Fatal("nil limiter never blocks")
+	}
+}
@@ -0,0 +1,161 @@
+package model
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base32"
+	"errors"
+	"github.com/leyle/go-api-starter/util"
+	"strings"
+	"time"
+)
+
+const (
+	TokenPurposeMFA = "mfa"
+
+	// jwt typ header of challenge tokens, access tokens use the default JWT
+	ChallengeTokenType = "mfa-challenge+jwt"
+
+	defaultMFAIssuer           = "fabric-user-manager"
+	defaultMFAChallengeMinutes = 5
+	defaultRecoveryCodeCount   = 10
+
+	recoveryCodeLen    = 10
+	mfaEncryptedPrefix = "enc:"
+)
+
+var ErrMFANoEncryptKey = errors.New("totp secret is encrypted, but no encrypt key is configured")
+
+type MFAOption struct {
+	// issuer shown in authenticator apps
+	Issuer string
+
+	// admin must enroll and use TOTP
+	RequireForAdmin bool
+
+	// AES key(16, 24 or 32 bytes) to encrypt TOTP secret saved in db
+	// if it's empty, secret is saved as plain text
+	EncryptKey []byte
+
+	// how long the challenge token returned by login is valid, unit is minute, default is 5
+	ChallengeMinutes int
+
+	// how many recovery codes are generated, default is 10
+	RecoveryCodeCount int
+}
+
+// MFAResult is returned when login needs a second step or when TOTP is enrolled
+type MFAResult struct {
+	// token used to finish login, it can't be used to call other apis
+	Challenge string `json:"challenge,omitempty"`
+
+	// user must enroll TOTP before login
+	EnrollRequired bool `json:"enrollRequired,omitempty"`
+
+	// TOTP secret and otpauth uri, only returned when enrolling
+	Secret string `json:"secret,omitempty"`
+	URI    string `json:"uri,omitempty"`
+
+	// plain recovery codes, only returned once when TOTP is enabled
+	RecoveryCodes []string `json:"recoveryCodes,omitempty"`
+}
+
+// Required reports if user must pass TOTP check when login
+func (o *MFAOption) Required(u *UserAccount) bool {
+	if u.MFAEnabled {
+		return true
+	}
+	return o != nil && o.RequireForAdmin && u.Role == UserRoleAdmin
+}
+
+func (o *MFAOption) IssuerName() string {
+	if o == nil || o.Issuer == "" {
+		return defaultMFAIssuer
+	}
+	return o.Issuer
+}
+
+func (o *MFAOption) ChallengeTTL() time.Duration {
+	if o == nil || o.ChallengeMinutes <= 0 {
+		return defaultMFAChallengeMinutes * time.Minute
+	}
+	return time.Duration(o.ChallengeMinutes) * time.Minute
+}
+
+func (o *MFAOption) recoveryCodeCount() int {
+	if o == nil || o.RecoveryCodeCount <= 0 {
+		return defaultRecoveryCodeCount
+	}
+	return o.RecoveryCodeCount
+}
+
+// SealSecret encrypts TOTP secret if EncryptKey is set
+func (o *MFAOption) SealSecret(secret string) (string, error) {
+	if o == nil || len(o.EncryptKey) == 0 {
+		return secret, nil
+	}
+	enc, err := util.Encrypt(o.EncryptKey, secret)
+	if err != nil {
+		return "", err
+	}
+	return mfaEncryptedPrefix + enc, nil
+}
+
+// OpenSecret decrypts TOTP secret saved by SealSecret
+func (o *MFAOption) OpenSecret(sealed string) (string, error) {
+	if !strings.HasPrefix(sealed, mfaEncryptedPrefix) {
+		return sealed, nil
+	}
+	if o == nil || len(o.EncryptKey) == 0 {
+		return "", ErrMFANoEncryptKey
+	}
+	return util.Decrypt(o.EncryptKey, strings.TrimPrefix(sealed, mfaEncryptedPrefix))
+}
+
+// GenerateRecoveryCodes returns plain codes for user and their hashes for db
+func (o *MFAOption) GenerateRecoveryCodes() ([]string, []string, error) {
+	n := o.recoveryCodeCount()
+	plain := make([]string, 0, n)
+	hashed := make([]string, 0, n)
+	enc := base32.StdEncoding.WithPadding(base32.NoPadding)
+	for i := 0; i < n; i++ {
+		buf := make([]byte, recoveryCodeLen)
+		if _, err := rand.Read(buf); err != nil {
+			return nil, nil, err
+		}
+		code := strings.ToLower(enc.EncodeToString(buf))[:recoveryCodeLen]
+		code = code[:5] + "-" + code[5:]
+		plain = append(plain, code)
+		hashed = append(hashed, hashRecoveryCode(code))
+	}
+	return plain, hashed, nil
+}
+
+// recovery codes are random, sha256 is enough
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.TrimSpace(code))
+	code = strings.ReplaceAll(code, "-", "")
+	code = strings.ReplaceAll(code, " ", "")
+	return util.Sha256(code)
+}
+
+// UseRecoveryCode removes the matched code, each code can only be used once
+func (u *UserAccount) UseRecoveryCode(code string) bool {
+	hash := hashRecoveryCode(code)
+	for i, h := range u.RecoveryCodes {
+		if subtle.ConstantTimeCompare([]byte(h), []byte(hash)) == 1 {
+			u.RecoveryCodes = append(u.RecoveryCodes[:i:i], u.RecoveryCodes[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// ClearMFA disables TOTP and removes its secret and recovery codes
+func (u *UserAccount) ClearMFA() {
+	u.MFAEnabled = false
+	u.MFASecret = ""
+	u.MFAPendingSecret = ""
+	u.MFALastStep = 0
+	u.RecoveryCodes = nil
+}
@@ -1,11 +1,20 @@
 package model
 
-import "github.com/leyle/go-api-starter/couchdb"
+import (
+	"github.com/leyle/go-api-starter/couchdb"
+	"sync"
+	"time"
+)
 
 type Option struct {
-	// couchdb config
+	// couchdb config, it's always required
+	// refresh tokens, revocations, jwt keys, registration sagas and audit logs are kept in couchdb
 	CouchDBOpt *couchdb.CouchDBOption
 
+	// user account store, if it's nil, couchdb is used
+	// only user accounts are kept in it, see CouchDBOpt
+	UserStore UserStore
+
 	// default fabric ca admin account
 	Registrar *FabricCARegistrar
 
@@ -14,6 +23,116 @@ type Option struct {
 
 	// JWT config
 	JWTOpt *JWTOption
+
+	// password hash config, if it's nil, argon2id with default cost is used
+	PasswdHashOpt *PasswdHashOption
+
+	// password policy for registration and password change
+	PasswdPolicyOpt *PasswdPolicyOption
+
+	// failed login tracking and account lockout, if it's nil, default values are used
+	LoginThrottleOpt *LoginThrottleOption
+
+	// TOTP multi-factor authentication config
+	MFAOpt *MFAOption
+
+	// OAuth2 token introspection config
+	OAuth2Opt *OAuth2Option
+
+	// user deletion config, if it's nil, users are deleted at once
+	UserDeleteOpt *UserDeleteOption
+
+	// scheduled reconciliation between db, wallet and ca, nil means it only runs by api
+	ReconcileOpt *ReconcileOption
+
+	// automatic re-enrollment before certificates expire, nil means it's only done by api
+	CertRenewOpt *CertRenewOption
+
+	// default affiliation and ca attributes of registered users
+	CAAttrOpt *CAAttrOption
+
+	// gateway connections kept for chaincode proxy, nil means default limits
+	GatewayPoolOpt *GatewayPoolOption
+
+	// if it's set, Init enrolls registrar and creates the first admin, see BootstrapOption
+	// it's the supported way if UserStore, PasswdHashOpt, PasswdPolicyOpt or CAAttrOpt is set,
+	// bootstrap command only knows default options
+	BootstrapOpt *BootstrapOption
+}
+
+const (
+	defaultCertRenewWindowHours  = 7 * 24
+	defaultCertRenewCheckMinutes = 60
+)
+
+type CertRenewOption struct {
+	// certificate expiring within this window is renewed, unit is hour, default is 168
+	WindowHours int
+
+	// how often certificates are checked, unit is minute, default is 60
+	CheckMinutes int
+}
+
+func (o *CertRenewOption) Window() time.Duration {
+	if o == nil || o.WindowHours <= 0 {
+		return defaultCertRenewWindowHours * time.Hour
+	}
+	return time.Duration(o.WindowHours) * time.Hour
+}
+
+func (o *CertRenewOption) CheckInterval() time.Duration {
+	if o == nil || o.CheckMinutes <= 0 {
+		return defaultCertRenewCheckMinutes * time.Minute
+	}
+	return time.Duration(o.CheckMinutes) * time.Minute
+}
+
+// BootstrapOption creates the first app admin, it's done once, later runs change nothing
+// registrar is always enrolled into wallet if it's not there
+type BootstrapOption struct {
+	// app admin account, it's registered in ca like other users
+	// empty username means only registrar is enrolled
+	AdminUsername string
+	AdminPasswd   string
+}
+
+type ReconcileOption struct {
+	// how often reconciliation runs, unit is minute, default is 60
+	IntervalMinutes int
+
+	// repair mismatches found by scheduled run, default is only report them
+	// orphan ca identities are never removed by scheduled run, admin removes them by reconcile api
+	Repair bool
+
+	// ca identities not managed by this service, they are never reported
+	// registrar, peer and orderer identities are always ignored
+	IgnoreIdentities []string
+}
+
+type UserDeleteOption struct {
+	// deleted user is kept for this long before it's purged, unit is hour
+	// zero means user is hard deleted at once
+	RetentionHours int
+
+	// how often soft deleted users are checked, unit is minute, default is 60
+	PurgeCheckMinutes int
+}
+
+func (o *UserDeleteOption) Retention() time.Duration {
+	if o == nil || o.RetentionHours <= 0 {
+		return 0
+	}
+	return time.Duration(o.RetentionHours) * time.Hour
+}
+
+type OAuth2Option struct {
+	// clients allowed to call introspection endpoint
+	Clients []*OAuth2Client
+}
+
+type OAuth2Client struct {
+	ClientId     string
+	ClientSecret string
 }
 
 type FabricCARegistrar struct {
@@ -28,10 +147,134 @@ type FabricGWOption struct {
 	// file type fabric wallet path
 	WalletPath string
 
+	// wallet backend, file(default), couchdb or memory
+	// memory is only for tests, identities are lost after restart
+	WalletBackend string
+
+	// 32 bytes AES-256 key, if it's set, file and couchdb wallets encrypt identities
+	// each identity is encrypted by its own data key, which is encrypted by this key
+	WalletMasterKey []byte
+
+	// migration only, identities saved before WalletMasterKey is set are read and encrypted at once
+	// without it, they are rejected
+	WalletAllowPlaintext bool
+
 	OrgName string
 }
 
+const (
+	defaultAccessExpireMinutes = 15
+	defaultRefreshExpireHours  = 7 * 24
+)
+
 type JWTOption struct {
 	Secret      []byte
-	ExpireHours int // unit is hour
+	ExpireHours int // deprecated, it isn't used since access token has its own lifetime
+
+	// signing algorithm, HS256/RS256/ES256/EdDSA, default is HS256 with Secret
+	Algorithm string
+
+	// PEM encoded private key, used by RS256/ES256/EdDSA
+	PrivateKey []byte
+
+	// kid in token header, if it's empty
+	// asymmetric key uses its RFC 7638 thumbprint, HS256 uses "default"
+	KeyId string
+
+	// access token lifetime, unit is minute
+	// if it's zero, default value is 15 minutes, long sessions use refresh token
+	AccessExpireMinutes int
+
+	// refresh token lifetime, unit is hour
+	// if it's zero, default value is 7 days
+	RefreshExpireHours int
+
+	// how long a token revocation lookup result is cached, unit is second
+	// if it's zero, default value is 30 seconds
+	RevocationCacheSeconds int
+
+	// key ring holds one active signing key and several verify-only keys
+	// if it's nil, a ring with the key built from Secret/Algorithm/PrivateKey is used
+	KeyRing *KeyRing
+
+	// scheduled signing key rotation, nil means keys are never rotated
+	KeyRotation *KeyRotationOption
+
+	keyOnce    sync.Once
+	signingKey *JWTKey
+	keyErr     error
+	ringOnce   sync.Once
+}
+
+type KeyRotationOption struct {
+	// algorithm of generated keys, default is the current active key's algorithm
+	Algorithm string
+
+	// active key is replaced after this, unit is hour
+	IntervalHours int
+
+	// a replaced key is still used to verify tokens for this long, unit is hour
+	// it should not be shorter than access token lifetime, which is the default value
+	RetainHours int
+
+	// how often rotation is checked and keys are reloaded from db, unit is minute
+	// default is 5 minutes
+	CheckMinutes int
+
+	// AES key(16, 24 or 32 bytes) to encrypt generated keys saved in db
+	// if it's empty, keys are saved as plain text
+	EncryptKey []byte
+}
+
+// Ring returns the key ring, it's created from config key if KeyRing is nil
+func (j *JWTOption) Ring() *KeyRing {
+	j.ringOnce.Do(func() {
+		if j.KeyRing == nil {
+			j.KeyRing = NewKeyRing()
+		}
+		// config key is optional when keys are generated by rotation
+		if key, err := j.SigningKey(); err == nil && j.KeyRing.Get(key.Id) == nil {
+			j.KeyRing.Add(key, false)
+		}
+	})
+	return j.KeyRing
+}
+
+func (j *JWTOption) RetainTTL() time.Duration {
+	if j.KeyRotation != nil && j.KeyRotation.RetainHours > 0 {
+		return time.Duration(j.KeyRotation.RetainHours) * time.Hour
+	}
+	return j.AccessTokenTTL()
+}
+
+// SigningKey returns the key built from Secret/Algorithm/PrivateKey
+// it's parsed only once
+func (j *JWTOption) SigningKey() (*JWTKey, error) {
+	j.keyOnce.Do(func() {
+		key := &JWTKey{
+			Id:         j.KeyId,
+			Algorithm:  j.Algorithm,
+			Secret:     j.Secret,
+			PrivateKey: j.PrivateKey,
+		}
+		j.keyErr = key.Load()
+		if j.keyErr == nil {
+			j.signingKey = key
+		}
+	})
+	return j.signingKey, j.keyErr
+}
+
+func (j *JWTOption) AccessTokenTTL() time.Duration {
+	if j.AccessExpireMinutes > 0 {
+		return time.Duration(j.AccessExpireMinutes) * time.Minute
+	}
+	return defaultAccessExpireMinutes * time.Minute
+}
+
+func (j *JWTOption) RefreshTokenTTL() time.Duration {
+	if j.RefreshExpireHours > 0 {
+		return time.Duration(j.RefreshExpireHours) * time.Hour
+	}
+	return defaultRefreshExpireHours * time.Hour
 }
@@ -0,0 +1,290 @@
+package model
+
+import (
+	"bufio"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	defaultPasswdMinLength = 8
+	defaultPasswdMaxLength = 128
+
+	tempPasswdLen = 16
+)
+
+var ErrTempPasswdPolicy = errors.New("can't generate a temporary password which meets password policy")
+
+// violation codes returned to client
+const (
+	PasswdViolationTooShort  = "too_short"
+	PasswdViolationTooLong   = "too_long"
+	PasswdViolationNoUpper   = "no_upper"
+	PasswdViolationNoLower   = "no_lower"
+	PasswdViolationNoDigit   = "no_digit"
+	PasswdViolationNoSymbol  = "no_symbol"
+	PasswdViolationReused    = "reused"
+	PasswdViolationDenied    = "denied"
+	PasswdViolationMalformed = "invalid_utf8"
+)
+
+type PasswdPolicyOption struct {
+	// length is counted in characters, default is 8 to 128
+	// if policy is nil, only empty and too long passwords are denied
+	MinLength int
+	MaxLength int
+
+	// required character classes
+	RequireUpper  bool
+	RequireLower  bool
+	RequireDigit  bool
+	RequireSymbol bool
+
+	// new password can't be the same as the last N passwords, current one included
+	HistoryCount int
+
+	// local file of common passwords, one per line, compared case-insensitively
+	DenyListPath string
+
+	denyOnce sync.Once
+	denyList map[string]struct{}
+	denyErr  error
+}
+
+type PasswdViolation struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// PasswdPolicyError holds all violations of a password
+type PasswdPolicyError struct {
+	Violations []*PasswdViolation `json:"violations"`
+}
+
+func (e *PasswdPolicyError) Error() string {
+	msgs := make([]string, 0, len(e.Violations))
+	for _, v := range e.Violations {
+		msgs = append(msgs, v.Message)
+	}
+	return "password doesn't meet policy: " + strings.Join(msgs, "; ")
+}
+
+func (e *PasswdPolicyError) add(code, format string, args ...interface{}) {
+	e.Violations = append(e.Violations, &PasswdViolation{
+		Code:    code,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+func (p *PasswdPolicyOption) minLength() int {
+	if p == nil {
+		return 1
+	}
+	if p.MinLength <= 0 {
+		return defaultPasswdMinLength
+	}
+	return p.MinLength
+}
+
+func (p *PasswdPolicyOption) maxLength() int {
+	if p == nil || p.MaxLength <= 0 {
+		return defaultPasswdMaxLength
+	}
+	return p.MaxLength
+}
+
+// LoadDenyList reads deny list file, it's read only once
+func (p *PasswdPolicyOption) LoadDenyList() error {
+	if p == nil || p.DenyListPath == "" {
+		return nil
+	}
+
+	p.denyOnce.Do(func() {
+		f, err := os.Open(p.DenyListPath)
+		if err != nil {
+			p.denyErr = err
+			return
+		}
+		defer f.Close()
+
+		list := make(map[string]struct{})
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			list[strings.ToLower(line)] = struct{}{}
+		}
+		if err = scanner.Err(); err != nil {
+			p.denyErr = err
+			return
+		}
+		p.denyList = list
+	})
+	return p.denyErr
+}
+
+// Check returns *PasswdPolicyError if passwd violates policy
+// user is optional, if it's not nil, its current and previous hashes are checked
+func (p *PasswdPolicyOption) Check(passwd string, user *UserAccount) error {
+	verr := &PasswdPolicyError{}
+
+	if !utf8.ValidString(passwd) {
+		verr.add(PasswdViolationMalformed, "password must be valid utf-8 text")
+		return verr
+	}
+
+	length := utf8.RuneCountInString(passwd)
+	if min := p.minLength(); length < min {
+		verr.add(PasswdViolationTooShort, "password must be at least %d characters", min)
+	}
+	if max := p.maxLength(); length > max {
+		verr.add(PasswdViolationTooLong, "password must be at most %d characters", max)
+	}
+
+	if p != nil {
+		var upper, lower, digit, symbol bool
+		for _, r := range passwd {
+			switch {
+			case unicode.IsUpper(r):
+				upper = true
+			case unicode.IsLower(r):
+				lower = true
+			case unicode.IsDigit(r):
+				digit = true
+			case unicode.IsPunct(r) || unicode.IsSymbol(r) || unicode.IsSpace(r):
+				symbol = true
+			}
+		}
+		if p.RequireUpper && !upper {
+			verr.add(PasswdViolationNoUpper, "password must contain an uppercase letter")
+		}
+		if p.RequireLower && !lower {
+			verr.add(PasswdViolationNoLower, "password must contain a lowercase letter")
+		}
+		if p.RequireDigit && !digit {
+			verr.add(PasswdViolationNoDigit, "password must contain a digit")
+		}
+		if p.RequireSymbol && !symbol {
+			verr.add(PasswdViolationNoSymbol, "password must contain a symbol")
+		}
+	}
+
+	if p != nil && p.DenyListPath != "" {
+		if err := p.LoadDenyList(); err != nil {
+			return err
+		}
+		if _, ok := p.denyList[strings.ToLower(passwd)]; ok {
+			verr.add(PasswdViolationDenied, "password is too common")
+		}
+	}
+
+	if user != nil && p.isReused(passwd, user) {
+		verr.add(PasswdViolationReused, "password must not be the same as the last %d passwords", p.HistoryCount)
+	}
+
+	if len(verr.Violations) > 0 {
+		return verr
+	}
+	return nil
+}
+
+// isReused checks the last N passwords, current password is the first one
+func (p *PasswdPolicyOption) isReused(passwd string, user *UserAccount) bool {
+	if p == nil || p.HistoryCount <= 0 {
+		return false
+	}
+
+	if user.IsPasswdEqual(passwd) {
+		return true
+	}
+
+	history := user.PasswdHistory
+	if len(history) > p.HistoryCount-1 {
+		history = history[:p.HistoryCount-1]
+	}
+	for _, hash := range history {
+		if ok, _ := VerifyPasswd(hash, passwd); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// historySize returns how many previous hashes should be kept besides current one
+func (p *PasswdPolicyOption) historySize() int {
+	if p == nil || p.HistoryCount <= 1 {
+		return 0
+	}
+	return p.HistoryCount - 1
+}
+
+// GenerateTempPasswd returns a random password which meets the policy
+// it has upper, lower, digit and symbol, and is at least 16 characters or policy's min length
+func (p *PasswdPolicyOption) GenerateTempPasswd() (string, error) {
+	length := tempPasswdLen
+	if min := p.minLength(); length < min {
+		length = min
+	}
+	if max := p.maxLength(); length > max {
+		length = max
+	}
+
+	// deny list may reject a random password, though it's unlikely
+	for i := 0; i < 5; i++ {
+		passwd, err := randomPasswd(length)
+		if err != nil {
+			return "", err
+		}
+		if p.Check(passwd, nil) == nil {
+			return passwd, nil
+		}
+	}
+	return "", ErrTempPasswdPolicy
+}
+
+func randomPasswd(length int) (string, error) {
+	classes := []string{
+		"ABCDEFGHJKLMNPQRSTUVWXYZ",
+		"abcdefghijkmnopqrstuvwxyz",
+		"23456789",
+		"!@#$%^&*-_=+",
+	}
+	all := ""
+	for _, c := range classes {
+		all += c
+	}
+
+	buf := make([]byte, length)
+	for i := range buf {
+		chars := all
+		if i < len(classes) {
+			chars = classes[i]
+		}
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(chars))))
+		if err != nil {
+			return "", err
+		}
+		buf[i] = chars[n.Int64()]
+	}
+
+	// move the required chars to random positions
+	for i := len(buf) - 1; i > 0; i-- {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(i+1)))
+		if err != nil {
+			return "", err
+		}
+		j := n.Int64()
+		buf[i], buf[j] = buf[j], buf[i]
+	}
+
+	return string(buf), nil
+}
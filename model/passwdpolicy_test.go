@@ -0,0 +1,106 @@
+package model
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func violationCodes(err error) map[string]bool {
+	codes := make(map[string]bool)
+	if verr, ok := err.(*PasswdPolicyError); ok {
+		for _, v := range verr.Violations {
+			codes[v.Code] = true
+		}
+	}
+	return codes
+}
+
+func TestPasswdPolicyCheck(t *testing.T) {
+	f, err := ioutil.TempFile("", "denylist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("# common passwords\nPassword1!\n")
+	f.Close()
+
+	policy := &PasswdPolicyOption{
+		MinLength:     8,
+		MaxLength:     16,
+		RequireUpper:  true,
+		RequireLower:  true,
+		RequireDigit:  true,
+		RequireSymbol: true,
+		DenyListPath:  f.Name(),
+	}
+
+	codes := violationCodes(policy.Check("abc", nil))
+	for _, code := range []string{PasswdViolationTooShort, PasswdViolationNoUpper, PasswdViolationNoDigit, PasswdViolationNoSymbol} {
+		if !codes[code] {
+			t.Error("expect violation", code)
+		}
+	}
+	if codes[PasswdViolationNoLower] {
+		t.Error("unexpected violation", PasswdViolationNoLower)
+	}
+
+	if !violationCodes(policy.Check("password1!", nil))[PasswdViolationDenied] {
+		t.Error("common password should be denied")
+	}
+
+	if err = policy.Check("Correct horse 9", nil); err != nil {
+		t.Error("space counts as symbol", err)
+	}
+
+	if err = (*PasswdPolicyOption)(nil).Check("a", nil); err != nil {
+		t.Error("nil policy only denies empty password", err)
+	}
+	if err = (*PasswdPolicyOption)(nil).Check("", nil); err == nil {
+		t.Error("nil policy should deny empty password")
+	}
+}
+
+func TestPasswdPolicyHistory(t *testing.T) {
+	hashOpt := &PasswdHashOption{Algorithm: PasswdAlgBcrypt, BcryptCost: 4}
+	policy := &PasswdPolicyOption{HistoryCount: 3}
+
+	user := &UserAccount{}
+	for _, pw := range []string{"first-pass", "second-pass", "third-pass", "fourth-pass"} {
+		if err := user.ChangePasswd(hashOpt, policy, pw); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(user.PasswdHistory) != 2 {
+		t.Fatal("expect 2 previous hashes, got", len(user.PasswdHistory))
+	}
+
+	for _, pw := range []string{"fourth-pass", "third-pass", "second-pass"} {
+		if !violationCodes(policy.Check(pw, user))[PasswdViolationReused] {
+			t.Error("reused password should be denied", pw)
+		}
+	}
+	if err := policy.Check("first-pass", user); err != nil {
+		t.Error("password older than history should be allowed", err)
+	}
+}
+
+func TestGenerateTempPasswd(t *testing.T) {
+	policy := &PasswdPolicyOption{
+		MinLength:     24,
+		RequireUpper:  true,
+		RequireLower:  true,
+		RequireDigit:  true,
+		RequireSymbol: true,
+	}
+	passwd, err := policy.GenerateTempPasswd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(passwd) != 24 {
+		t.Fatalf("unexpected length %d", len(passwd))
+	}
+	if err = policy.Check(passwd, nil); err != nil {
+		t.Fatalf("temporary password doesn't meet policy, %v", err)
+	}
+}
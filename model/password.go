@@ -0,0 +1,176 @@
+package model
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"strings"
+)
+
+const (
+	PasswdAlgArgon2id = "argon2id"
+	PasswdAlgBcrypt   = "bcrypt"
+)
+
+const (
+	defaultArgon2Time    = 3
+	defaultArgon2Memory  = 64 * 1024 // KiB
+	defaultArgon2Threads = 2
+	defaultBcryptCost    = 12
+
+	argon2SaltLen = 16
+	argon2KeyLen  = 32
+
+	// bcrypt only uses the first 72 bytes, longer passwords are rejected instead of truncated
+	bcryptMaxPasswdBytes = 72
+)
+
+var (
+	ErrInvalidPasswdHash   = errors.New("invalid password hash")
+	ErrBcryptPasswdTooLong = errors.New("password is longer than 72 bytes, bcrypt can't hash it")
+)
+
+type PasswdHashOption struct {
+	// argon2id or bcrypt, default is argon2id
+	Algorithm string
+
+	// argon2id cost
+	Argon2Time    uint32
+	Argon2Memory  uint32 // unit is KiB
+	Argon2Threads uint8
+
+	// bcrypt cost
+	BcryptCost int
+}
+
+func (o *PasswdHashOption) withDefault() *PasswdHashOption {
+	opt := PasswdHashOption{}
+	if o != nil {
+		opt = *o
+	}
+	if opt.Algorithm == "" {
+		opt.Algorithm = PasswdAlgArgon2id
+	}
+	if opt.Argon2Time == 0 {
+		opt.Argon2Time = defaultArgon2Time
+	}
+	if opt.Argon2Memory == 0 {
+		opt.Argon2Memory = defaultArgon2Memory
+	}
+	if opt.Argon2Threads == 0 {
+		opt.Argon2Threads = defaultArgon2Threads
+	}
+	if opt.BcryptCost == 0 {
+		opt.BcryptCost = defaultBcryptCost
+	}
+	return &opt
+}
+
+// HashPasswd returns PHC string format hash
+// argon2id: $argon2id$v=19$m=65536,t=3,p=2$<salt>$<hash>
+// bcrypt uses its own modular crypt format: $2a$12$...
+func HashPasswd(o *PasswdHashOption, passwd string) (string, error) {
+	opt := o.withDefault()
+	switch opt.Algorithm {
+	case PasswdAlgArgon2id:
+		salt := make([]byte, argon2SaltLen)
+		if _, err := rand.Read(salt); err != nil {
+			return "", err
+		}
+		hash := argon2.IDKey([]byte(passwd), salt, opt.Argon2Time, opt.Argon2Memory, opt.Argon2Threads, argon2KeyLen)
+		return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+			argon2.Version, opt.Argon2Memory, opt.Argon2Time, opt.Argon2Threads,
+			base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(hash)), nil
+	case PasswdAlgBcrypt:
+		if len(passwd) > bcryptMaxPasswdBytes {
+			return "", ErrBcryptPasswdTooLong
+		}
+		hash, err := bcrypt.GenerateFromPassword([]byte(passwd), opt.BcryptCost)
+		if err != nil {
+			return "", err
+		}
+		return string(hash), nil
+	}
+	return "", fmt.Errorf("unsupported password hash algorithm: %s", opt.Algorithm)
+}
+
+// VerifyPasswd compares passwd with hash in constant time
+func VerifyPasswd(hash, passwd string) (bool, error) {
+	if strings.HasPrefix(hash, "$argon2id$") {
+		params, salt, key, err := parseArgon2Hash(hash)
+		if err != nil {
+			return false, err
+		}
+		other := argon2.IDKey([]byte(passwd), salt, params.Argon2Time, params.Argon2Memory, params.Argon2Threads, uint32(len(key)))
+		return subtle.ConstantTimeCompare(key, other) == 1, nil
+	}
+
+	if strings.HasPrefix(hash, "$2") {
+		// bcrypt truncates it, two passwords with the same first 72 bytes would both match
+		if len(passwd) > bcryptMaxPasswdBytes {
+			return false, nil
+		}
+		err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(passwd))
+		if err == bcrypt.ErrMismatchedHashAndPassword {
+			return false, nil
+		}
+		return err == nil, err
+	}
+
+	return false, ErrInvalidPasswdHash
+}
+
+// passwdNeedsRehash reports if hash is not created by current algorithm and cost
+func passwdNeedsRehash(o *PasswdHashOption, hash string) bool {
+	opt := o.withDefault()
+	switch opt.Algorithm {
+	case PasswdAlgArgon2id:
+		params, _, _, err := parseArgon2Hash(hash)
+		if err != nil {
+			return true
+		}
+		return params.Argon2Time != opt.Argon2Time ||
+			params.Argon2Memory != opt.Argon2Memory ||
+			params.Argon2Threads != opt.Argon2Threads
+	case PasswdAlgBcrypt:
+		cost, err := bcrypt.Cost([]byte(hash))
+		if err != nil {
+			return true
+		}
+		return cost != opt.BcryptCost
+	}
+	return false
+}
+
+func parseArgon2Hash(hash string) (*PasswdHashOption, []byte, []byte, error) {
+	// "", "argon2id", "v=19", "m=65536,t=3,p=2", salt, hash
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return nil, nil, nil, ErrInvalidPasswdHash
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return nil, nil, nil, ErrInvalidPasswdHash
+	}
+
+	params := &PasswdHashOption{Algorithm: PasswdAlgArgon2id}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Argon2Memory, &params.Argon2Time, &params.Argon2Threads); err != nil {
+		return nil, nil, nil, ErrInvalidPasswdHash
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return nil, nil, nil, ErrInvalidPasswdHash
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return nil, nil, nil, ErrInvalidPasswdHash
+	}
+
+	return params, salt, key, nil
+}
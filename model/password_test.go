@@ -0,0 +1,78 @@
+package model
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestHashPasswd(t *testing.T) {
+	opts := []*PasswdHashOption{
+		nil,
+		{Algorithm: PasswdAlgArgon2id, Argon2Time: 1, Argon2Memory: 8 * 1024, Argon2Threads: 1},
+		{Algorithm: PasswdAlgBcrypt, BcryptCost: 4},
+	}
+
+	for _, opt := range opts {
+		hash, err := HashPasswd(opt, "p@ss word")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ok, err := VerifyPasswd(hash, "p@ss word")
+		if err != nil || !ok {
+			t.Fatal("right password should match", hash, err)
+		}
+		ok, err = VerifyPasswd(hash, "p@ssword")
+		if err != nil || ok {
+			t.Fatal("wrong password should not match", hash, err)
+		}
+
+		if passwdNeedsRehash(opt, hash) {
+			t.Fatal("hash created by same option should not need rehash", hash)
+		}
+	}
+}
+
+func TestUserAccountRehash(t *testing.T) {
+	ua := &UserAccount{Salt: "20210101000000"}
+	ua.PassHash = ua.CreatePassHash("passwd", ua.Salt)
+
+	if !ua.IsPasswdEqual("passwd") || ua.IsPasswdEqual("other") {
+		t.Fatal("legacy hash verify failed")
+	}
+	if !ua.NeedsRehash(nil) {
+		t.Fatal("legacy hash should need rehash")
+	}
+
+	bcryptOpt := &PasswdHashOption{Algorithm: PasswdAlgBcrypt, BcryptCost: 4}
+	if err := ua.SetPasswd(bcryptOpt, "passwd"); err != nil {
+		t.Fatal(err)
+	}
+	if ua.PassHash != "" || ua.Salt != "" || !strings.HasPrefix(ua.PHCHash, "$2") {
+		t.Fatal("legacy hash should be replaced")
+	}
+	if !ua.IsPasswdEqual("passwd") {
+		t.Fatal("new hash verify failed")
+	}
+
+	// cost changed
+	if !ua.NeedsRehash(&PasswdHashOption{Algorithm: PasswdAlgBcrypt, BcryptCost: 5}) {
+		t.Fatal("hash with old cost should need rehash")
+	}
+}
+
+func TestBcryptLongPasswd(t *testing.T) {
+	opt := &PasswdHashOption{Algorithm: PasswdAlgBcrypt, BcryptCost: 4}
+	prefix := strings.Repeat("a", 72)
+	if _, err := HashPasswd(opt, prefix+"b"); err != ErrBcryptPasswdTooLong {
+		t.Fatalf("expect too long error, got %v", err)
+	}
+
+	hash, err := HashPasswd(opt, prefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := VerifyPasswd(hash, prefix+"c"); ok {
+		t.Fatal("password longer than 72 bytes should not match truncated hash")
+	}
+}
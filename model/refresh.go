@@ -0,0 +1,111 @@
+package model
+
+import (
+	"encoding/json"
+	"github.com/leyle/go-api-starter/couchdb"
+	"github.com/leyle/go-api-starter/util"
+)
+
+const DBNameRefreshToken = "refreshtoken"
+
+// refresh token value is an opaque random string
+// we only save its sha256 value as doc id, so a leaked db can't be used to refresh tokens
+// all refresh tokens created from one login share the same FamilyId
+type RefreshToken struct {
+	Id        string        `json:"id"`
+	Rev       string        `json:"_rev,omitempty"`
+	FamilyId  string        `json:"familyId"`
+	UserId    string        `json:"userId"`
+	Username  string        `json:"username"`
+	Used      bool          `json:"used"`
+	Revoked   bool          `json:"revoked"`
+	ExpiresAt int64         `json:"expiresAt"`
+	Created   *util.CurTime `json:"created"`
+	Updated   *util.CurTime `json:"updated"`
+}
+
+func (rt *RefreshToken) IsExpired() bool {
+	return util.CurUnixTime() >= rt.ExpiresAt
+}
+
+func GetRefreshToken(ctx *JWTContext, id string) (*RefreshToken, error) {
+	var rt *RefreshToken
+	_, err := ctx.Ds(DBNameRefreshToken).GetById(ctx.Context(), id, &rt)
+	if err != nil {
+		if err == couchdb.NoIdData {
+			return nil, nil
+		}
+		ctx.Logger().Error().Err(err).Msg("GetRefreshToken failed")
+		return nil, err
+	}
+
+	return rt, nil
+}
+
+func SaveRefreshToken(ctx *JWTContext, rt *RefreshToken) error {
+	data, _ := json.Marshal(rt)
+	err := ctx.Ds(DBNameRefreshToken).CreateDoc(ctx.Context(), rt.Id, data)
+	if err != nil {
+		ctx.Logger().Error().Err(err).Str("userId", rt.UserId).Msg("SaveRefreshToken failed")
+		return err
+	}
+	return nil
+}
+
+func UpdateRefreshToken(ctx *JWTContext, rt *RefreshToken) error {
+	rt.Updated = util.GetCurTime()
+	rev, err := updateDoc(ctx, DBNameRefreshToken, rt.Id, rt)
+	if err != nil {
+		ctx.Logger().Error().Err(err).Str("familyId", rt.FamilyId).Msg("UpdateRefreshToken failed")
+		return err
+	}
+	rt.Rev = rev
+	return nil
+}
+
+// used and revoked tokens are not returned, revoking the family only needs live tokens
+func GetActiveRefreshTokensByFamily(ctx *JWTContext, familyId string) ([]*RefreshToken, error) {
+	selector := map[string]interface{}{
+		"familyId": familyId,
+		"used":     false,
+		"revoked":  false,
+	}
+	return searchRefreshTokens(ctx, selector)
+}
+
+// used tokens are not returned, they can't be refreshed anymore
+func GetActiveRefreshTokensByUser(ctx *JWTContext, userId string) ([]*RefreshToken, error) {
+	selector := map[string]interface{}{
+		"userId":  userId,
+		"used":    false,
+		"revoked": false,
+	}
+	return searchRefreshTokens(ctx, selector)
+}
+
+// searchRefreshTokens returns all matched tokens, pages are read by bookmark
+func searchRefreshTokens(ctx *JWTContext, selector interface{}) ([]*RefreshToken, error) {
+	const pageSize = 200
+	req := &couchDBFindRequest{
+		Selector: selector,
+		Limit:    pageSize,
+	}
+
+	var rts []*RefreshToken
+	for {
+		var resp struct {
+			Docs []*RefreshToken `json:"docs"`
+		}
+		bookmark, err := couchDBFind(ctx.Context(), ctx.Opt.CouchDBOpt, DBNameRefreshToken, req, &resp)
+		if err != nil {
+			ctx.Logger().Error().Err(err).Msg("search refresh tokens failed")
+			return nil, err
+		}
+		rts = append(rts, resp.Docs...)
+		if len(resp.Docs) < pageSize || bookmark == "" {
+			break
+		}
+		req.Bookmark = bookmark
+	}
+	return rts, nil
+}
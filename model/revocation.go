@@ -0,0 +1,237 @@
+package model
+
+import (
+	"encoding/json"
+	"github.com/leyle/go-api-starter/couchdb"
+	"github.com/leyle/go-api-starter/util"
+	"sync"
+	"time"
+)
+
+const DBNameTokenRevocation = "tokenrevocation"
+
+const (
+	RevocationTypeToken = "token"
+	RevocationTypeUser  = "user"
+)
+
+// a single revoked token, doc id is the token's jti
+type RevokedToken struct {
+	Id        string        `json:"id"`
+	Rev       string        `json:"_rev,omitempty"`
+	Type      string        `json:"type"`
+	UserId    string        `json:"userId"`
+	ExpiresAt int64         `json:"expiresAt"`
+	Created   *util.CurTime `json:"created"`
+}
+
+// all tokens of the user issued at or before Cutoff are revoked, except KeepTokenId
+// doc id is cutoffDocId(userId)
+type TokenCutoff struct {
+	Id     string `json:"id"`
+	Rev    string `json:"_rev,omitempty"`
+	Type   string `json:"type"`
+	UserId string `json:"userId"`
+	Cutoff int64  `json:"cutoff"`
+
+	// jti of the token issued together with the revocation, e.g. by password change
+	KeepTokenId string `json:"keepTokenId,omitempty"`
+
+	Created *util.CurTime `json:"created"`
+	Updated *util.CurTime `json:"updated"`
+}
+
+func cutoffDocId(userId string) string {
+	return "cutoff-" + userId
+}
+
+func GetRevokedToken(ctx *JWTContext, jti string) (*RevokedToken, error) {
+	var rt *RevokedToken
+	_, err := ctx.Ds(DBNameTokenRevocation).GetById(ctx.Context(), jti, &rt)
+	if err != nil {
+		if err == couchdb.NoIdData {
+			return nil, nil
+		}
+		ctx.Logger().Error().Err(err).Str("jti", jti).Msg("GetRevokedToken failed")
+		return nil, err
+	}
+	return rt, nil
+}
+
+func SaveRevokedToken(ctx *JWTContext, rt *RevokedToken) error {
+	rt.Type = RevocationTypeToken
+	data, _ := json.Marshal(rt)
+	err := ctx.Ds(DBNameTokenRevocation).CreateDoc(ctx.Context(), rt.Id, data)
+	if err != nil {
+		ctx.Logger().Error().Err(err).Str("jti", rt.Id).Msg("SaveRevokedToken failed")
+		return err
+	}
+	return nil
+}
+
+func GetTokenCutoff(ctx *JWTContext, userId string) (*TokenCutoff, error) {
+	var tc *TokenCutoff
+	_, err := ctx.Ds(DBNameTokenRevocation).GetById(ctx.Context(), cutoffDocId(userId), &tc)
+	if err != nil {
+		if err == couchdb.NoIdData {
+			return nil, nil
+		}
+		ctx.Logger().Error().Err(err).Str("userId", userId).Msg("GetTokenCutoff failed")
+		return nil, err
+	}
+	return tc, nil
+}
+
+// SaveTokenCutoff creates or moves forward the user's cutoff time
+// keepTokenId is optional, the token with this jti isn't revoked by the cutoff
+func SaveTokenCutoff(ctx *JWTContext, userId string, cutoff int64, keepTokenId string) error {
+	tc, err := GetTokenCutoff(ctx, userId)
+	if err != nil {
+		return err
+	}
+
+	if tc == nil {
+		tc = &TokenCutoff{
+			Id:          cutoffDocId(userId),
+			Type:        RevocationTypeUser,
+			UserId:      userId,
+			Cutoff:      cutoff,
+			KeepTokenId: keepTokenId,
+			Created:     util.GetCurTime(),
+		}
+		tc.Updated = tc.Created
+		data, _ := json.Marshal(tc)
+		err = ctx.Ds(DBNameTokenRevocation).CreateDoc(ctx.Context(), tc.Id, data)
+	} else {
+		// a later revocation in the same second also revokes the token kept by the former one
+		if tc.Cutoff > cutoff || (tc.Cutoff == cutoff && tc.KeepTokenId == keepTokenId) {
+			return nil
+		}
+		tc.Cutoff = cutoff
+		tc.KeepTokenId = keepTokenId
+		tc.Updated = util.GetCurTime()
+		_, err = updateDoc(ctx, DBNameTokenRevocation, tc.Id, tc)
+	}
+	if err != nil {
+		ctx.Logger().Error().Err(err).Str("userId", userId).Msg("SaveTokenCutoff failed")
+		return err
+	}
+	return nil
+}
+
+const defaultRevocationCacheTTL = 30 * time.Second
+
+// RevocationCache keeps revocation lookups in memory
+// a revoked token is remembered until it expires
+// a "not revoked" result and user cutoff are trusted for ttl, then db is checked again,
+// so revocations from other instances are picked up in at most ttl
+// all methods are safe on a nil cache, they just report cache miss
+type RevocationCache struct {
+	mu      sync.RWMutex
+	ttl     time.Duration
+	tokens  map[string]*revocationEntry
+	cutoffs map[string]*revocationEntry
+}
+
+type revocationEntry struct {
+	// for token, value is expiresAt when revoked
+	// for user, value is cutoff, keep is the jti not revoked by it
+	value   int64
+	keep    string
+	revoked bool
+	checked time.Time
+}
+
+func NewRevocationCache(ttl time.Duration) *RevocationCache {
+	if ttl <= 0 {
+		ttl = defaultRevocationCacheTTL
+	}
+	return &RevocationCache{
+		ttl:     ttl,
+		tokens:  make(map[string]*revocationEntry),
+		cutoffs: make(map[string]*revocationEntry),
+	}
+}
+
+// TokenRevoked returns revoked flag and if the cached result can be used
+func (rc *RevocationCache) TokenRevoked(jti string) (revoked, ok bool) {
+	if rc == nil {
+		return false, false
+	}
+	rc.mu.RLock()
+	defer rc.mu.RUnlock()
+	e, exist := rc.tokens[jti]
+	if !exist {
+		return false, false
+	}
+	if e.revoked {
+		return true, true
+	}
+	return false, time.Since(e.checked) < rc.ttl
+}
+
+func (rc *RevocationCache) SetToken(jti string, revoked bool, expiresAt int64) {
+	if rc == nil {
+		return
+	}
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.purge()
+	rc.tokens[jti] = &revocationEntry{
+		value:   expiresAt,
+		revoked: revoked,
+		checked: time.Now(),
+	}
+}
+
+// UserCutoff returns user's cutoff, the jti kept by it, and if the cached result can be used
+func (rc *RevocationCache) UserCutoff(userId string) (cutoff int64, keepTokenId string, ok bool) {
+	if rc == nil {
+		return 0, "", false
+	}
+	rc.mu.RLock()
+	defer rc.mu.RUnlock()
+	e, exist := rc.cutoffs[userId]
+	if !exist || time.Since(e.checked) >= rc.ttl {
+		return 0, "", false
+	}
+	return e.value, e.keep, true
+}
+
+func (rc *RevocationCache) SetUserCutoff(userId string, cutoff int64, keepTokenId string) {
+	if rc == nil {
+		return
+	}
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.purge()
+	rc.cutoffs[userId] = &revocationEntry{
+		value:   cutoff,
+		keep:    keepTokenId,
+		checked: time.Now(),
+	}
+}
+
+// purge drops expired entries, caller must hold the lock
+func (rc *RevocationCache) purge() {
+	const purgeThreshold = 10000
+	if len(rc.tokens)+len(rc.cutoffs) < purgeThreshold {
+		return
+	}
+
+	now := time.Now()
+	for k, e := range rc.tokens {
+		if e.revoked && now.Unix() < e.value {
+			continue
+		}
+		if !e.revoked && now.Sub(e.checked) < rc.ttl {
+			continue
+		}
+		delete(rc.tokens, k)
+	}
+	for k, e := range rc.cutoffs {
+		if now.Sub(e.checked) >= rc.ttl {
+			delete(rc.cutoffs, k)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package model
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRevocationCache(t *testing.T) {
+	rc := NewRevocationCache(50 * time.Millisecond)
+
+	if _, ok := rc.TokenRevoked("jti"); ok {
+		t.Fatal("empty cache should miss")
+	}
+
+	rc.SetToken("jti", false, time.Now().Add(time.Hour).Unix())
+	revoked, ok := rc.TokenRevoked("jti")
+	if !ok || revoked {
+		t.Fatal("not revoked result should be cached")
+	}
+
+	rc.SetToken("revoked", true, time.Now().Add(time.Hour).Unix())
+	rc.SetUserCutoff("user", 100, "kept")
+	if cutoff, keep, ok := rc.UserCutoff("user"); !ok || cutoff != 100 || keep != "kept" {
+		t.Fatal("user cutoff should be cached")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+
+	if _, ok = rc.TokenRevoked("jti"); ok {
+		t.Fatal("not revoked result should expire after ttl")
+	}
+	if revoked, ok = rc.TokenRevoked("revoked"); !ok || !revoked {
+		t.Fatal("revoked result should be kept")
+	}
+	if _, _, ok = rc.UserCutoff("user"); ok {
+		t.Fatal("user cutoff should expire after ttl")
+	}
+
+	var nilCache *RevocationCache
+	nilCache.SetToken("jti", true, 0)
+	if _, ok = nilCache.TokenRevoked("jti"); ok {
+		t.Fatal("nil cache should always miss")
+	}
+}
@@ -0,0 +1,117 @@
+package model
+
+import (
+	"github.com/leyle/go-api-starter/couchdb"
+	"github.com/leyle/go-api-starter/util"
+)
+
+const DBNameRegisterSaga = "registersaga"
+
+const (
+	SagaStatusPending    = "pending"
+	SagaStatusDone       = "done"
+	SagaStatusRolledBack = "rolledback"
+
+	// compensation failed, it needs manual repair
+	SagaStatusFailed = "failed"
+)
+
+// registration steps, in order
+const (
+	RegisterStepReserve    = "reserve"
+	RegisterStepCARegister = "caRegister"
+	RegisterStepCAEnroll   = "caEnroll"
+	RegisterStepWalletPut  = "walletPut"
+	RegisterStepActivate   = "activate"
+)
+
+// RegisterSaga is the persisted state of a user registration
+// doc id is the user id, Steps are completed steps, in order
+// User holds the account to reserve, it's dropped when saga finishes
+// Running is a step whose action has started but isn't confirmed, it's set only for non-idempotent steps
+// CAAbsent records that ca had no identity of Username before caRegister sent the request,
+// without it an existing ca identity belongs to someone else and is never removed by rollback
+type RegisterSaga struct {
+	Id       string        `json:"id"`
+	Rev      string        `json:"_rev,omitempty"`
+	UserId   string        `json:"userId"`
+	Username string        `json:"username"`
+	Status   string        `json:"status"`
+	Steps    []string      `json:"steps"`
+	Running  string        `json:"running,omitempty"`
+	CAAbsent bool          `json:"caAbsent,omitempty"`
+	User     *UserAccount  `json:"user,omitempty"`
+	Err      string        `json:"err,omitempty"`
+	Created  *util.CurTime `json:"created"`
+	Updated  *util.CurTime `json:"updated"`
+}
+
+func (s *RegisterSaga) IsDone(step string) bool {
+	for _, done := range s.Steps {
+		if done == step {
+			return true
+		}
+	}
+	return false
+}
+
+func GetRegisterSaga(ctx *JWTContext, id string) (*RegisterSaga, error) {
+	var saga *RegisterSaga
+	_, err := ctx.Ds(DBNameRegisterSaga).GetById(ctx.Context(), id, &saga)
+	if err != nil {
+		if err == couchdb.NoIdData {
+			return nil, nil
+		}
+		ctx.Logger().Error().Err(err).Str("id", id).Msg("GetRegisterSaga failed")
+		return nil, err
+	}
+	return saga, nil
+}
+
+// SaveRegisterSaga creates saga doc, ErrDocConflict is returned if it exists
+func SaveRegisterSaga(ctx *JWTContext, saga *RegisterSaga) error {
+	rev, err := updateDoc(ctx, DBNameRegisterSaga, saga.Id, saga)
+	if err != nil {
+		ctx.Logger().Error().Err(err).Str("username", saga.Username).Msg("SaveRegisterSaga failed")
+		return err
+	}
+	saga.Rev = rev
+	return nil
+}
+
+func UpdateRegisterSaga(ctx *JWTContext, saga *RegisterSaga) error {
+	saga.Updated = util.GetCurTime()
+	rev, err := updateDoc(ctx, DBNameRegisterSaga, saga.Id, saga)
+	if err != nil {
+		ctx.Logger().Error().Err(err).Str("username", saga.Username).Msg("UpdateRegisterSaga failed")
+		return err
+	}
+	saga.Rev = rev
+	return nil
+}
+
+// GetPendingRegisterSagas returns pending sagas not updated after updatedBefore(unix second)
+func GetPendingRegisterSagas(ctx *JWTContext, updatedBefore int64) ([]*RegisterSaga, error) {
+	const maxSagas = 1000
+	searchReq := &couchdb.SearchRequest{
+		Selector: map[string]interface{}{
+			"status": SagaStatusPending,
+			"updated.second": map[string]int64{
+				"$lt": updatedBefore,
+			},
+		},
+		Limit: maxSagas,
+	}
+
+	type Resp struct {
+		Docs []*RegisterSaga `json:"docs"`
+	}
+	var respDocs *Resp
+	_, err := ctx.Ds(DBNameRegisterSaga).Search(ctx.Context(), searchReq, &respDocs)
+	if err != nil {
+		ctx.Logger().Error().Err(err).Msg("search pending register sagas failed")
+		return nil, err
+	}
+
+	return respDocs.Docs, nil
+}
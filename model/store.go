@@ -0,0 +1,193 @@
+package model
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/leyle/go-api-starter/util"
+	"strconv"
+	"strings"
+)
+
+var ErrUsernameExist = errors.New("username has already exists")
+
+// UserStore saves user accounts
+// Get methods return nil, nil if the user doesn't exist
+// Update and Delete need user's current rev, ErrDocConflict is returned if it's changed by others
+type UserStore interface {
+	GetById(ctx context.Context, id string) (*UserAccount, error)
+	GetByUsername(ctx context.Context, username string) (*UserAccount, error)
+
+	// Create saves a new user, ua.Rev is set after success
+	Create(ctx context.Context, ua *UserAccount) error
+
+	// Update saves ua with ua.Rev, ua.Rev is set to the new rev after success
+	Update(ctx context.Context, ua *UserAccount) error
+
+	List(ctx context.Context, query *UserQuery) (*UserList, error)
+	Delete(ctx context.Context, id, rev string) error
+}
+
+// UserStoreIniter is implemented by stores which need to create database/table/index
+type UserStoreIniter interface {
+	Init(ctx context.Context) error
+}
+
+const (
+	defaultUserQueryLimit = 20
+	maxUserQueryLimit     = 200
+)
+
+// sortable fields of UserQuery
+const (
+	UserSortCreated  = "created"
+	UserSortUpdated  = "updated"
+	UserSortUsername = "username"
+)
+
+var ErrInvalidUserSort = errors.New("invalid sort field, it should be created, updated or username")
+
+type UserQuery struct {
+	// empty value means no filter
+	Role           UserRole
+	Valid          *bool
+	UsernamePrefix string
+
+	// created time range, unix second, both are inclusive, zero means no limit
+	CreatedFrom int64
+	CreatedTo   int64
+
+	// default is created, ascending
+	Sort string
+	Desc bool
+
+	Limit int
+
+	// returned by last query, empty means first page
+	Bookmark string
+}
+
+func (q *UserQuery) limit() int {
+	if q.Limit <= 0 {
+		return defaultUserQueryLimit
+	}
+	if q.Limit > maxUserQueryLimit {
+		return maxUserQueryLimit
+	}
+	return q.Limit
+}
+
+func (q *UserQuery) Validate() error {
+	switch q.Sort {
+	case "", UserSortCreated, UserSortUpdated, UserSortUsername:
+		return nil
+	}
+	return ErrInvalidUserSort
+}
+
+func (q *UserQuery) sortField() string {
+	if q.Sort == "" {
+		return UserSortCreated
+	}
+	return q.Sort
+}
+
+func (q *UserQuery) match(ua *UserAccount) bool {
+	if q.Role != "" && ua.Role != q.Role {
+		return false
+	}
+	if q.Valid != nil && ua.Valid != *q.Valid {
+		return false
+	}
+	if q.UsernamePrefix != "" && !strings.HasPrefix(ua.Username, q.UsernamePrefix) {
+		return false
+	}
+	created := timeSecond(ua.Created)
+	if q.CreatedFrom > 0 && created < q.CreatedFrom {
+		return false
+	}
+	if q.CreatedTo > 0 && created > q.CreatedTo {
+		return false
+	}
+	return true
+}
+
+// less orders users by sort field, then id
+func (q *UserQuery) less(a, b *UserAccount) bool {
+	var cmp int
+	switch q.sortField() {
+	case UserSortUsername:
+		cmp = strings.Compare(a.Username, b.Username)
+	case UserSortUpdated:
+		cmp = compareInt64(timeSecond(a.Updated), timeSecond(b.Updated))
+	default:
+		cmp = compareInt64(timeSecond(a.Created), timeSecond(b.Created))
+	}
+	if cmp == 0 {
+		cmp = strings.Compare(a.Id, b.Id)
+	}
+	if q.Desc {
+		return cmp > 0
+	}
+	return cmp < 0
+}
+
+func compareInt64(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+type UserList struct {
+	Users []*UserAccount `json:"users"`
+
+	// pass it to next query to get next page, empty means no more data
+	Bookmark string `json:"bookmark"`
+}
+
+// nextRev returns rev like "2-9f86d081", the number is increased on each write
+// used by stores that don't have their own revision
+func nextRev(rev string) string {
+	n := 0
+	if idx := strings.Index(rev, "-"); idx > 0 {
+		n, _ = strconv.Atoi(rev[:idx])
+	}
+
+	buf := make([]byte, 4)
+	_, _ = rand.Read(buf)
+	return fmt.Sprintf("%d-%s", n+1, hex.EncodeToString(buf))
+}
+
+// offset bookmark is used by stores without native bookmark
+func encodeOffsetBookmark(offset int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.Itoa(offset)))
+}
+
+func decodeOffsetBookmark(bookmark string) int {
+	if bookmark == "" {
+		return 0
+	}
+	data, err := base64.RawURLEncoding.DecodeString(bookmark)
+	if err != nil {
+		return 0
+	}
+	offset, err := strconv.Atoi(string(data))
+	if err != nil || offset < 0 {
+		return 0
+	}
+	return offset
+}
+
+func timeSecond(t *util.CurTime) int64 {
+	if t == nil {
+		return 0
+	}
+	return t.Second
+}
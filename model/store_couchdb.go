@@ -0,0 +1,334 @@
+package model
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/leyle/go-api-starter/couchdb"
+	"strings"
+	"time"
+)
+
+// CouchDBUserStore is the default user store
+type CouchDBUserStore struct {
+	opt    *couchdb.CouchDBOption
+	dbName string
+}
+
+func NewCouchDBUserStore(opt *couchdb.CouchDBOption) *CouchDBUserStore {
+	return &CouchDBUserStore{
+		opt:    opt,
+		dbName: DBNameUserAccount,
+	}
+}
+
+func (s *CouchDBUserStore) ds() *couchdb.CouchDBClient {
+	return couchdb.New(s.opt, s.dbName)
+}
+
+// Init creates database and index
+func (s *CouchDBUserStore) Init(ctx context.Context) error {
+	err := s.ds().CreateDatabase(ctx)
+	if err != nil {
+		return err
+	}
+
+	fields := []string{
+		"username",
+		"role",
+		"valid",
+		"created.second",
+		"updated.second",
+	}
+
+	return s.ds().CreateIndex(ctx, fields)
+}
+
+func (s *CouchDBUserStore) GetById(ctx context.Context, id string) (*UserAccount, error) {
+	var ua *UserAccount
+	_, err := s.ds().GetById(ctx, id, &ua)
+	if err != nil {
+		if err == couchdb.NoIdData {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return ua, nil
+}
+
+func (s *CouchDBUserStore) GetByUsername(ctx context.Context, username string) (*UserAccount, error) {
+	selector := map[string]string{
+		"username": username,
+	}
+
+	searchReq := &couchdb.SearchRequest{
+		Selector: selector,
+		Limit:    1,
+	}
+
+	type Resp struct {
+		Docs []*UserAccount `json:"docs"`
+	}
+	var respDocs *Resp
+	_, err := s.ds().Search(ctx, searchReq, &respDocs)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(respDocs.Docs) > 0 {
+		return respDocs.Docs[0], nil
+	}
+
+	return nil, nil
+}
+
+// couchdb has no unique index, a lock doc whose id is the username makes username unique
+// it's in the user database, it has no user fields, so user queries don't return it
+const usernameLockPrefix = "username:"
+
+// a lock whose user isn't saved for this long is left by a crashed request
+const staleUsernameLockSeconds = 10 * 60
+
+type usernameLock struct {
+	Id       string `json:"id"`
+	Rev      string `json:"_rev,omitempty"`
+	LockOf   string `json:"lockOf"`
+	UserId   string `json:"userId"`
+	LockedAt int64  `json:"lockedAt"`
+}
+
+func usernameLockId(username string) string {
+	return usernameLockPrefix + username
+}
+
+func (s *CouchDBUserStore) Create(ctx context.Context, ua *UserAccount) error {
+	err := s.lockUsername(ctx, ua)
+	if err != nil {
+		return err
+	}
+
+	// put without _rev creates the doc, and it returns the rev
+	ua.Rev = ""
+	err = s.put(ctx, ua)
+	if err != nil {
+		// same user id may be saved again, e.g. by saga recovery, then the lock is kept
+		if err != ErrDocConflict {
+			s.unlockUsername(ctx, ua.Username, ua.Id)
+		}
+		return err
+	}
+	return nil
+}
+
+// lockUsername creates the lock doc of ua's username
+// ErrUsernameExist is returned if it's locked by another user
+func (s *CouchDBUserStore) lockUsername(ctx context.Context, ua *UserAccount) error {
+	lock := &usernameLock{
+		Id:       usernameLockId(ua.Username),
+		LockOf:   ua.Username,
+		UserId:   ua.Id,
+		LockedAt: time.Now().Unix(),
+	}
+	data, err := json.Marshal(lock)
+	if err != nil {
+		return err
+	}
+	_, err = s.ds().UpdateById(ctx, lock.Id, data)
+	if err == nil {
+		// users saved before locks are added have no lock
+		old, err := s.GetByUsername(ctx, ua.Username)
+		if err != nil {
+			s.unlockUsername(ctx, ua.Username, ua.Id)
+			return err
+		}
+		if old != nil && old.Id != ua.Id {
+			s.relockUsername(ctx, ua.Username, old.Id)
+			return ErrUsernameExist
+		}
+		return nil
+	}
+	if !isCouchDBConflict(err) {
+		return err
+	}
+
+	var cur *usernameLock
+	_, err = s.ds().GetById(ctx, lock.Id, &cur)
+	if err != nil {
+		return err
+	}
+	if cur.UserId == ua.Id {
+		return nil
+	}
+
+	// request which takes the lock may crash before the user is saved
+	owner, err := s.GetById(ctx, cur.UserId)
+	if err != nil {
+		return err
+	}
+	if owner != nil || time.Now().Unix()-cur.LockedAt < staleUsernameLockSeconds {
+		return ErrUsernameExist
+	}
+	lock.Rev = cur.Rev
+	data, err = json.Marshal(lock)
+	if err != nil {
+		return err
+	}
+	_, err = s.ds().UpdateById(ctx, lock.Id, data)
+	if err != nil {
+		if isCouchDBConflict(err) {
+			return ErrUsernameExist
+		}
+		return err
+	}
+	return nil
+}
+
+// relockUsername gives the lock to userId, errors are ignored, the lock is only a guard
+func (s *CouchDBUserStore) relockUsername(ctx context.Context, username, userId string) {
+	var cur *usernameLock
+	if _, err := s.ds().GetById(ctx, usernameLockId(username), &cur); err != nil {
+		return
+	}
+	cur.UserId = userId
+	data, err := json.Marshal(cur)
+	if err != nil {
+		return
+	}
+	_, _ = s.ds().UpdateById(ctx, cur.Id, data)
+}
+
+// unlockUsername removes the lock if it's held by userId
+func (s *CouchDBUserStore) unlockUsername(ctx context.Context, username, userId string) {
+	var cur *usernameLock
+	if _, err := s.ds().GetById(ctx, usernameLockId(username), &cur); err != nil {
+		return
+	}
+	if cur.UserId != userId {
+		return
+	}
+	_ = s.ds().DeleteById(ctx, cur.Id, cur.Rev)
+}
+
+func (s *CouchDBUserStore) Update(ctx context.Context, ua *UserAccount) error {
+	return s.put(ctx, ua)
+}
+
+func (s *CouchDBUserStore) put(ctx context.Context, ua *UserAccount) error {
+	data, err := json.Marshal(ua)
+	if err != nil {
+		return err
+	}
+
+	body, err := s.ds().UpdateById(ctx, ua.Id, data)
+	if err != nil {
+		if isCouchDBConflict(err) {
+			return ErrDocConflict
+		}
+		return err
+	}
+
+	ua.Rev = parseCouchDBRev(body)
+	return nil
+}
+
+func (s *CouchDBUserStore) List(ctx context.Context, query *UserQuery) (*UserList, error) {
+	selector := map[string]interface{}{}
+	if query.Role != "" {
+		selector["role"] = query.Role
+	}
+	if query.Valid != nil {
+		selector["valid"] = *query.Valid
+	}
+	if query.UsernamePrefix != "" {
+		selector["username"] = map[string]string{
+			"$gte": query.UsernamePrefix,
+			"$lt":  query.UsernamePrefix + "\ufff0",
+		}
+	}
+
+	created := map[string]int64{}
+	if query.CreatedFrom > 0 {
+		created["$gte"] = query.CreatedFrom
+	}
+	if query.CreatedTo > 0 {
+		created["$lte"] = query.CreatedTo
+	}
+	if len(created) > 0 {
+		selector["created.second"] = created
+	}
+
+	// sort field must be in selector, or couchdb can't use its index
+	sortField := map[string]string{
+		UserSortCreated:  "created.second",
+		UserSortUpdated:  "updated.second",
+		UserSortUsername: "username",
+	}[query.sortField()]
+	if _, ok := selector[sortField]; !ok {
+		selector[sortField] = map[string]interface{}{"$gt": nil}
+	}
+	direction := "asc"
+	if query.Desc {
+		direction = "desc"
+	}
+
+	req := &couchDBFindRequest{
+		Selector: selector,
+		Sort:     []map[string]string{{sortField: direction}},
+		Limit:    query.limit(),
+		Bookmark: query.Bookmark,
+	}
+
+	type Resp struct {
+		Docs []*UserAccount `json:"docs"`
+	}
+	var respDocs *Resp
+	bookmark, err := couchDBFind(ctx, s.opt, s.dbName, req, &respDocs)
+	if err != nil {
+		return nil, err
+	}
+
+	list := &UserList{
+		Users: respDocs.Docs,
+	}
+	if list.Users == nil {
+		list.Users = []*UserAccount{}
+	}
+	// couchdb always returns a bookmark, a short page means no more data
+	if len(list.Users) == req.Limit {
+		list.Bookmark = bookmark
+	}
+
+	return list, nil
+}
+
+func (s *CouchDBUserStore) Delete(ctx context.Context, id, rev string) error {
+	ua, err := s.GetById(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	err = s.ds().DeleteById(ctx, id, rev)
+	if err != nil {
+		if isCouchDBConflict(err) {
+			return ErrDocConflict
+		}
+		return err
+	}
+
+	// username can be used again
+	if ua != nil {
+		s.unlockUsername(ctx, ua.Username, ua.Id)
+	}
+	return nil
+}
+
+func isCouchDBConflict(err error) bool {
+	return strings.Contains(err.Error(), "statusCode[409]")
+}
+
+func parseCouchDBRev(body []byte) string {
+	var ret struct {
+		Rev string `json:"rev"`
+	}
+	_ = json.Unmarshal(body, &ret)
+	return ret.Rev
+}
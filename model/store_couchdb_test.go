@@ -0,0 +1,67 @@
+package model
+
+import (
+	"context"
+	"github.com/leyle/fabric-user-manager/internal/couchdbtest"
+	"testing"
+)
+
+func TestCouchDBUserStoreUniqueUsername(t *testing.T) {
+	srv := couchdbtest.NewServer()
+	defer srv.Close()
+
+	ctx := context.Background()
+	store := NewCouchDBUserStore(srv.Option())
+	if err := store.Init(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	alice := &UserAccount{Id: "u1", Username: "alice"}
+	if err := store.Create(ctx, alice); err != nil {
+		t.Fatal(err)
+	}
+	// saga recovery saves the same user again, it's not taken as another user
+	if err := store.Create(ctx, &UserAccount{Id: "u1", Username: "alice"}); err != ErrDocConflict {
+		t.Fatalf("expect conflict for same id, got %v", err)
+	}
+	if err := store.Create(ctx, &UserAccount{Id: "u2", Username: "alice"}); err != ErrUsernameExist {
+		t.Fatalf("expect username exist, got %v", err)
+	}
+
+	// lock doc isn't returned as a user
+	got, err := store.GetByUsername(ctx, "alice")
+	if err != nil || got == nil || got.Id != "u1" {
+		t.Fatalf("unexpected user %+v, %v", got, err)
+	}
+
+	// username can be used again after delete
+	if err = store.Delete(ctx, alice.Id, alice.Rev); err != nil {
+		t.Fatal(err)
+	}
+	if err = store.Create(ctx, &UserAccount{Id: "u3", Username: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCouchDBUserStoreLegacyUsername(t *testing.T) {
+	srv := couchdbtest.NewServer()
+	defer srv.Close()
+
+	ctx := context.Background()
+	store := NewCouchDBUserStore(srv.Option())
+	if err := store.Init(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// user saved before locks are added
+	legacy := &UserAccount{Id: "u1", Username: "bob"}
+	if err := store.put(ctx, legacy); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Create(ctx, &UserAccount{Id: "u2", Username: "bob"}); err != ErrUsernameExist {
+		t.Fatalf("expect username exist, got %v", err)
+	}
+	if err := store.Create(ctx, &UserAccount{Id: "u3", Username: "bob"}); err != ErrUsernameExist {
+		t.Fatalf("expect username exist by lock, got %v", err)
+	}
+}
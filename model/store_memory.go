@@ -0,0 +1,142 @@
+package model
+
+import (
+	"context"
+	"sort"
+	"sync"
+)
+
+// MemoryUserStore keeps users in memory, it's used by tests
+type MemoryUserStore struct {
+	mu    sync.RWMutex
+	users map[string]*UserAccount
+}
+
+func NewMemoryUserStore() *MemoryUserStore {
+	return &MemoryUserStore{
+		users: make(map[string]*UserAccount),
+	}
+}
+
+// stored users are copied, so callers can't change them without Update
+// copyUser deep copies ua, so callers can't modify stored user without Update
+func copyUser(ua *UserAccount) *UserAccount {
+	cp := *ua
+	if ua.Created != nil {
+		created := *ua.Created
+		cp.Created = &created
+	}
+	if ua.Updated != nil {
+		updated := *ua.Updated
+		cp.Updated = &updated
+	}
+	cp.PasswdHistory = append([]string(nil), ua.PasswdHistory...)
+	cp.RecoveryCodes = append([]string(nil), ua.RecoveryCodes...)
+	cp.CAAttrs = nil
+	for _, attr := range ua.CAAttrs {
+		a := *attr
+		cp.CAAttrs = append(cp.CAAttrs, &a)
+	}
+	return &cp
+}
+
+func (s *MemoryUserStore) GetById(ctx context.Context, id string) (*UserAccount, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	ua, ok := s.users[id]
+	if !ok {
+		return nil, nil
+	}
+	return copyUser(ua), nil
+}
+
+func (s *MemoryUserStore) GetByUsername(ctx context.Context, username string) (*UserAccount, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, ua := range s.users {
+		if ua.Username == username {
+			return copyUser(ua), nil
+		}
+	}
+	return nil, nil
+}
+
+func (s *MemoryUserStore) Create(ctx context.Context, ua *UserAccount) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.users[ua.Id]; ok {
+		return ErrDocConflict
+	}
+	for _, u := range s.users {
+		if u.Username == ua.Username {
+			return ErrUsernameExist
+		}
+	}
+
+	ua.Rev = nextRev("")
+	s.users[ua.Id] = copyUser(ua)
+	return nil
+}
+
+func (s *MemoryUserStore) Update(ctx context.Context, ua *UserAccount) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old, ok := s.users[ua.Id]
+	if !ok || old.Rev != ua.Rev {
+		return ErrDocConflict
+	}
+
+	ua.Rev = nextRev(ua.Rev)
+	s.users[ua.Id] = copyUser(ua)
+	return nil
+}
+
+func (s *MemoryUserStore) List(ctx context.Context, query *UserQuery) (*UserList, error) {
+	s.mu.RLock()
+	var users []*UserAccount
+	for _, ua := range s.users {
+		if query.match(ua) {
+			users = append(users, copyUser(ua))
+		}
+	}
+	s.mu.RUnlock()
+
+	sort.Slice(users, func(i, j int) bool {
+		return query.less(users[i], users[j])
+	})
+
+	return pageUsers(users, query), nil
+}
+
+func (s *MemoryUserStore) Delete(ctx context.Context, id, rev string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old, ok := s.users[id]
+	if !ok || old.Rev != rev {
+		return ErrDocConflict
+	}
+	delete(s.users, id)
+	return nil
+}
+
+func pageUsers(users []*UserAccount, query *UserQuery) *UserList {
+	offset := decodeOffsetBookmark(query.Bookmark)
+	limit := query.limit()
+
+	list := &UserList{
+		Users: []*UserAccount{},
+	}
+	if offset >= len(users) {
+		return list
+	}
+
+	end := offset + limit
+	if end < len(users) {
+		list.Bookmark = encodeOffsetBookmark(end)
+	} else {
+		end = len(users)
+	}
+	list.Users = users[offset:end]
+
+	return list
+}
@@ -0,0 +1,118 @@
+package model
+
+import (
+	"context"
+	"fmt"
+	"github.com/leyle/go-api-starter/util"
+	"testing"
+)
+
+func TestMemoryUserStore(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryUserStore()
+
+	ua := &UserAccount{
+		Id:       "1",
+		Username: "alice",
+		Role:     UserRoleUser,
+		Valid:    true,
+		Created:  util.GetCurTime(),
+
+		RecoveryCodes: []string{"code"},
+		CAAttrs:       []*CAAttribute{{Name: "dept", Value: "sales"}},
+	}
+	if err := store.Create(ctx, ua); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Create(ctx, &UserAccount{Id: "2", Username: "alice"}); err != ErrUsernameExist {
+		t.Fatal("duplicate username should be rejected")
+	}
+
+	got, err := store.GetByUsername(ctx, "alice")
+	if err != nil || got == nil || got.Rev != ua.Rev {
+		t.Fatal("get by username failed", err)
+	}
+
+	// returned user doesn't share slices with the stored one
+	got.RecoveryCodes[0] = "changed"
+	got.CAAttrs[0].Value = "changed"
+	again, _ := store.GetById(ctx, "1")
+	if again.RecoveryCodes[0] != "code" || again.CAAttrs[0].Value != "sales" {
+		t.Fatal("stored user is modified without update")
+	}
+	got.RecoveryCodes, got.CAAttrs = again.RecoveryCodes, again.CAAttrs
+
+	stale := *got
+	got.Valid = false
+	if err = store.Update(ctx, got); err != nil {
+		t.Fatal(err)
+	}
+	if err = store.Update(ctx, &stale); err != ErrDocConflict {
+		t.Fatal("update with old rev should conflict")
+	}
+
+	missing, err := store.GetById(ctx, "none")
+	if err != nil || missing != nil {
+		t.Fatal("missing user should return nil, nil")
+	}
+
+	if err = store.Delete(ctx, got.Id, got.Rev); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMemoryUserStoreList(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryUserStore()
+	for i := 0; i < 5; i++ {
+		role := UserRoleUser
+		if i%2 == 0 {
+			role = UserRoleAdmin
+		}
+		ua := &UserAccount{
+			Id:       fmt.Sprintf("%d", i),
+			Username: fmt.Sprintf("user%d", i),
+			Role:     role,
+			Created:  &util.CurTime{Second: int64(i)},
+		}
+		if err := store.Create(ctx, ua); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	query := &UserQuery{Role: UserRoleAdmin, Limit: 2}
+	var names []string
+	for {
+		list, err := store.List(ctx, query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, ua := range list.Users {
+			names = append(names, ua.Username)
+		}
+		if list.Bookmark == "" {
+			break
+		}
+		query.Bookmark = list.Bookmark
+	}
+
+	if fmt.Sprint(names) != "[user0 user2 user4]" {
+		t.Fatal("unexpected list result", names)
+	}
+
+	list, err := store.List(ctx, &UserQuery{CreatedFrom: 1, CreatedTo: 3, Sort: UserSortUsername, Desc: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	names = nil
+	for _, ua := range list.Users {
+		names = append(names, ua.Username)
+	}
+	if fmt.Sprint(names) != "[user3 user2 user1]" {
+		t.Fatal("unexpected sorted result", names)
+	}
+
+	if err = (&UserQuery{Sort: "passHash"}).Validate(); err != ErrInvalidUserSort {
+		t.Fatal("unknown sort field should be rejected")
+	}
+}
@@ -0,0 +1,261 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+const (
+	SQLDialectSQLite   = "sqlite"
+	SQLDialectPostgres = "postgres"
+)
+
+// SQLUserStore saves users by database/sql, the driver is registered by the caller
+// filter columns are saved separately, the whole account is saved as json in data column,
+// so new account fields don't need schema migration
+type SQLUserStore struct {
+	db      *sql.DB
+	dialect string
+	table   string
+}
+
+func NewSQLUserStore(db *sql.DB, dialect string) *SQLUserStore {
+	return &SQLUserStore{
+		db:      db,
+		dialect: dialect,
+		table:   DBNameUserAccount,
+	}
+}
+
+// Init creates table and index
+func (s *SQLUserStore) Init(ctx context.Context) error {
+	stmts := []string{
+		fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+			id VARCHAR(64) PRIMARY KEY,
+			rev VARCHAR(64) NOT NULL,
+			username VARCHAR(255) NOT NULL UNIQUE,
+			role VARCHAR(32) NOT NULL,
+			valid BOOLEAN NOT NULL,
+			created_second BIGINT NOT NULL,
+			updated_second BIGINT NOT NULL,
+			data TEXT NOT NULL
+		)`, s.table),
+		fmt.Sprintf(`CREATE INDEX IF NOT EXISTS idx_%s_role ON %s (role)`, s.table, s.table),
+		fmt.Sprintf(`CREATE INDEX IF NOT EXISTS idx_%s_created ON %s (created_second)`, s.table, s.table),
+	}
+
+	for _, stmt := range stmts {
+		if _, err := s.db.ExecContext(ctx, stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// query replaces ? with $n for postgres
+func (s *SQLUserStore) query(q string) string {
+	if s.dialect != SQLDialectPostgres {
+		return q
+	}
+
+	var b strings.Builder
+	n := 0
+	for _, c := range q {
+		if c == '?' {
+			n++
+			fmt.Fprintf(&b, "$%d", n)
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+func (s *SQLUserStore) GetById(ctx context.Context, id string) (*UserAccount, error) {
+	q := fmt.Sprintf("SELECT rev, data FROM %s WHERE id = ?", s.table)
+	return s.getOne(ctx, q, id)
+}
+
+func (s *SQLUserStore) GetByUsername(ctx context.Context, username string) (*UserAccount, error) {
+	q := fmt.Sprintf("SELECT rev, data FROM %s WHERE username = ?", s.table)
+	return s.getOne(ctx, q, username)
+}
+
+func (s *SQLUserStore) getOne(ctx context.Context, q string, arg interface{}) (*UserAccount, error) {
+	row := s.db.QueryRowContext(ctx, s.query(q), arg)
+	ua, err := scanUser(row)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return ua, err
+}
+
+type sqlScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanUser(row sqlScanner) (*UserAccount, error) {
+	var rev, data string
+	if err := row.Scan(&rev, &data); err != nil {
+		return nil, err
+	}
+
+	var ua *UserAccount
+	if err := json.Unmarshal([]byte(data), &ua); err != nil {
+		return nil, err
+	}
+	ua.Rev = rev
+	return ua, nil
+}
+
+func (s *SQLUserStore) Create(ctx context.Context, ua *UserAccount) error {
+	exist, err := s.GetByUsername(ctx, ua.Username)
+	if err != nil {
+		return err
+	}
+	if exist != nil {
+		return ErrUsernameExist
+	}
+
+	rev := nextRev("")
+	data, err := marshalSQLUser(ua)
+	if err != nil {
+		return err
+	}
+
+	q := fmt.Sprintf(`INSERT INTO %s (id, rev, username, role, valid, created_second, updated_second, data)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`, s.table)
+	_, err = s.db.ExecContext(ctx, s.query(q),
+		ua.Id, rev, ua.Username, string(ua.Role), ua.Valid, timeSecond(ua.Created), timeSecond(ua.Updated), data)
+	if err != nil {
+		return err
+	}
+
+	ua.Rev = rev
+	return nil
+}
+
+func (s *SQLUserStore) Update(ctx context.Context, ua *UserAccount) error {
+	rev := nextRev(ua.Rev)
+	data, err := marshalSQLUser(ua)
+	if err != nil {
+		return err
+	}
+
+	q := fmt.Sprintf(`UPDATE %s SET rev = ?, username = ?, role = ?, valid = ?, created_second = ?, updated_second = ?, data = ?
+		WHERE id = ? AND rev = ?`, s.table)
+	ret, err := s.db.ExecContext(ctx, s.query(q),
+		rev, ua.Username, string(ua.Role), ua.Valid, timeSecond(ua.Created), timeSecond(ua.Updated), data, ua.Id, ua.Rev)
+	if err != nil {
+		return err
+	}
+
+	n, err := ret.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrDocConflict
+	}
+
+	ua.Rev = rev
+	return nil
+}
+
+func (s *SQLUserStore) List(ctx context.Context, query *UserQuery) (*UserList, error) {
+	var conds []string
+	var args []interface{}
+	if query.Role != "" {
+		conds = append(conds, "role = ?")
+		args = append(args, string(query.Role))
+	}
+	if query.Valid != nil {
+		conds = append(conds, "valid = ?")
+		args = append(args, *query.Valid)
+	}
+	if query.UsernamePrefix != "" {
+		conds = append(conds, "username >= ? AND username < ?")
+		args = append(args, query.UsernamePrefix, query.UsernamePrefix+"\ufff0")
+	}
+
+	if query.CreatedFrom > 0 {
+		conds = append(conds, "created_second >= ?")
+		args = append(args, query.CreatedFrom)
+	}
+	if query.CreatedTo > 0 {
+		conds = append(conds, "created_second <= ?")
+		args = append(args, query.CreatedTo)
+	}
+
+	where := ""
+	if len(conds) > 0 {
+		where = "WHERE " + strings.Join(conds, " AND ")
+	}
+
+	offset := decodeOffsetBookmark(query.Bookmark)
+	limit := query.limit()
+	column := map[string]string{
+		UserSortCreated:  "created_second",
+		UserSortUpdated:  "updated_second",
+		UserSortUsername: "username",
+	}[query.sortField()]
+	direction := "ASC"
+	if query.Desc {
+		direction = "DESC"
+	}
+	q := fmt.Sprintf("SELECT rev, data FROM %s %s ORDER BY %s %s, id %s LIMIT ? OFFSET ?", s.table, where, column, direction, direction)
+	args = append(args, limit, offset)
+
+	rows, err := s.db.QueryContext(ctx, s.query(q), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := &UserList{
+		Users: []*UserAccount{},
+	}
+	for rows.Next() {
+		ua, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		list.Users = append(list.Users, ua)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(list.Users) == limit {
+		list.Bookmark = encodeOffsetBookmark(offset + limit)
+	}
+
+	return list, nil
+}
+
+func (s *SQLUserStore) Delete(ctx context.Context, id, rev string) error {
+	q := fmt.Sprintf("DELETE FROM %s WHERE id = ? AND rev = ?", s.table)
+	ret, err := s.db.ExecContext(ctx, s.query(q), id, rev)
+	if err != nil {
+		return err
+	}
+	n, err := ret.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrDocConflict
+	}
+	return nil
+}
+
+// rev is saved in its own column
+func marshalSQLUser(ua *UserAccount) (string, error) {
+	cp := *ua
+	cp.Rev = ""
+	data, err := json.Marshal(&cp)
+	return string(data), err
+}
@@ -0,0 +1,84 @@
+package model
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// RFC 6238 appendix B, SHA1, last 6 digits
+func TestTOTPCode(t *testing.T) {
+	secret := totpEncoding.EncodeToString([]byte("12345678901234567890"))
+	cases := map[int64]string{
+		59:         "287082",
+		1111111109: "081804",
+		1234567890: "005924",
+		2000000000: "279037",
+	}
+
+	for ts, expect := range cases {
+		code, err := TOTPCode(secret, TOTPStep(time.Unix(ts, 0)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != expect {
+			t.Errorf("time %d, expect %s, got %s", ts, expect, code)
+		}
+	}
+}
+
+func TestVerifyTOTP(t *testing.T) {
+	secret, err := GenerateTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	prev, _ := TOTPCode(secret, TOTPStep(now)-1)
+	step, ok := VerifyTOTP(secret, prev, now, 0)
+	if !ok || step != TOTPStep(now)-1 {
+		t.Fatal("code of previous step should be accepted")
+	}
+
+	if _, ok = VerifyTOTP(secret, prev, now, step); ok {
+		t.Fatal("used code should be refused")
+	}
+
+	old, _ := TOTPCode(secret, TOTPStep(now)-3)
+	if _, ok = VerifyTOTP(secret, old, now, 0); ok {
+		t.Fatal("expired code should be refused")
+	}
+
+	uri := TOTPURI("issuer", "alice", secret)
+	if !strings.HasPrefix(uri, "otpauth://totp/issuer:alice?") || !strings.Contains(uri, "secret="+secret) {
+		t.Fatal("unexpected uri", uri)
+	}
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	opt := &MFAOption{RecoveryCodeCount: 3, EncryptKey: []byte("0123456789abcdef")}
+	plain, hashed, err := opt.GenerateRecoveryCodes()
+	if err != nil || len(plain) != 3 || len(hashed) != 3 {
+		t.Fatal("generate recovery codes failed", err)
+	}
+
+	u := &UserAccount{RecoveryCodes: hashed}
+	if !u.UseRecoveryCode(strings.ToUpper(plain[1])) {
+		t.Fatal("recovery code should be case insensitive")
+	}
+	if u.UseRecoveryCode(plain[1]) || len(u.RecoveryCodes) != 2 {
+		t.Fatal("recovery code can only be used once")
+	}
+
+	sealed, err := opt.SealSecret("SECRET")
+	if err != nil || sealed == "SECRET" {
+		t.Fatal("secret should be encrypted", err)
+	}
+	secret, err := opt.OpenSecret(sealed)
+	if err != nil || secret != "SECRET" {
+		t.Fatal("open secret failed", err)
+	}
+	if _, err = (*MFAOption)(nil).OpenSecret(sealed); err != ErrMFANoEncryptKey {
+		t.Fatal("expect no encrypt key error", err)
+	}
+}
@@ -1,8 +1,9 @@
 package model
 
 import (
-	"github.com/leyle/go-api-starter/couchdb"
+	"crypto/subtle"
 	"github.com/leyle/go-api-starter/util"
+	"time"
 )
 
 // user role is the same as fabric ou type
@@ -36,50 +37,177 @@ type UserAccount struct {
 	Id       string        `json:"id"`
 	Rev      string        `json:"_rev,omitempty"`
 	Username string        `json:"username"`
-	Salt     string        `json:"salt,omitempty"`
-	PassHash string        `json:"passHash,omitempty"`
+	Salt     string        `json:"salt,omitempty"`     // legacy, see PassHash
+	PassHash string        `json:"passHash,omitempty"` // legacy sha256 hash, replaced by PHCHash after login
+	PHCHash  string        `json:"phcHash,omitempty"`  // PHC format hash, see HashPasswd
 	Role     UserRole      `json:"role"`
 	Valid    bool          `json:"valid"`
 	Created  *util.CurTime `json:"created"`
 	Updated  *util.CurTime `json:"updated"`
+
+	// set when admin resets password, user must change it before using other apis
+	MustChangePasswd bool `json:"mustChangePasswd"`
+
+	// previous PHC hashes, newest first, used by password policy to deny reuse
+	PasswdHistory []string `json:"passwdHistory,omitempty"`
+
+	// failed logins in a row, account is locked until lockedUntil(unix time) after too many
+	FailedAttempts int   `json:"failedAttempts"`
+	LockedUntil    int64 `json:"lockedUntil"`
+
+	// TOTP, secrets may be encrypted, see MFAOption, recovery codes are sha256 hashes
+	MFAEnabled       bool     `json:"mfaEnabled"`
+	MFASecret        string   `json:"mfaSecret,omitempty"`
+	MFAPendingSecret string   `json:"mfaPendingSecret,omitempty"`
+	MFALastStep      int64    `json:"mfaLastStep,omitempty"`
+	RecoveryCodes    []string `json:"recoveryCodes,omitempty"`
+
+	// set when admin disables user, certRevoked is false if ca revocation hasn't succeeded
+	DisabledAt     int64  `json:"disabledAt,omitempty"`
+	DisabledReason string `json:"disabledReason,omitempty"`
+	CertRevoked    bool   `json:"certRevoked,omitempty"`
+
+	// registration hasn't finished, see RegisterSaga
+	RegisterPending bool `json:"registerPending,omitempty"`
+
+	// soft deleted, account is purged after retention, see UserDeleteOption
+	DeletedAt int64 `json:"deletedAt,omitempty"`
+
+	// expiry(unix time) of enrollment certificate in wallet, zero means unknown
+	CertNotAfter int64 `json:"certNotAfter,omitempty"`
+
+	// ca identity's affiliation and attributes, see CAAttrOption
+	Affiliation string         `json:"affiliation,omitempty"`
+	CAAttrs     []*CAAttribute `json:"caAttrs,omitempty"`
 }
 
 func (u *UserAccount) IsPasswdEqual(passwd string) bool {
 	// input passwd is normal text
-	tmp := u.CreatePassHash(passwd, u.Salt)
-	if tmp == u.PassHash {
-		return true
+	if u.PHCHash != "" {
+		ok, _ := VerifyPasswd(u.PHCHash, passwd)
+		return ok
 	}
-	return false
+
+	tmp := u.CreatePassHash(passwd, u.Salt)
+	return subtle.ConstantTimeCompare([]byte(tmp), []byte(u.PassHash)) == 1
 }
 
+// CreatePassHash creates legacy sha256 hash, it's only used to verify old accounts
 func (u *UserAccount) CreatePassHash(passwd, salt string) string {
 	return util.GenerateHashPasswd(passwd, salt)
 }
 
-func GetUserAccountByUsername(ctx *JWTContext, username string) (*UserAccount, error) {
-	selector := map[string]string{
-		"username": username,
+// SetPasswd replaces user's password hash with a new PHC hash
+func (u *UserAccount) SetPasswd(opt *PasswdHashOption, passwd string) error {
+	hash, err := HashPasswd(opt, passwd)
+	if err != nil {
+		return err
+	}
+	u.PHCHash = hash
+	u.Salt = ""
+	u.PassHash = ""
+	return nil
+}
+
+// ChangePasswd keeps current hash in history, then sets the new password
+func (u *UserAccount) ChangePasswd(opt *PasswdHashOption, policy *PasswdPolicyOption, passwd string) error {
+	history := u.PasswdHistory
+	if u.PHCHash != "" {
+		history = append([]string{u.PHCHash}, history...)
+	}
+	if size := policy.historySize(); len(history) > size {
+		history = history[:size]
 	}
 
-	searchReq := &couchdb.SearchRequest{
-		Selector: selector,
-		Limit:    1,
+	if err := u.SetPasswd(opt, passwd); err != nil {
+		return err
 	}
+	u.PasswdHistory = history
+	return nil
+}
+
+// IsLocked reports if account is locked by failed logins
+func (u *UserAccount) IsLocked() bool {
+	return u.LockedUntil > time.Now().Unix()
+}
 
-	type Resp struct {
-		Docs []*UserAccount `json:"docs"`
+// NeedsRehash reports if user's hash is legacy or not created by current option
+func (u *UserAccount) NeedsRehash(opt *PasswdHashOption) bool {
+	if u.PHCHash == "" {
+		return true
 	}
-	var respDocs *Resp
-	_, err := ctx.Ds(DBNameUserAccount).Search(ctx.C.Request.Context(), searchReq, &respDocs)
+	return passwdNeedsRehash(opt, u.PHCHash)
+}
+
+// Sanitize returns a copy without secret fields, it's used in api responses
+func (u *UserAccount) Sanitize() *UserAccount {
+	cp := *u
+	cp.Salt = ""
+	cp.PassHash = ""
+	cp.PHCHash = ""
+	cp.PasswdHistory = nil
+	cp.MFASecret = ""
+	cp.MFAPendingSecret = ""
+	cp.RecoveryCodes = nil
+	return &cp
+}
+
+func GetUserAccountByUsername(ctx *JWTContext, username string) (*UserAccount, error) {
+	ua, err := ctx.Users().GetByUsername(ctx.Context(), username)
 	if err != nil {
 		ctx.Logger().Error().Err(err).Str("username", username).Msg("GetByUsername failed")
 		return nil, err
 	}
+	return ua, nil
+}
 
-	if len(respDocs.Docs) > 0 {
-		return respDocs.Docs[0], nil
+func GetUserAccountById(ctx *JWTContext, id string) (*UserAccount, error) {
+	ua, err := ctx.Users().GetById(ctx.Context(), id)
+	if err != nil {
+		ctx.Logger().Error().Err(err).Str("id", id).Msg("GetById failed")
+		return nil, err
 	}
+	return ua, nil
+}
 
-	return nil, nil
+func SaveUserAccount(ctx *JWTContext, ua *UserAccount) error {
+	err := ctx.Users().Create(ctx.Context(), ua)
+	if err != nil {
+		ctx.Logger().Error().Err(err).Str("username", ua.Username).Msg("create user failed")
+		return err
+	}
+	return nil
+}
+
+// UpdateUserAccount saves ua with its rev, ErrDocConflict is returned if it's changed by others
+func UpdateUserAccount(ctx *JWTContext, ua *UserAccount) error {
+	ua.Updated = util.GetCurTime()
+	err := ctx.Users().Update(ctx.Context(), ua)
+	if err != nil {
+		ctx.Logger().Error().Err(err).Str("username", ua.Username).Msg("update user failed")
+		return err
+	}
+	return nil
+}
+
+func ListUserAccounts(ctx *JWTContext, query *UserQuery) (*UserList, error) {
+	if err := query.Validate(); err != nil {
+		return nil, err
+	}
+
+	list, err := ctx.Users().List(ctx.Context(), query)
+	if err != nil {
+		ctx.Logger().Error().Err(err).Msg("list users failed")
+		return nil, err
+	}
+	return list, nil
+}
+
+func DeleteUserAccount(ctx *JWTContext, ua *UserAccount) error {
+	err := ctx.Users().Delete(ctx.Context(), ua.Id, ua.Rev)
+	if err != nil {
+		ctx.Logger().Error().Err(err).Str("username", ua.Username).Msg("delete user failed")
+		return err
+	}
+	return nil
 }
@@ -0,0 +1,150 @@
+package model
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/hyperledger/fabric-sdk-go/pkg/gateway"
+	"github.com/leyle/go-api-starter/couchdb"
+)
+
+// wallet backends, see FabricGWOption
+const (
+	WalletBackendFile    = "file"
+	WalletBackendCouchDB = "couchdb"
+	WalletBackendMemory  = "memory"
+)
+
+var (
+	ErrUnknownWalletBackend    = errors.New("unknown wallet backend")
+	ErrUnsupportedIdentity     = errors.New("only x509 identity can be stored in wallet")
+	ErrInvalidWalletMasterKey  = errors.New("wallet master key must be 32 bytes")
+	ErrInvalidWalletEnvelope   = errors.New("invalid encrypted wallet identity")
+	ErrPlaintextWalletIdentity = errors.New("wallet identity isn't encrypted, enable WalletAllowPlaintext to migrate it")
+)
+
+// Wallet stores fabric identities by label, *gateway.Wallet implements it
+// it can be passed to gateway.WithIdentity
+type Wallet interface {
+	Put(label string, id gateway.Identity) error
+	Get(label string) (gateway.Identity, error)
+	Remove(label string) error
+	Exists(label string) bool
+	List() ([]string, error)
+}
+
+// walletChecker is implemented by wallets whose lookup can fail, e.g. couchdb is down
+type walletChecker interface {
+	Has(label string) (bool, error)
+}
+
+// WalletExists is Exists which returns lookup error, so an outage isn't taken as not exist
+// sdk's wallets can't tell errors, their Exists is used
+func WalletExists(w Wallet, label string) (bool, error) {
+	if checker, ok := w.(walletChecker); ok {
+		return checker.Has(label)
+	}
+	return w.Exists(label), nil
+}
+
+// WalletIniter is implemented by wallets which need to create database/index
+type WalletIniter interface {
+	Init(ctx context.Context) error
+}
+
+// NewWallet creates wallet by option's backend
+// if master key is set, file and couchdb backends encrypt identities before saving them
+func NewWallet(opt *FabricGWOption, couchOpt *couchdb.CouchDBOption) (Wallet, error) {
+	var store gateway.WalletStore
+	switch opt.WalletBackend {
+	case "", WalletBackendFile:
+		if len(opt.WalletMasterKey) == 0 {
+			// keep sdk's own layout, so existing wallets work as before
+			return gateway.NewFileSystemWallet(opt.WalletPath)
+		}
+		fs, err := newFileWalletStore(opt.WalletPath)
+		if err != nil {
+			return nil, err
+		}
+		store = fs
+	case WalletBackendCouchDB:
+		store = newCouchDBWalletStore(couchOpt)
+	case WalletBackendMemory:
+		return gateway.NewInMemoryWallet(), nil
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnknownWalletBackend, opt.WalletBackend)
+	}
+
+	if len(opt.WalletMasterKey) > 0 {
+		encStore, err := newEncryptedWalletStore(store, opt.WalletMasterKey, opt.WalletAllowPlaintext)
+		if err != nil {
+			return nil, err
+		}
+		store = encStore
+	}
+	return NewStoreWallet(store), nil
+}
+
+// storeWallet saves identities in the same json format as sdk's wallets
+type storeWallet struct {
+	store gateway.WalletStore
+}
+
+// NewStoreWallet creates wallet backed by store
+func NewStoreWallet(store gateway.WalletStore) Wallet {
+	return &storeWallet{store: store}
+}
+
+func (w *storeWallet) Init(ctx context.Context) error {
+	if initer, ok := w.store.(WalletIniter); ok {
+		return initer.Init(ctx)
+	}
+	return nil
+}
+
+func (w *storeWallet) Put(label string, id gateway.Identity) error {
+	x509Id, ok := id.(*gateway.X509Identity)
+	if !ok {
+		return ErrUnsupportedIdentity
+	}
+	data, err := json.Marshal(x509Id)
+	if err != nil {
+		return err
+	}
+	return w.store.Put(label, data)
+}
+
+func (w *storeWallet) Get(label string) (gateway.Identity, error) {
+	data, err := w.store.Get(label)
+	if err != nil {
+		return nil, err
+	}
+	var id *gateway.X509Identity
+	if err = json.Unmarshal(data, &id); err != nil {
+		return nil, err
+	}
+	if id == nil || id.IDType != "X.509" {
+		return nil, ErrUnsupportedIdentity
+	}
+	return id, nil
+}
+
+func (w *storeWallet) Remove(label string) error {
+	return w.store.Remove(label)
+}
+
+func (w *storeWallet) Exists(label string) bool {
+	return w.store.Exists(label)
+}
+
+func (w *storeWallet) Has(label string) (bool, error) {
+	if checker, ok := w.store.(walletChecker); ok {
+		return checker.Has(label)
+	}
+	return w.store.Exists(label), nil
+}
+
+func (w *storeWallet) List() ([]string, error) {
+	return w.store.List()
+}
@@ -0,0 +1,156 @@
+package model
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"github.com/hyperledger/fabric-sdk-go/pkg/gateway"
+)
+
+const walletEnvelopeVersion = 1
+
+// walletEnvelope is the stored form of an encrypted identity
+// data key is random per identity and encrypted by master key, label is used as
+// additional data, so an envelope can't be moved to another label
+type walletEnvelope struct {
+	Version int    `json:"encVersion"`
+	DataKey []byte `json:"dataKey"`
+	Data    []byte `json:"data"`
+}
+
+type encryptedWalletStore struct {
+	store  gateway.WalletStore
+	master cipher.AEAD
+
+	// read identities saved before encryption is enabled, and encrypt them
+	allowPlaintext bool
+}
+
+func newEncryptedWalletStore(store gateway.WalletStore, masterKey []byte, allowPlaintext bool) (*encryptedWalletStore, error) {
+	if len(masterKey) != 32 {
+		return nil, ErrInvalidWalletMasterKey
+	}
+	aead, err := newGCM(masterKey)
+	if err != nil {
+		return nil, err
+	}
+	return &encryptedWalletStore{
+		store:          store,
+		master:         aead,
+		allowPlaintext: allowPlaintext,
+	}, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealGCM returns nonce followed by ciphertext
+func sealGCM(aead cipher.AEAD, plain, ad []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plain, ad), nil
+}
+
+func openGCM(aead cipher.AEAD, sealed, ad []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, ErrInvalidWalletEnvelope
+	}
+	n := aead.NonceSize()
+	return aead.Open(nil, sealed[:n], sealed[n:], ad)
+}
+
+func (s *encryptedWalletStore) Init(ctx context.Context) error {
+	if initer, ok := s.store.(WalletIniter); ok {
+		return initer.Init(ctx)
+	}
+	return nil
+}
+
+func (s *encryptedWalletStore) Put(label string, content []byte) error {
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return err
+	}
+	dataAEAD, err := newGCM(dataKey)
+	if err != nil {
+		return err
+	}
+
+	env := &walletEnvelope{Version: walletEnvelopeVersion}
+	env.Data, err = sealGCM(dataAEAD, content, []byte(label))
+	if err != nil {
+		return err
+	}
+	env.DataKey, err = sealGCM(s.master, dataKey, []byte(label))
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(env)
+	if err != nil {
+		return err
+	}
+	return s.store.Put(label, data)
+}
+
+// Get decrypts identity
+// identity saved before encryption is enabled is rejected, unless allowPlaintext is set,
+// then it's encrypted at once, so it can't be replaced by a plaintext one after migration
+func (s *encryptedWalletStore) Get(label string) ([]byte, error) {
+	data, err := s.store.Get(label)
+	if err != nil {
+		return nil, err
+	}
+
+	var env walletEnvelope
+	if err = json.Unmarshal(data, &env); err != nil || env.Version == 0 {
+		if !s.allowPlaintext {
+			return nil, ErrPlaintextWalletIdentity
+		}
+		if err = s.Put(label, data); err != nil {
+			return nil, err
+		}
+		return data, nil
+	}
+	if env.Version != walletEnvelopeVersion {
+		return nil, ErrInvalidWalletEnvelope
+	}
+
+	dataKey, err := openGCM(s.master, env.DataKey, []byte(label))
+	if err != nil {
+		return nil, err
+	}
+	dataAEAD, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return openGCM(dataAEAD, env.Data, []byte(label))
+}
+
+func (s *encryptedWalletStore) Remove(label string) error {
+	return s.store.Remove(label)
+}
+
+func (s *encryptedWalletStore) Exists(label string) bool {
+	return s.store.Exists(label)
+}
+
+func (s *encryptedWalletStore) Has(label string) (bool, error) {
+	if checker, ok := s.store.(walletChecker); ok {
+		return checker.Has(label)
+	}
+	return s.store.Exists(label), nil
+}
+
+func (s *encryptedWalletStore) List() ([]string, error) {
+	return s.store.List()
+}
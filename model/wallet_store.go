@@ -0,0 +1,224 @@
+package model
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/leyle/go-api-starter/couchdb"
+	"github.com/leyle/go-api-starter/logmiddleware"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const DBNameWallet = "wallet"
+
+var ErrWalletIdentityNotFound = errors.New("identity doesn't exist in wallet")
+
+const walletFileExt = ".id"
+
+// fileWalletStore keeps one file per label, the same layout as sdk's file system wallet
+type fileWalletStore struct {
+	path string
+}
+
+func newFileWalletStore(path string) (*fileWalletStore, error) {
+	path = filepath.Clean(path)
+	if err := os.MkdirAll(path, 0700); err != nil {
+		return nil, err
+	}
+	return &fileWalletStore{path: path}, nil
+}
+
+func (s *fileWalletStore) file(label string) string {
+	return filepath.Join(s.path, label+walletFileExt)
+}
+
+func (s *fileWalletStore) Put(label string, content []byte) error {
+	// write to a temp file first, so a crash doesn't leave a broken identity
+	tmp := s.file(label) + ".tmp"
+	if err := ioutil.WriteFile(tmp, content, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.file(label))
+}
+
+func (s *fileWalletStore) Get(label string) ([]byte, error) {
+	data, err := ioutil.ReadFile(s.file(label))
+	if os.IsNotExist(err) {
+		return nil, ErrWalletIdentityNotFound
+	}
+	return data, err
+}
+
+func (s *fileWalletStore) Remove(label string) error {
+	err := os.Remove(s.file(label))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (s *fileWalletStore) Exists(label string) bool {
+	ok, _ := s.Has(label)
+	return ok
+}
+
+func (s *fileWalletStore) Has(label string) (bool, error) {
+	_, err := os.Stat(s.file(label))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *fileWalletStore) List() ([]string, error) {
+	files, err := ioutil.ReadDir(s.path)
+	if err != nil {
+		return nil, err
+	}
+	var labels []string
+	for _, f := range files {
+		if !f.IsDir() && strings.HasSuffix(f.Name(), walletFileExt) {
+			labels = append(labels, strings.TrimSuffix(f.Name(), walletFileExt))
+		}
+	}
+	return labels, nil
+}
+
+// couchDBWalletStore keeps identities in couchdb, so all instances share them
+// doc id is the label
+type couchDBWalletStore struct {
+	opt *couchdb.CouchDBOption
+}
+
+type walletDoc struct {
+	Id      string `json:"id"`
+	Rev     string `json:"_rev,omitempty"`
+	Label   string `json:"label"`
+	Content string `json:"content"`
+}
+
+func newCouchDBWalletStore(opt *couchdb.CouchDBOption) *couchDBWalletStore {
+	return &couchDBWalletStore{opt: opt}
+}
+
+func (s *couchDBWalletStore) ds() *couchdb.CouchDBClient {
+	return couchdb.New(s.opt, DBNameWallet)
+}
+
+// wallet interface has no context, it's used by background jobs too
+func (s *couchDBWalletStore) ctx() context.Context {
+	logger := logmiddleware.GetLogger(logmiddleware.LogTargetConsole)
+	return logger.WithContext(context.Background())
+}
+
+// Init creates database and index
+func (s *couchDBWalletStore) Init(ctx context.Context) error {
+	err := s.ds().CreateDatabase(ctx)
+	if err != nil {
+		return err
+	}
+	return s.ds().CreateIndex(ctx, []string{"label"})
+}
+
+func (s *couchDBWalletStore) get(label string) (*walletDoc, error) {
+	var doc *walletDoc
+	_, err := s.ds().GetById(s.ctx(), label, &doc)
+	if err != nil {
+		if err == couchdb.NoIdData {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return doc, nil
+}
+
+func (s *couchDBWalletStore) Put(label string, content []byte) error {
+	doc, err := s.get(label)
+	if err != nil {
+		return err
+	}
+	if doc == nil {
+		doc = &walletDoc{Id: label, Label: label}
+	}
+	doc.Content = string(content)
+
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	_, err = s.ds().UpdateById(s.ctx(), label, data)
+	if err != nil && isCouchDBConflict(err) {
+		return ErrDocConflict
+	}
+	return err
+}
+
+func (s *couchDBWalletStore) Get(label string) ([]byte, error) {
+	doc, err := s.get(label)
+	if err != nil {
+		return nil, err
+	}
+	if doc == nil {
+		return nil, ErrWalletIdentityNotFound
+	}
+	return []byte(doc.Content), nil
+}
+
+func (s *couchDBWalletStore) Remove(label string) error {
+	doc, err := s.get(label)
+	if err != nil || doc == nil {
+		return err
+	}
+	return s.ds().DeleteById(s.ctx(), label, doc.Rev)
+}
+
+// Exists takes couchdb errors as not exist, use Has if it matters
+func (s *couchDBWalletStore) Exists(label string) bool {
+	ok, _ := s.Has(label)
+	return ok
+}
+
+func (s *couchDBWalletStore) Has(label string) (bool, error) {
+	doc, err := s.get(label)
+	if err != nil {
+		return false, err
+	}
+	return doc != nil, nil
+}
+
+func (s *couchDBWalletStore) List() ([]string, error) {
+	const pageSize = 200
+	req := &couchDBFindRequest{
+		Selector: map[string]interface{}{
+			"label": map[string]interface{}{
+				"$gt": nil,
+			},
+		},
+		Limit: pageSize,
+	}
+
+	var labels []string
+	for {
+		var resp struct {
+			Docs []*walletDoc `json:"docs"`
+		}
+		bookmark, err := couchDBFind(s.ctx(), s.opt, DBNameWallet, req, &resp)
+		if err != nil {
+			return nil, err
+		}
+		for _, doc := range resp.Docs {
+			labels = append(labels, doc.Label)
+		}
+		if len(resp.Docs) < pageSize || bookmark == "" {
+			break
+		}
+		req.Bookmark = bookmark
+	}
+	return labels, nil
+}
@@ -0,0 +1,137 @@
+package model
+
+import (
+	"bytes"
+	"github.com/hyperledger/fabric-sdk-go/pkg/gateway"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestEncryptedFileWallet(t *testing.T) {
+	dir := t.TempDir()
+	key := bytes.Repeat([]byte{1}, 32)
+	opt := &FabricGWOption{WalletPath: dir, WalletMasterKey: key}
+
+	wallet, err := NewWallet(opt, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := gateway.NewX509Identity("Org1MSP", "cert-pem", "key-pem")
+	if err = wallet.Put("alice", id); err != nil {
+		t.Fatal(err)
+	}
+
+	raw, err := ioutil.ReadFile(filepath.Join(dir, "alice.id"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(raw, []byte("key-pem")) {
+		t.Fatal("private key is saved in plaintext")
+	}
+
+	got, err := wallet.Get("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	x509Id := got.(*gateway.X509Identity)
+	if x509Id.Key() != "key-pem" || x509Id.Certificate() != "cert-pem" || x509Id.MspID != "Org1MSP" {
+		t.Fatalf("unexpected identity %+v", x509Id)
+	}
+	if labels, _ := wallet.List(); len(labels) != 1 || labels[0] != "alice" {
+		t.Fatalf("unexpected labels %v", labels)
+	}
+
+	// wrong master key can't decrypt it
+	opt.WalletMasterKey = bytes.Repeat([]byte{2}, 32)
+	other, err := NewWallet(opt, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = other.Get("alice"); err == nil {
+		t.Fatal("expect error with wrong master key")
+	}
+
+	// envelope can't be moved to another label
+	if err = ioutil.WriteFile(filepath.Join(dir, "bob.id"), raw, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = wallet.Get("bob"); err == nil {
+		t.Fatal("expect error for moved identity")
+	}
+
+	opt.WalletMasterKey = []byte("short")
+	if _, err = NewWallet(opt, nil); err != ErrInvalidWalletMasterKey {
+		t.Fatalf("expect invalid key error, got %v", err)
+	}
+}
+
+func TestEncryptedWalletReadsPlaintext(t *testing.T) {
+	dir := t.TempDir()
+	plain, err := gateway.NewFileSystemWallet(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = plain.Put("alice", gateway.NewX509Identity("Org1MSP", "cert-pem", "key-pem")); err != nil {
+		t.Fatal(err)
+	}
+
+	opt := &FabricGWOption{WalletPath: dir, WalletMasterKey: bytes.Repeat([]byte{1}, 32)}
+	wallet, err := NewWallet(opt, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = wallet.Get("alice"); err != ErrPlaintextWalletIdentity {
+		t.Fatalf("expect plaintext error, got %v", err)
+	}
+
+	// migration reads it and encrypts it
+	opt.WalletAllowPlaintext = true
+	wallet, err = NewWallet(opt, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := wallet.Get("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.(*gateway.X509Identity).Key() != "key-pem" {
+		t.Fatal("unexpected plaintext identity")
+	}
+	raw, err := ioutil.ReadFile(filepath.Join(dir, "alice.id"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(raw, []byte("key-pem")) {
+		t.Fatal("plaintext identity isn't encrypted after read")
+	}
+
+	exist, err := WalletExists(wallet, "alice")
+	if err != nil || !exist {
+		t.Fatalf("expect alice in wallet, %v", err)
+	}
+	exist, err = WalletExists(wallet, "bob")
+	if err != nil || exist {
+		t.Fatalf("expect bob not in wallet, %v", err)
+	}
+}
+
+func TestMemoryWallet(t *testing.T) {
+	wallet, err := NewWallet(&FabricGWOption{WalletBackend: WalletBackendMemory}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = wallet.Put("alice", gateway.NewX509Identity("Org1MSP", "cert-pem", "key-pem")); err != nil {
+		t.Fatal(err)
+	}
+	if !wallet.Exists("alice") {
+		t.Fatal("expect alice in wallet")
+	}
+	if err = wallet.Remove("alice"); err != nil || wallet.Exists("alice") {
+		t.Fatal("expect alice removed")
+	}
+
+	if _, err = NewWallet(&FabricGWOption{WalletBackend: "redis"}, nil); err == nil {
+		t.Fatal("expect unknown backend error")
+	}
+}
@@ -0,0 +1,175 @@
+package model
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"golang.org/x/crypto/pbkdf2"
+	"time"
+)
+
+const (
+	IdentityBundleVersion = 1
+	IdentityBundleKDF     = "pbkdf2-sha256"
+
+	defaultBundleIterations = 200000
+	// bundle comes from outside, too many iterations make import a cpu burner
+	maxBundleIterations = 5000000
+	minBundleIterations = 10000
+)
+
+var (
+	ErrInvalidIdentityBundle = errors.New("invalid identity bundle")
+	ErrWrongBundlePasswd     = errors.New("wrong identity bundle password")
+	ErrIdentityKeyMismatch   = errors.New("private key doesn't match certificate")
+	ErrIdentityCertUntrusted = errors.New("certificate isn't issued by the org's ca")
+	ErrIdentityMSPMismatch   = errors.New("identity's msp id isn't the org's msp id")
+)
+
+// IdentityBundle is a wallet identity protected by password, it can be moved between hosts
+// private key is encrypted by AES-256-GCM with a key derived from password,
+// msp id and certificate are authenticated with it, so they can't be replaced
+type IdentityBundle struct {
+	Version      int    `json:"version"`
+	Label        string `json:"label"`
+	MspId        string `json:"mspId"`
+	Certificate  string `json:"certificate"`
+	KDF          string `json:"kdf"`
+	Iterations   int    `json:"iterations"`
+	Salt         []byte `json:"salt"`
+	EncryptedKey []byte `json:"encryptedKey"`
+	ExportedAt   int64  `json:"exportedAt"`
+}
+
+// SealIdentityBundle encrypts key by passwd
+func SealIdentityBundle(label, mspId, cert, key, passwd string) (*IdentityBundle, error) {
+	b := &IdentityBundle{
+		Version:     IdentityBundleVersion,
+		Label:       label,
+		MspId:       mspId,
+		Certificate: cert,
+		KDF:         IdentityBundleKDF,
+		Iterations:  defaultBundleIterations,
+		Salt:        make([]byte, 16),
+		ExportedAt:  time.Now().Unix(),
+	}
+	if _, err := rand.Read(b.Salt); err != nil {
+		return nil, err
+	}
+
+	aead, err := newGCM(b.deriveKey(passwd))
+	if err != nil {
+		return nil, err
+	}
+	b.EncryptedKey, err = sealGCM(aead, []byte(key), b.additionalData())
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Open decrypts private key by passwd
+func (b *IdentityBundle) Open(passwd string) (string, error) {
+	if b.Version != IdentityBundleVersion || b.KDF != IdentityBundleKDF ||
+		b.Iterations < minBundleIterations || b.Iterations > maxBundleIterations ||
+		len(b.Salt) == 0 || b.MspId == "" || b.Certificate == "" {
+		return "", ErrInvalidIdentityBundle
+	}
+
+	aead, err := newGCM(b.deriveKey(passwd))
+	if err != nil {
+		return "", err
+	}
+	key, err := openGCM(aead, b.EncryptedKey, b.additionalData())
+	if err != nil {
+		// gcm can't tell wrong password from modified bundle
+		return "", ErrWrongBundlePasswd
+	}
+	return string(key), nil
+}
+
+func (b *IdentityBundle) deriveKey(passwd string) []byte {
+	return pbkdf2.Key([]byte(passwd), b.Salt, b.Iterations, 32, sha256.New)
+}
+
+func (b *IdentityBundle) additionalData() []byte {
+	return []byte(b.MspId + "\n" + b.Certificate)
+}
+
+// VerifyIdentity checks certPEM is issued by caChainPEM and keyPEM is its private key
+// the first certificate of ca chain is root ca, others are intermediate cas
+func VerifyIdentity(certPEM, keyPEM string, caChainPEM []byte) (*x509.Certificate, error) {
+	cert, err := parsePEMCert([]byte(certPEM))
+	if err != nil {
+		return nil, err
+	}
+
+	roots := x509.NewCertPool()
+	inters := x509.NewCertPool()
+	rest := caChainPEM
+	for i := 0; ; i++ {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			if i == 0 {
+				return nil, ErrIdentityCertUntrusted
+			}
+			break
+		}
+		caCert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		if i == 0 {
+			roots.AddCert(caCert)
+		} else {
+			inters.AddCert(caCert)
+		}
+	}
+
+	_, err = cert.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: inters,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		return nil, ErrIdentityCertUntrusted
+	}
+
+	key, err := parsePEMKey([]byte(keyPEM))
+	if err != nil {
+		return nil, err
+	}
+	pub, ok := key.Public().(interface{ Equal(crypto.PublicKey) bool })
+	if !ok || !pub.Equal(cert.PublicKey) {
+		return nil, ErrIdentityKeyMismatch
+	}
+	return cert, nil
+}
+
+func parsePEMCert(data []byte) (*x509.Certificate, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, ErrInvalidIdentityBundle
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// fabric ca returns pkcs8 keys, sec1 ec keys are accepted too
+func parsePEMKey(data []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, ErrInvalidIdentityBundle
+	}
+	if key, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+		signer, ok := key.(crypto.Signer)
+		if !ok {
+			return nil, ErrInvalidIdentityBundle
+		}
+		return signer, nil
+	}
+	return x509.ParseECPrivateKey(block.Bytes)
+}
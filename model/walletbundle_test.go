@@ -0,0 +1,96 @@
+package model
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func testCert(t *testing.T, cn string, serial int64, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage = x509.KeyUsageCertSign
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key, string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+}
+
+func testKeyPEM(t *testing.T, key *ecdsa.PrivateKey) string {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+}
+
+func TestIdentityBundle(t *testing.T) {
+	b, err := SealIdentityBundle("alice", "Org1MSP", "cert-pem", "key-pem", "bundle-passwd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := b.Open("bundle-passwd")
+	if err != nil || key != "key-pem" {
+		t.Fatalf("unexpected key %q, %v", key, err)
+	}
+	if _, err = b.Open("wrong"); err != ErrWrongBundlePasswd {
+		t.Fatalf("expect wrong password error, got %v", err)
+	}
+
+	b.MspId = "Org2MSP"
+	if _, err = b.Open("bundle-passwd"); err != ErrWrongBundlePasswd {
+		t.Fatalf("expect error for modified msp id, got %v", err)
+	}
+
+	b.Iterations = maxBundleIterations + 1
+	if _, err = b.Open("bundle-passwd"); err != ErrInvalidIdentityBundle {
+		t.Fatalf("expect invalid bundle error, got %v", err)
+	}
+}
+
+func TestVerifyIdentity(t *testing.T) {
+	ca, caKey, caPEM := testCert(t, "ca", 1, nil, nil)
+	_, userKey, userPEM := testCert(t, "alice", 2, ca, caKey)
+
+	cert, err := VerifyIdentity(userPEM, testKeyPEM(t, userKey), []byte(caPEM))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert.Subject.CommonName != "alice" {
+		t.Fatalf("unexpected common name %s", cert.Subject.CommonName)
+	}
+
+	_, otherKey, _ := testCert(t, "bob", 3, ca, caKey)
+	if _, err = VerifyIdentity(userPEM, testKeyPEM(t, otherKey), []byte(caPEM)); err != ErrIdentityKeyMismatch {
+		t.Fatalf("expect key mismatch error, got %v", err)
+	}
+
+	_, _, otherCAPEM := testCert(t, "other-ca", 4, nil, nil)
+	if _, err = VerifyIdentity(userPEM, testKeyPEM(t, userKey), []byte(otherCAPEM)); err != ErrIdentityCertUntrusted {
+		t.Fatalf("expect untrusted error, got %v", err)
+	}
+}